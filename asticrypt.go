@@ -1,12 +1,27 @@
 package asticrypt
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
 )
 
 // Vars
 var (
-	aesKeyBits     = 256
-	b64            = base64.StdEncoding
-	privateKeyBits = 4096
+	aesKeyBits                     = 256
+	b64                            = base64.StdEncoding
+	encryptedMessageVersionCurrent = EncryptedMessageVersion2
+	encryptedStreamChunkSize       = 64 * 1024
+	encryptionModeDefault          = EncryptionModeAES256GCM
+	privateKeyBits                 = 4096
+	supportedEncryptionModes       = []string{EncryptionModeAES256GCM, EncryptionModeChaCha20Poly1305, EncryptionModeXChaCha20Poly1305, EncryptionModeAES256CFB}
+	supportedKeyWraps              = []string{KeyWrapRSAOAEPSHA512, KeyWrapX25519HKDFSHA256, KeyWrapECDHP256HKDFSHA256, KeyWrapECDHP384HKDFSHA256, KeyWrapEphemeralX25519HKDFSHA256}
+	supportedSignatureSchemes      = []string{SignatureSchemeRSAPKCS1v15SHA512, SignatureSchemeEd25519, SignatureSchemeECDSAP256SHA512, SignatureSchemeECDSAP384SHA512}
 )
+
+// hmacSHA256 computes an HMAC-SHA256
+func hmacSHA256(key, data []byte) []byte {
+	var h = hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
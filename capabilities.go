@@ -0,0 +1,104 @@
+package asticrypt
+
+import (
+	"context"
+	"fmt"
+)
+
+// Protocol versions
+// Messages sent by clients predating the handshake have no version and are considered as ProtocolVersionLegacy
+const (
+	ProtocolVersionLegacy = 0
+	ProtocolVersion1      = 1
+	// Responses carry the request ID of their request
+	ProtocolVersion2       = 2
+	ProtocolVersionCurrent = ProtocolVersion2
+)
+
+// Capabilities
+const (
+	CapabilityBatch            = "batch"
+	CapabilityClockSync        = "clock-sync"
+	CapabilityErrorCodes       = "error-codes"
+	CapabilityForwardSecrecy   = "forward-secrecy"
+	CapabilityPrekeys          = "prekeys"
+	CapabilityReplayProtection = "replay-protection"
+	CapabilitySessions         = "sessions"
+)
+
+// supportedCapabilities represents the capabilities of this version of the library
+var supportedCapabilities = []string{
+	CapabilityBatch,
+	CapabilityClockSync,
+	CapabilityErrorCodes,
+	CapabilityForwardSecrecy,
+	CapabilityPrekeys,
+	CapabilityReplayProtection,
+	CapabilitySessions,
+}
+
+// UpgradeRequiredLabel is the label sent to clients whose protocol version is too old
+const UpgradeRequiredLabel = "Your application is too old, please upgrade it"
+
+// BodyCapabilities represents a body containing the protocol version and capabilities of a peer
+type BodyCapabilities struct {
+	Capabilities    []string `json:"capabilities,omitempty"`
+	EncryptionModes []string `json:"encryption_modes,omitempty"`
+	ProtocolVersion int      `json:"protocol_version"`
+}
+
+// LocalCapabilities returns the protocol version and capabilities of this version of the library
+func LocalCapabilities() BodyCapabilities {
+	return BodyCapabilities{
+		Capabilities:    append([]string{}, supportedCapabilities...),
+		EncryptionModes: append([]string{}, supportedEncryptionModes...),
+		ProtocolVersion: ProtocolVersionCurrent,
+	}
+}
+
+// Has checks whether a capability is supported
+func (c BodyCapabilities) Has(capability string) bool {
+	return isSupported(capability, c.Capabilities)
+}
+
+// Negotiate returns the capabilities and encryption modes supported by both peers as well as the lowest protocol
+// version
+// Encryption modes keep the order of the remote peer so that its preferences prevail
+func (c BodyCapabilities) Negotiate(remote BodyCapabilities) (o BodyCapabilities) {
+	o.ProtocolVersion = c.ProtocolVersion
+	if remote.ProtocolVersion < o.ProtocolVersion {
+		o.ProtocolVersion = remote.ProtocolVersion
+	}
+	for _, v := range remote.Capabilities {
+		if isSupported(v, c.Capabilities) {
+			o.Capabilities = append(o.Capabilities, v)
+		}
+	}
+	for _, v := range remote.EncryptionModes {
+		if isSupported(v, c.EncryptionModes) {
+			o.EncryptionModes = append(o.EncryptionModes, v)
+		}
+	}
+	return
+}
+
+// CheckProtocolVersion returns an error wrapping ErrUpgradeRequired if the protocol version is lower than the minimum
+func CheckProtocolVersion(version, min int) error {
+	if version < min {
+		return HandlerError{
+			Err:   WithCode(ErrUpgradeRequired, fmt.Errorf("protocol version %d is lower than %d", version, min)),
+			Label: UpgradeRequiredLabel,
+		}
+	}
+	return nil
+}
+
+// protocolVersionContextKey is the context key of the protocol version
+type protocolVersionContextKey struct{}
+
+// ProtocolVersionFromContext returns the protocol version of the message being handled by a router
+// It allows handlers to fall back for older clients
+func ProtocolVersionFromContext(ctx context.Context) int {
+	v, _ := ctx.Value(protocolVersionContextKey{}).(int)
+	return v
+}
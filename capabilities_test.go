@@ -0,0 +1,33 @@
+package asticrypt_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/asticode/go-asticrypt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapabilities(t *testing.T) {
+	// Negotiate
+	var l = asticrypt.LocalCapabilities()
+	assert.Equal(t, asticrypt.ProtocolVersionCurrent, l.ProtocolVersion)
+	assert.True(t, l.Has(asticrypt.CapabilityReplayProtection))
+	c := l.Negotiate(asticrypt.BodyCapabilities{
+		Capabilities:    []string{"unknown", asticrypt.CapabilityClockSync},
+		EncryptionModes: []string{asticrypt.EncryptionModeChaCha20Poly1305, "unknown"},
+	})
+	assert.Equal(t, asticrypt.BodyCapabilities{
+		Capabilities:    []string{asticrypt.CapabilityClockSync},
+		EncryptionModes: []string{asticrypt.EncryptionModeChaCha20Poly1305},
+		ProtocolVersion: asticrypt.ProtocolVersionLegacy,
+	}, c)
+
+	// Check protocol version
+	assert.NoError(t, asticrypt.CheckProtocolVersion(asticrypt.ProtocolVersion1, asticrypt.ProtocolVersion1))
+	err := asticrypt.CheckProtocolVersion(asticrypt.ProtocolVersionLegacy, asticrypt.ProtocolVersion1)
+	assert.True(t, errors.Is(err, asticrypt.ErrUpgradeRequired))
+	assert.Equal(t, asticrypt.BodyError{Code: asticrypt.ErrorCodeUpgradeRequired, Label: asticrypt.UpgradeRequiredLabel}, asticrypt.NewBodyError(err, "label"))
+	assert.Equal(t, 0, asticrypt.ProtocolVersionFromContext(context.Background()))
+}
@@ -0,0 +1,476 @@
+package asticrypt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ClientOptions represents the client options
+type ClientOptions struct {
+	// Base URL of the server, without trailing slash
+	Addr       string
+	HTTPClient *http.Client
+	// Called with errors that don't make calls fail, such as clock sync errors
+	OnError func(ctx context.Context, err error)
+	// Defaults to "/encrypted"
+	PatternEncrypted string
+	// Defaults to "/time". If set to "-", the clock is not synced with the server
+	// Syncing the clock before the first call is best effort: if it fails, the local clock is used
+	PatternTime string
+	// If true, a session is opened so that calls don't require public key operations
+	// Sessions are only opened once the server capabilities are known so that no round trip is added before the
+	// first call. Calls fall back to public keys if the server doesn't advertise the sessions capability
+	Sessions bool
+	// Used to validate replies. Defaults to BodyMessageValidityDefault
+	Validity time.Duration
+}
+
+// Client represents a client of an asticrypt server
+// It is safe for concurrent use
+type Client struct {
+	capabilities        *BodyCapabilities
+	clockOffset         time.Duration
+	clockSynced         bool
+	m                   *sync.Mutex
+	o                   ClientOptions
+	prvSrc              *PrivateKey
+	pubDst              *PublicKey
+	session             *Session
+	sessionsUnsupported bool
+}
+
+// clientSessionMargin is the duration before its expiration after which a session is renewed
+const clientSessionMargin = time.Minute
+
+// NewClient creates a new client
+func NewClient(o ClientOptions) *Client {
+	if o.HTTPClient == nil {
+		o.HTTPClient = http.DefaultClient
+	}
+	if len(o.PatternEncrypted) == 0 {
+		o.PatternEncrypted = "/encrypted"
+	}
+	if len(o.PatternTime) == 0 {
+		o.PatternTime = "/time"
+	}
+	return &Client{
+		m: &sync.Mutex{},
+		o: o,
+	}
+}
+
+// SetKeys sets the client private key and the server public key
+// They can be nil as long as only Do is used
+func (c *Client) SetKeys(prvSrc *PrivateKey, pubDst *PublicKey) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.prvSrc = prvSrc
+	c.pubDst = pubDst
+	c.session = nil
+}
+
+// SetCapabilities sets the capabilities advertised by the server
+// They're also set automatically when NameReferences is called, alone or in a batch
+func (c *Client) SetCapabilities(remote BodyCapabilities) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	var cs = LocalCapabilities().Negotiate(remote)
+	c.capabilities = &cs
+	c.sessionsUnsupported = false
+}
+
+// updateCapabilities sets the capabilities if the call is a successful NameReferences call
+func (c *Client) updateCapabilities(name string, out interface{}) {
+	if name != NameReferences {
+		return
+	}
+	if b, ok := out.(*BodyReferences); ok && b != nil {
+		c.SetCapabilities(b.Capabilities)
+	}
+}
+
+// requiresRequestID checks whether responses must carry the request ID of their request based on either the
+// negotiated protocol version or the protocol version of the response
+func (c *Client) requiresRequestID(responseVersion int) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return responseVersion >= ProtocolVersion2 || (c.capabilities != nil && c.capabilities.ProtocolVersion >= ProtocolVersion2)
+}
+
+// keys returns the keys
+func (c *Client) keys() (*PrivateKey, *PublicKey) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.prvSrc, c.pubDst
+}
+
+// Now returns the local time corrected by the clock offset with the server
+func (c *Client) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return time.Now().Add(c.clockOffset)
+}
+
+// SyncClock computes the clock offset with the server so that messages are not rejected when the local clock drifts
+func (c *Client) SyncClock(ctx context.Context) (err error) {
+	// Send HTTP request
+	var b BodyTime
+	var sentAt = time.Now()
+	if err = c.Do(ctx, http.MethodGet, c.o.PatternTime, nil, &b); err != nil {
+		err = errors.Wrap(err, "sending HTTP request failed")
+		return
+	}
+
+	// Update clock offset
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.clockOffset = ClockOffset(b.Now, sentAt, time.Now())
+	c.clockSynced = true
+	return
+}
+
+// shouldSyncClock checks whether the clock needs to be synced
+func (c *Client) shouldSyncClock() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return !c.clockSynced && c.o.PatternTime != "-"
+}
+
+// skipClockSync prevents the clock from being synced before next calls
+// SyncClock can still be called explicitly
+func (c *Client) skipClockSync() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.clockSynced = true
+}
+
+// Do sends a plain JSON HTTP request
+// Errors replied by the server are returned as BodyError
+func (c *Client) Do(ctx context.Context, method, pattern string, in, out interface{}) (err error) {
+	// Send
+	var status int
+	var b []byte
+	if status, b, err = c.send(ctx, method, pattern, in, ""); err != nil {
+		return
+	}
+
+	// Process status code
+	if status != http.StatusOK {
+		err = newBodyErrorFromResponse(status, b)
+		return
+	}
+
+	// Unmarshal body
+	if out != nil {
+		if err = json.Unmarshal(b, out); err != nil {
+			err = errors.Wrap(err, "unmarshaling body failed")
+			return
+		}
+	}
+	return
+}
+
+// newBodyErrorFromResponse builds a body error from a plain JSON error response
+func newBodyErrorFromResponse(status int, b []byte) (err error) {
+	var bd BodyError
+	if err = json.Unmarshal(b, &bd); err != nil {
+		err = errors.Wrapf(err, "unmarshaling body of response with status %d failed", status)
+		return
+	}
+	return bd
+}
+
+// send sends an HTTP request and returns the status code and body of the response
+func (c *Client) send(ctx context.Context, method, pattern string, in interface{}, requestID string) (status int, o []byte, err error) {
+	// Marshal body
+	var b []byte
+	if in != nil {
+		if b, err = json.Marshal(in); err != nil {
+			err = errors.Wrap(err, "marshaling body failed")
+			return
+		}
+	}
+
+	// Create new request
+	var r *http.Request
+	if r, err = http.NewRequestWithContext(ctx, method, c.o.Addr+pattern, bytes.NewReader(b)); err != nil {
+		err = errors.Wrap(err, "creating http request failed")
+		return
+	}
+	if len(requestID) > 0 {
+		r.Header.Set(HeaderRequestID, requestID)
+	}
+
+	// Send request
+	var resp *http.Response
+	if resp, err = c.o.HTTPClient.Do(r); err != nil {
+		err = errors.Wrap(err, "sending request failed")
+		return
+	}
+	defer resp.Body.Close()
+	status = resp.StatusCode
+
+	// Read body
+	if o, err = io.ReadAll(resp.Body); err != nil {
+		err = errors.Wrap(err, "reading body failed")
+		return
+	}
+	return
+}
+
+// Call sends an encrypted message and decrypts the reply into out
+// Errors replied by the server, encrypted under NameError or not, are returned as BodyError
+func (c *Client) Call(ctx context.Context, name string, in, out interface{}) (err error) {
+	// Get keys
+	var prvSrc, pubDst = c.keys()
+	if prvSrc == nil || pubDst == nil {
+		err = errors.New("keys are not set")
+		return
+	}
+
+	// Sync clock
+	// Servers predating the time pattern don't expose it, therefore it's only attempted once
+	if c.shouldSyncClock() {
+		if errSync := c.SyncClock(ctx); errSync != nil {
+			c.skipClockSync()
+			if c.o.OnError != nil {
+				c.o.OnError(ctx, errors.Wrap(errSync, "syncing clock failed"))
+			}
+		}
+	}
+
+	// Update capabilities
+	defer func() {
+		if err == nil {
+			c.updateCapabilities(name, out)
+		}
+	}()
+
+	// No session
+	if !c.o.Sessions {
+		return c.call(ctx, name, in, out, prvSrc, pubDst, nil)
+	}
+
+	// Loop until the session is valid
+	// When the server restarts or the session expires earlier than expected, the session is opened once more
+	for attempt := 0; ; attempt++ {
+		// Get session
+		var s *Session
+		if s, err = c.getSession(ctx, prvSrc, pubDst); err != nil {
+			err = errors.Wrap(err, "getting session failed")
+			return
+		}
+
+		// Call
+		if err = c.call(ctx, name, in, out, prvSrc, pubDst, s); s != nil && attempt == 0 && errors.Is(err, ErrSessionExpired) {
+			c.resetSession(s)
+			continue
+		}
+		return
+	}
+}
+
+// getSession returns a valid session, opening a new one if needed
+// It returns a nil session if the server capabilities are not known yet or if the server doesn't support sessions
+func (c *Client) getSession(ctx context.Context, prvSrc *PrivateKey, pubDst *PublicKey) (s *Session, err error) {
+	// Check current session
+	// Servers that don't advertise sessions are never asked to open one since they may not even return error codes
+	c.m.Lock()
+	if c.sessionsUnsupported || c.capabilities == nil || !c.capabilities.Has(CapabilitySessions) {
+		c.m.Unlock()
+		return
+	} else if c.session != nil && !c.session.IsExpired(time.Now().Add(c.clockOffset+clientSessionMargin)) {
+		s = c.session
+		c.m.Unlock()
+		return
+	}
+	c.m.Unlock()
+
+	// Generate ephemeral key
+	// The session key is derived from ephemeral keys only so that compromising long-term keys doesn't expose sessions
+	var k *EphemeralKey
+	if k, err = GenerateEphemeralKey(); err != nil {
+		err = errors.Wrap(err, "generating ephemeral key failed")
+		return
+	}
+
+	// Open session
+	var o Session
+	if err = c.call(ctx, NameSessionOpen, BodySessionOpen{EphemeralKey: k.Public()}, &o, prvSrc, pubDst, nil); errors.Is(err, ErrNotFound) {
+		// Servers advertising sessions without a session store don't know the name
+		c.m.Lock()
+		c.sessionsUnsupported = true
+		c.m.Unlock()
+		err = nil
+		return
+	} else if err != nil {
+		err = errors.Wrap(err, "opening session failed")
+		return
+	}
+
+	// Complete session
+	if err = o.complete(k); err != nil {
+		err = errors.Wrap(err, "completing session failed")
+		return
+	}
+
+	// Store session
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.session = &o
+	s = c.session
+	return
+}
+
+// resetSession resets the session unless it has already been renewed
+func (c *Client) resetSession(s *Session) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.session == s {
+		c.session = nil
+	}
+}
+
+// call sends an encrypted message, within a session if provided, and decrypts the reply into out
+func (c *Client) call(ctx context.Context, name string, in, out interface{}, prvSrc *PrivateKey, pubDst *PublicKey, s *Session) (err error) {
+	// Generate request ID
+	var requestID string
+	if requestID, err = NewRequestID(); err != nil {
+		err = errors.Wrap(err, "generating request ID failed")
+		return
+	}
+
+	// Build body
+	var bout BodyMessage
+	if bout, err = NewBodyMessageWithOptions(name, in, prvSrc, prvSrc.Public(), pubDst, c.Now(), BodyMessageOptions{
+		RequestID: requestID,
+		Session:   s,
+	}); err != nil {
+		err = errors.Wrap(err, "building body failed")
+		return
+	}
+
+	// Send HTTP request
+	var status int
+	var b []byte
+	if status, b, err = c.send(ctx, http.MethodPost, c.o.PatternEncrypted, bout, requestID); err != nil {
+		err = errors.Wrap(err, "sending HTTP request failed")
+		return
+	}
+
+	// Unmarshal body
+	// Errors are only encrypted when the server knows the keys
+	var bin BodyMessage
+	if err = json.Unmarshal(b, &bin); err != nil || (bin.Message == nil && bin.Session == nil) {
+		if status != http.StatusOK {
+			err = newBodyErrorFromResponse(status, b)
+		} else if err != nil {
+			err = errors.Wrap(err, "unmarshaling body failed")
+		} else {
+			err = errors.New("body has no message")
+		}
+		return
+	}
+
+	// Decrypt body
+	var m BodyMessageIn
+	if m, err = bin.DecryptWithOptions(prvSrc, pubDst, c.Now(), BodyMessageDecryptOptions{
+		Response: true,
+		Session:  s,
+		Validity: c.o.Validity,
+	}); err != nil {
+		err = errors.Wrap(err, "decrypting message failed")
+		return
+	}
+
+	// Check request ID
+	// Only legacy servers predating request IDs are allowed not to send it back
+	if (len(m.RequestID) > 0 || c.requiresRequestID(m.ProtocolVersion)) && m.RequestID != requestID {
+		err = fmt.Errorf("request ID %s != response request ID %s", requestID, m.RequestID)
+		return
+	}
+
+	// Process name
+	if m.Name == NameError {
+		// Unmarshal payload
+		var bd BodyError
+		if err = json.Unmarshal(m.Payload, &bd); err != nil {
+			err = errors.Wrap(err, "unmarshaling payload failed")
+			return
+		}
+		err = bd
+		return
+	} else if m.Name != name {
+		err = fmt.Errorf("input name %s != message name %s", name, m.Name)
+		return
+	}
+
+	// Unmarshal payload
+	if out != nil {
+		if err = json.Unmarshal(m.Payload, out); err != nil {
+			err = errors.Wrap(err, "unmarshaling payload failed")
+			return
+		}
+	}
+	return
+}
+
+// BatchCall represents a call sent as part of a batch
+type BatchCall struct {
+	// Set once the batch is done
+	Err  error
+	In   interface{}
+	Name string
+	Out  interface{}
+}
+
+// Batch sends several calls in a single encrypted message so that the public key operations are only done once
+// The returned error is only about the batch itself, errors of each call are stored in their Err field which is a
+// BodyError if the server replied with an error
+func (c *Client) Batch(ctx context.Context, calls []*BatchCall) (err error) {
+	// Build items
+	var is = make([]BodyBatchItem, len(calls))
+	for idx, call := range calls {
+		is[idx].Name = call.Name
+		if call.In != nil {
+			if is[idx].Payload, err = json.Marshal(call.In); err != nil {
+				err = errors.Wrapf(err, "marshaling input of %s failed", call.Name)
+				return
+			}
+		}
+	}
+
+	// Call
+	var rs []BodyBatchResult
+	if err = c.Call(ctx, NameBatch, is, &rs); err != nil {
+		return
+	}
+
+	// Check results
+	if len(rs) != len(calls) {
+		err = fmt.Errorf("%d results for %d calls", len(rs), len(calls))
+		return
+	}
+
+	// Process results
+	for idx, call := range calls {
+		if rs[idx].Error != nil {
+			call.Err = *rs[idx].Error
+		} else if call.Out != nil && len(rs[idx].Payload) > 0 {
+			if errUnmarshal := json.Unmarshal(rs[idx].Payload, call.Out); errUnmarshal != nil {
+				call.Err = errors.Wrap(errUnmarshal, "unmarshaling payload failed")
+			} else {
+				c.updateCapabilities(call.Name, call.Out)
+			}
+		}
+	}
+	return
+}
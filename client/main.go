@@ -1,8 +1,8 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"net/http"
 	"os"
 	"path/filepath"
 
@@ -17,14 +17,16 @@ import (
 
 // Vars
 var (
-	clientPrivateKey   *asticrypt.PrivateKey
 	accounts           = make(map[string]string)
-	httpClient         = &http.Client{}
+	apiClient          *asticrypt.Client
+	clientPrivateKey   *asticrypt.PrivateKey
 	googleClientID     string
 	googleClientSecret string
 	now                time.Time
 	pathConfiguration  string
 	pathExecutable     string
+	prefetchedAccounts []string
+	serverCapabilities asticrypt.BodyCapabilities
 	serverPublicKey    *asticrypt.PublicKey
 	ServerPublicAddr   string
 	Version            string
@@ -35,6 +37,13 @@ func main() {
 	// TODO For test purposes
 	ServerPublicAddr = "http://127.0.0.1:4000"
 
+	// Build api client
+	apiClient = asticrypt.NewClient(asticrypt.ClientOptions{
+		Addr:     ServerPublicAddr,
+		OnError:  func(ctx context.Context, err error) { astilog.Error(err) },
+		Sessions: true,
+	})
+
 	// Parse flags
 	flag.Parse()
 
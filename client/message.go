@@ -23,6 +23,8 @@ func handleMessages(w *astilectron.Window, m bootstrap.MessageIn) {
 		handleMessageLogin(w, m)
 	case "logout":
 		handleMessageLogout(w)
+	case "passphrase.change":
+		handleMessagePassphraseChange(w, m)
 	case "sign.up":
 		handleMessageSignUp(w, m)
 	}
@@ -37,7 +39,10 @@ type messageError struct {
 // update updates the message error
 func (e *messageError) update(err error, devMsg string, userMsg string) {
 	e.err = errors.Wrap(err, devMsg+" failed")
-	if bodyError, ok := err.(asticrypt.BodyError); ok {
+	var bodyError asticrypt.BodyError
+	if errors.Is(err, asticrypt.ErrUpgradeRequired) {
+		e.userMsg = asticrypt.UpgradeRequiredLabel
+	} else if errors.As(err, &bodyError) {
 		e.userMsg = bodyError.Label
 	} else {
 		e.userMsg = userMsg
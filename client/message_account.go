@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 
 	"crypto/tls"
@@ -30,7 +31,7 @@ func handleMessageAccountAdd(w *astilectron.Window, m bootstrap.MessageIn) {
 
 	// Add account
 	var label string
-	if err = sendEncryptedHTTPRequest(asticrypt.NameAccountAdd, account, &label); err != nil {
+	if err = apiClient.Call(context.Background(), asticrypt.NameAccountAdd, account, &label); err != nil {
 		msgError.update(err, "adding account", defaultUserErrorMsg)
 		return
 	}
@@ -50,9 +51,12 @@ func handleMessageAccountList(w *astilectron.Window) {
 	defer processMessageError(w, msgError)
 
 	// List accounts
-	var es []string
+	// Accounts prefetched when logging in are only used once
+	var es = prefetchedAccounts
 	var err error
-	if err = sendEncryptedHTTPRequest(asticrypt.NameAccountList, nil, &es); err != nil {
+	if es != nil {
+		prefetchedAccounts = nil
+	} else if err = apiClient.Call(context.Background(), asticrypt.NameAccountList, nil, &es); err != nil {
 		msgError.update(err, "listing accounts", defaultUserErrorMsg)
 		return
 	}
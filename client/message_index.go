@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
 
 	"github.com/BurntSushi/toml"
 	"github.com/asticode/go-asticrypt"
@@ -38,19 +42,40 @@ func handleMessageIndex(w *astilectron.Window) {
 	}
 }
 
-// fetchReferences fetches references
+// fetchReferences fetches references and prefetches accounts in the same round trip
 func fetchReferences() (err error) {
-	// Fetch references
+	// Fetch references and accounts
 	var body asticrypt.BodyReferences
-	if err = sendEncryptedHTTPRequest(asticrypt.NameReferences, nil, &body); err != nil {
-		err = errors.Wrap(err, "sending encrypted http request failed")
+	var es []string
+	var cs = []*asticrypt.BatchCall{
+		{In: asticrypt.LocalCapabilities(), Name: asticrypt.NameReferences, Out: &body},
+		{Name: asticrypt.NameAccountList, Out: &es},
+	}
+	if err = apiClient.Batch(context.Background(), cs); errors.Is(err, asticrypt.ErrNotFound) {
+		// Servers predating batches don't know the batch name
+		cs = cs[:1]
+		cs[0].Err = apiClient.Call(context.Background(), asticrypt.NameReferences, cs[0].In, &body)
+	} else if err != nil {
+		err = errors.Wrap(err, "sending batch failed")
+		return
+	}
+	if err = cs[0].Err; err != nil {
+		err = errors.Wrap(err, "calling references failed")
 		return
 	}
 
+	// Update prefetched accounts
+	// Failing to prefetch accounts is not a problem since they are fetched again when listed
+	prefetchedAccounts = nil
+	if len(cs) > 1 && cs[1].Err == nil {
+		prefetchedAccounts = es
+	}
+
 	// Update references
 	googleClientID = body.GoogleClientID
 	googleClientSecret = body.GoogleClientSecret
 	now = body.Now
+	serverCapabilities = body.Capabilities
 	return
 }
 
@@ -60,6 +85,72 @@ type Configuration struct {
 	ServerPublicKey  *asticrypt.PublicKey  `toml:"server_public_key"`
 }
 
+// writeConfiguration writes the configuration atomically so that an interrupted write never corrupts the only copy
+// of the private key
+// Renaming the temporary file is the commit point: no error is returned once the configuration file has been replaced
+func writeConfiguration(c Configuration) (err error) {
+	// Create temporary file in the same dir so that renaming it is atomic
+	var f *os.File
+	if f, err = ioutil.TempFile(filepath.Dir(pathConfiguration), filepath.Base(pathConfiguration)+".tmp"); err != nil {
+		err = errors.Wrap(err, "creating temporary file failed")
+		return
+	}
+	defer os.Remove(f.Name())
+
+	// Write configuration
+	if err = toml.NewEncoder(f).Encode(c); err != nil {
+		f.Close()
+		err = errors.Wrap(err, "encoding configuration failed")
+		return
+	}
+
+	// Flush to disk
+	if err = f.Sync(); err != nil {
+		f.Close()
+		err = errors.Wrap(err, "syncing temporary file failed")
+		return
+	}
+
+	// Close
+	if err = f.Close(); err != nil {
+		err = errors.Wrap(err, "closing temporary file failed")
+		return
+	}
+
+	// Replace configuration file
+	if err = os.Rename(f.Name(), pathConfiguration); err != nil {
+		err = errors.Wrap(err, "renaming temporary file failed")
+		return
+	}
+
+	// Flush rename to disk
+	// The configuration file has been replaced at this point, therefore this is best effort
+	syncDir(filepath.Dir(pathConfiguration))
+	return
+}
+
+// syncDir flushes a dir to disk and only logs errors
+func syncDir(path string) {
+	// Dirs can't be synced on Windows
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	// Open
+	d, err := os.Open(path)
+	if err != nil {
+		astilog.Error(errors.Wrapf(err, "opening %s failed", path))
+		return
+	}
+	defer d.Close()
+
+	// Sync
+	if err = d.Sync(); err != nil {
+		astilog.Error(errors.Wrapf(err, "syncing %s failed", path))
+		return
+	}
+}
+
 // handleMessageSignUp handles the "sign.up" message
 func handleMessageSignUp(w *astilectron.Window, m bootstrap.MessageIn) {
 	// Process errors
@@ -85,7 +176,8 @@ func handleMessageSignUp(w *astilectron.Window, m bootstrap.MessageIn) {
 
 	// Send HTTP request
 	var body asticrypt.BodyKey
-	if err = sendHTTPRequest(http.MethodPost, "/users", asticrypt.BodyKey{Key: cltPrvKey.Public()}, &body); err != nil {
+	var c = asticrypt.LocalCapabilities()
+	if err = apiClient.Do(context.Background(), http.MethodPost, "/users", asticrypt.BodyKey{Capabilities: &c, Key: cltPrvKey.Public()}, &body); err != nil {
 		msgError.update(err, "sending http request", defaultUserErrorMsg)
 		return
 	}
@@ -95,21 +187,14 @@ func handleMessageSignUp(w *astilectron.Window, m bootstrap.MessageIn) {
 	*clientPrivateKey = *cltPrvKey
 	serverPublicKey = &asticrypt.PublicKey{}
 	*serverPublicKey = *body.Key
-
-	// Create configuration file
-	var f *os.File
-	if f, err = os.Create(pathConfiguration); err != nil {
-		msgError.update(err, "creating configuration file", defaultUserErrorMsg)
-		return
-	}
-	defer f.Close()
+	apiClient.SetKeys(clientPrivateKey, serverPublicKey)
 
 	// Write configuration
-	if err = toml.NewEncoder(f).Encode(Configuration{
+	if err = writeConfiguration(Configuration{
 		ClientPrivateKey: clientPrivateKey,
 		ServerPublicKey:  serverPublicKey,
 	}); err != nil {
-		msgError.update(err, "creating configuration file", defaultUserErrorMsg)
+		msgError.update(err, "writing configuration", defaultUserErrorMsg)
 		return
 	}
 
@@ -149,11 +234,25 @@ func handleMessageLogin(w *astilectron.Window, m bootstrap.MessageIn) {
 		return
 	}
 
+	// Upgrade legacy private key protection
+	if c.ClientPrivateKey.IsLegacy() {
+		astilog.Debug("Upgrading private key protection")
+		if err = c.ClientPrivateKey.Upgrade(); err != nil {
+			msgError.update(err, "upgrading private key", defaultUserErrorMsg)
+			return
+		}
+		if err = writeConfiguration(c); err != nil {
+			msgError.update(err, "writing configuration", defaultUserErrorMsg)
+			return
+		}
+	}
+
 	// Set keys
 	clientPrivateKey = &asticrypt.PrivateKey{}
 	*clientPrivateKey = *c.ClientPrivateKey
 	serverPublicKey = &asticrypt.PublicKey{}
 	*serverPublicKey = *c.ServerPublicKey
+	apiClient.SetKeys(clientPrivateKey, serverPublicKey)
 
 	// Fetch references
 	if err = fetchReferences(); err != nil {
@@ -168,6 +267,62 @@ func handleMessageLogin(w *astilectron.Window, m bootstrap.MessageIn) {
 	}
 }
 
+// handleMessagePassphraseChange handles the "passphrase.change" message
+func handleMessagePassphraseChange(w *astilectron.Window, m bootstrap.MessageIn) {
+	// Process errors
+	const defaultUserErrorMsg = "Changing password failed"
+	var msgError = &messageError{}
+	defer processMessageError(w, msgError)
+
+	// Unmarshal payload
+	type Body struct {
+		New string `json:"new"`
+		Old string `json:"old"`
+	}
+	var b Body
+	var err error
+	if err = json.Unmarshal(m.Payload, &b); err != nil {
+		msgError.update(err, "unmarshaling payload", defaultUserErrorMsg)
+		return
+	}
+
+	// Check private key
+	if clientPrivateKey == nil {
+		msgError.update(errors.New("no client private key"), "checking private key", "You must sign up first")
+		return
+	}
+
+	// Change passphrase
+	var k = &asticrypt.PrivateKey{}
+	*k = *clientPrivateKey
+	if _, err = k.ChangePassphrase(b.Old, b.New); err != nil {
+		if errors.Cause(err) == asticrypt.ErrWrongPassphrase {
+			msgError.update(err, "changing passphrase", "Current password is invalid")
+		} else {
+			msgError.update(err, "changing passphrase", defaultUserErrorMsg)
+		}
+		return
+	}
+
+	// Write configuration
+	if err = writeConfiguration(Configuration{
+		ClientPrivateKey: k,
+		ServerPublicKey:  serverPublicKey,
+	}); err != nil {
+		msgError.update(err, "writing configuration", defaultUserErrorMsg)
+		return
+	}
+
+	// Set key
+	*clientPrivateKey = *k
+
+	// Send
+	if err = w.Send(bootstrap.MessageOut{Name: "passphrase.changed"}); err != nil {
+		msgError.update(err, "sending message", defaultUserErrorMsg)
+		return
+	}
+}
+
 // handleMessageLogout handles the "logout" message
 func handleMessageLogout(w *astilectron.Window) {
 	// Process errors
@@ -178,6 +333,7 @@ func handleMessageLogout(w *astilectron.Window) {
 	// Set keys
 	clientPrivateKey = nil
 	serverPublicKey = nil
+	apiClient.SetKeys(nil, nil)
 
 	// Send
 	var err error
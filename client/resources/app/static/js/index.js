@@ -39,6 +39,9 @@ var index = {
                 case "logged.out":
                     index.listenLoggedOut();
                     break;
+                case "passphrase.changed":
+                    index.listenPassphraseChanged();
+                    break;
                 case "signed.up":
                     index.listenSignedUp();
                     break;
@@ -55,6 +58,7 @@ var index = {
         let content = `<div class="index-header">
             <button class="btn btn-success" onclick="index.onClickAccountAdd()" title="Add a new account"><i class="fa fa-plus"></i></button>
             <button class="btn btn-success" onclick="index.onClickAccountList()" title="Refresh accounts list"><i class="fa fa-refresh"></i></button>
+            <button class="btn btn-success" onclick="index.onClickPassphraseChange()" title="Change password"><i class="fa fa-key"></i></button>
             <button class="btn btn-success" onclick="index.onClickLogout()" title="Log out"><i class="fa fa-sign-out"></i></button>
         </div>`;
 
@@ -111,6 +115,10 @@ var index = {
     listenLoggedOut: function() {
         index.sendIndex();
     },
+    listenPassphraseChanged: function() {
+        asticode.modaler.hide();
+        asticode.notifier.success("Password has been changed");
+    },
     listenSignedUp: function() {
         index.sendIndex();
     },
@@ -146,12 +154,27 @@ var index = {
     onClickLogout: function() {
         index.sendLogout();
     },
+    onClickPassphraseChange: function() {
+        // Build content
+        let content = document.createElement("div");
+        content.innerHTML = `<input type="password" placeholder="Current password" id="value-passphrase-old">
+        <input type="password" placeholder="New password" id="value-passphrase-new" onkeypress="if (event.keyCode === 13) document.getElementById('btn-passphrase').click()">
+        <button class="btn btn-success btn-lg" id="btn-passphrase" onclick="index.onClickSubmitPassphrase()">Change</button>`;
+
+        // Update modal
+        asticode.modaler.setContent(content);
+        asticode.modaler.show();
+        document.getElementById("value-passphrase-old").focus();
+    },
     onClickSignUp: function() {
         index.sendSignUp(document.getElementById("value-password").value);
     },
     onClickSubmitAccount: function() {
         index.sendAccountAdd(document.getElementById("value-account").value);
     },
+    onClickSubmitPassphrase: function() {
+        index.sendPassphraseChange(document.getElementById("value-passphrase-old").value, document.getElementById("value-passphrase-new").value);
+    },
     sendAccountAdd: function(account) {
         asticode.loader.show();
         astilectron.send({name: "account.add", payload: account});
@@ -176,6 +199,10 @@ var index = {
         asticode.loader.show();
         astilectron.send({name: "logout"});
     },
+    sendPassphraseChange: function(oldPassword, newPassword) {
+        asticode.loader.show();
+        astilectron.send({name: "passphrase.change", payload: {new: newPassword, old: oldPassword}});
+    },
     sendSignUp: function(password) {
         asticode.loader.show();
         astilectron.send({name: "sign.up", payload: password});
@@ -0,0 +1,276 @@
+package asticrypt_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/asticode/go-asticrypt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient(t *testing.T) {
+	// Init
+	var pk1, pk2 = &asticrypt.PrivateKey{}, &asticrypt.PrivateKey{}
+	pk1.SetPassphrase("test")
+	err := pk1.UnmarshalText([]byte(prv1))
+	assert.NoError(t, err)
+	err = pk2.UnmarshalText([]byte(prv2))
+	assert.NoError(t, err)
+	var r = asticrypt.NewRouter(func(ctx context.Context, key *asticrypt.PublicKey) (asticrypt.RouterKeys, error) {
+		return asticrypt.RouterKeys{PrivateKey: pk2, PublicKey: pk1.Public()}, nil
+	}, asticrypt.RouterOptions{ReplayCache: asticrypt.NewReplayCacheMemory()})
+	asticrypt.Handle(r, "echo", func(ctx context.Context, req string) (string, error) {
+		return req, nil
+	})
+	asticrypt.Handle(r, "fail", func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, asticrypt.WithCode(asticrypt.ErrConflict, errors.New("fail"))
+	})
+	var mux = http.NewServeMux()
+	mux.Handle("/encrypted", r)
+	mux.HandleFunc("/time", func(rw http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(rw).Encode(asticrypt.BodyTime{Now: time.Now()})
+	})
+	var s = httptest.NewServer(mux)
+	defer s.Close()
+	var c = asticrypt.NewClient(asticrypt.ClientOptions{Addr: s.URL})
+
+	// Keys are not set
+	err = c.Call(context.Background(), "echo", "test", nil)
+	assert.Error(t, err)
+
+	// Call
+	c.SetKeys(pk1, pk2.Public())
+	var out string
+	err = c.Call(context.Background(), "echo", "test", &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", out)
+	assert.WithinDuration(t, time.Now(), c.Now(), time.Second)
+
+	// Error
+	err = c.Call(context.Background(), "unknown", "test", &out)
+	var be asticrypt.BodyError
+	assert.True(t, errors.As(err, &be))
+	assert.Equal(t, asticrypt.ErrorCodeNotFound, be.Code)
+	assert.Equal(t, "Communicating with server failed", be.Label)
+	assert.NotEmpty(t, be.RequestID)
+	assert.True(t, errors.Is(err, asticrypt.ErrNotFound))
+	assert.False(t, errors.Is(err, asticrypt.ErrConflict))
+
+	// Batch
+	var out1, out2 string
+	var cs = []*asticrypt.BatchCall{
+		{In: "test1", Name: "echo", Out: &out1},
+		{Name: "fail"},
+		{Name: "unknown"},
+		{Name: asticrypt.NameBatch},
+		{In: "test2", Name: "echo", Out: &out2},
+	}
+	err = c.Batch(context.Background(), cs)
+	assert.NoError(t, err)
+	assert.NoError(t, cs[0].Err)
+	assert.Equal(t, "test1", out1)
+	assert.True(t, errors.Is(cs[1].Err, asticrypt.ErrConflict))
+	assert.True(t, errors.Is(cs[2].Err, asticrypt.ErrNotFound))
+	assert.True(t, errors.Is(cs[3].Err, asticrypt.ErrBadRequest))
+	assert.NoError(t, cs[4].Err)
+	assert.Equal(t, "test2", out2)
+
+	// Syncing the clock is best effort
+	var errs []error
+	c = asticrypt.NewClient(asticrypt.ClientOptions{
+		Addr:        s.URL,
+		OnError:     func(ctx context.Context, err error) { errs = append(errs, err) },
+		PatternTime: "/unknown",
+	})
+	c.SetKeys(pk1, pk2.Public())
+	for i := 0; i < 2; i++ {
+		err = c.Call(context.Background(), "echo", "test", &out)
+		assert.NoError(t, err)
+		assert.Equal(t, "test", out)
+	}
+	assert.Len(t, errs, 1)
+	assert.WithinDuration(t, time.Now(), c.Now(), time.Second)
+}
+
+func TestClientRequestID(t *testing.T) {
+	// Init
+	var pk1, pk2 = &asticrypt.PrivateKey{}, &asticrypt.PrivateKey{}
+	pk1.SetPassphrase("test")
+	err := pk1.UnmarshalText([]byte(prv1))
+	assert.NoError(t, err)
+	err = pk2.UnmarshalText([]byte(prv2))
+	assert.NoError(t, err)
+	var requestID string
+	var version int
+	var s = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// Decrypt
+		var b asticrypt.BodyMessage
+		if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m, err := b.Decrypt(pk2, pk1.Public(), time.Now())
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// Reply with the request ID and protocol version set by the test
+		var id = requestID
+		if id == "-" {
+			id = m.RequestID
+		}
+		em, err := asticrypt.NewEncryptedMessage(asticrypt.BodyMessageOut{
+			CreatedAt:       time.Now(),
+			ID:              "id",
+			Name:            m.Name,
+			Payload:         "test",
+			ProtocolVersion: version,
+			RequestID:       id,
+		}, pk2, pk1.Public())
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(rw).Encode(asticrypt.BodyMessage{Message: em})
+	}))
+	defer s.Close()
+	var c = asticrypt.NewClient(asticrypt.ClientOptions{Addr: s.URL, PatternTime: "-"})
+	c.SetKeys(pk1, pk2.Public())
+
+	// Matching request ID
+	var out string
+	requestID, version = "-", asticrypt.ProtocolVersionCurrent
+	err = c.Call(context.Background(), "echo", "test", &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", out)
+
+	// Request ID mismatch
+	requestID = "invalid"
+	err = c.Call(context.Background(), "echo", "test", &out)
+	assert.Error(t, err)
+
+	// Stripped request ID
+	requestID = ""
+	err = c.Call(context.Background(), "echo", "test", &out)
+	assert.Error(t, err)
+
+	// Legacy servers don't send the request ID back
+	version = asticrypt.ProtocolVersion1
+	err = c.Call(context.Background(), "echo", "test", &out)
+	assert.NoError(t, err)
+
+	// Unless the negotiated protocol version supports request IDs
+	c.SetCapabilities(asticrypt.LocalCapabilities())
+	err = c.Call(context.Background(), "echo", "test", &out)
+	assert.Error(t, err)
+}
+
+// sessionStore is a session store that can be reset to simulate a server restart
+type sessionStore struct {
+	asticrypt.SessionStore
+	opened int
+}
+
+func (s *sessionStore) Set(ss asticrypt.StoredSession) error {
+	s.opened++
+	return s.SessionStore.Set(ss)
+}
+
+func TestClientSessions(t *testing.T) {
+	// Init
+	var pk1, pk2 = &asticrypt.PrivateKey{}, &asticrypt.PrivateKey{}
+	pk1.SetPassphrase("test")
+	err := pk1.UnmarshalText([]byte(prv1))
+	assert.NoError(t, err)
+	err = pk2.UnmarshalText([]byte(prv2))
+	assert.NoError(t, err)
+	var ss = &sessionStore{SessionStore: asticrypt.NewSessionStoreMemory()}
+	var requests int
+	var newServer = func(o asticrypt.RouterOptions, cs asticrypt.BodyCapabilities) *httptest.Server {
+		var r = asticrypt.NewRouter(func(ctx context.Context, key *asticrypt.PublicKey) (asticrypt.RouterKeys, error) {
+			return asticrypt.RouterKeys{PrivateKey: pk2, PublicKey: pk1.Public(), ReplayScope: "scope"}, nil
+		}, o)
+		asticrypt.Handle(r, "echo", func(ctx context.Context, req string) (string, error) {
+			return req, nil
+		})
+		asticrypt.Handle(r, asticrypt.NameReferences, func(ctx context.Context, req *asticrypt.BodyCapabilities) (asticrypt.BodyReferences, error) {
+			return asticrypt.BodyReferences{Capabilities: cs}, nil
+		})
+		return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			requests++
+			r.ServeHTTP(rw, req)
+		}))
+	}
+	var s = newServer(asticrypt.RouterOptions{ReplayCache: asticrypt.NewReplayCacheMemory(), SessionStore: ss}, asticrypt.LocalCapabilities())
+	defer s.Close()
+	var c = asticrypt.NewClient(asticrypt.ClientOptions{Addr: s.URL, PatternTime: "-", Sessions: true})
+	c.SetKeys(pk1, pk2.Public())
+
+	// No round trip is added before the first batch since capabilities are not known yet
+	var out string
+	var cs = []*asticrypt.BatchCall{
+		{In: asticrypt.LocalCapabilities(), Name: asticrypt.NameReferences, Out: &asticrypt.BodyReferences{}},
+		{In: "test", Name: "echo", Out: &out},
+	}
+	err = c.Batch(context.Background(), cs)
+	assert.NoError(t, err)
+	assert.NoError(t, cs[1].Err)
+	assert.Equal(t, "test", out)
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, 0, ss.opened)
+
+	// Session is opened once capabilities are known
+	for i := 0; i < 3; i++ {
+		err = c.Call(context.Background(), "echo", "test", &out)
+		assert.NoError(t, err)
+		assert.Equal(t, "test", out)
+	}
+	assert.Equal(t, 1, ss.opened)
+	assert.Equal(t, 5, requests)
+
+	// Session is opened once more when the server loses it
+	ss.SessionStore = asticrypt.NewSessionStoreMemory()
+	err = c.Call(context.Background(), "echo", "test", &out)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, ss.opened)
+
+	// Fall back to public keys when the server advertises sessions but doesn't support them
+	var s2 = newServer(asticrypt.RouterOptions{}, asticrypt.LocalCapabilities())
+	defer s2.Close()
+	c = asticrypt.NewClient(asticrypt.ClientOptions{Addr: s2.URL, PatternTime: "-", Sessions: true})
+	c.SetKeys(pk1, pk2.Public())
+	err = c.Call(context.Background(), asticrypt.NameReferences, asticrypt.LocalCapabilities(), &asticrypt.BodyReferences{})
+	assert.NoError(t, err)
+	err = c.Call(context.Background(), "echo", "test", &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", out)
+
+	// Sessions are not opened when the server doesn't advertise them
+	var ss3 = &sessionStore{SessionStore: asticrypt.NewSessionStoreMemory()}
+	var s3 = newServer(asticrypt.RouterOptions{SessionStore: ss3}, asticrypt.BodyCapabilities{})
+	defer s3.Close()
+	c = asticrypt.NewClient(asticrypt.ClientOptions{Addr: s3.URL, PatternTime: "-", Sessions: true})
+	c.SetKeys(pk1, pk2.Public())
+	err = c.Call(context.Background(), asticrypt.NameReferences, asticrypt.LocalCapabilities(), &asticrypt.BodyReferences{})
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		err = c.Call(context.Background(), "echo", "test", &out)
+		assert.NoError(t, err)
+		assert.Equal(t, "test", out)
+	}
+	assert.Equal(t, 0, ss3.opened)
+
+	// Capabilities can be set beforehand
+	c = asticrypt.NewClient(asticrypt.ClientOptions{Addr: s3.URL, PatternTime: "-", Sessions: true})
+	c.SetKeys(pk1, pk2.Public())
+	c.SetCapabilities(asticrypt.LocalCapabilities())
+	err = c.Call(context.Background(), "echo", "test", &out)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, ss3.opened)
+}
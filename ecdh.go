@@ -0,0 +1,119 @@
+package asticrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+// ecdhKeyWrapInfo is the HKDF info used when deriving ECDH key wrapping keys
+const ecdhKeyWrapInfo = "asticrypt ecdh key wrap"
+
+// ecdhKeyWrap returns the key wrap matching a curve
+func ecdhKeyWrap(c elliptic.Curve) string {
+	if c == elliptic.P384() {
+		return KeyWrapECDHP384HKDFSHA256
+	}
+	return KeyWrapECDHP256HKDFSHA256
+}
+
+// wrapKeyECDH wraps a key for an ECDH public key, ECIES style: an ephemeral key pair is generated on the same
+// curve, the shared secret is derived with HKDF and the key is sealed with AES-256-GCM
+// The output is the uncompressed ephemeral public key followed by the sealed key
+func wrapKeyECDH(recipient *ecdh.PublicKey, key []byte) (o []byte, err error) {
+	// Generate ephemeral key
+	var eph *ecdh.PrivateKey
+	if eph, err = recipient.Curve().GenerateKey(rand.Reader); err != nil {
+		err = errors.Wrap(err, "generating ephemeral key failed")
+		return
+	}
+
+	// Compute shared secret
+	var shared []byte
+	if shared, err = eph.ECDH(recipient); err != nil {
+		err = errors.Wrap(err, "computing shared secret failed")
+		return
+	}
+
+	// Create AEAD
+	var a cipher.AEAD
+	if a, err = ecdhKeyWrappingAEAD(shared, eph.PublicKey().Bytes(), recipient.Bytes()); err != nil {
+		err = errors.Wrap(err, "creating key wrapping AEAD failed")
+		return
+	}
+
+	// Seal
+	// The key wrapping key is never reused therefore the nonce can be constant
+	o = a.Seal(eph.PublicKey().Bytes(), make([]byte, a.NonceSize()), key, nil)
+	return
+}
+
+// unwrapKeyECDH unwraps a key wrapped by wrapKeyECDH
+func unwrapKeyECDH(prv *ecdh.PrivateKey, wrapped []byte) (key []byte, err error) {
+	// Check size
+	// Uncompressed points have the same size as the recipient's public key
+	var size = len(prv.PublicKey().Bytes())
+	if len(wrapped) < size {
+		err = errors.New("wrapped key is too short")
+		return
+	}
+
+	// Parse ephemeral public key
+	var eph *ecdh.PublicKey
+	if eph, err = prv.Curve().NewPublicKey(wrapped[:size]); err != nil {
+		err = errors.Wrap(err, "parsing ephemeral public key failed")
+		return
+	}
+
+	// Compute shared secret
+	var shared []byte
+	if shared, err = prv.ECDH(eph); err != nil {
+		err = errors.Wrap(err, "computing shared secret failed")
+		return
+	}
+
+	// Create AEAD
+	var a cipher.AEAD
+	if a, err = ecdhKeyWrappingAEAD(shared, eph.Bytes(), prv.PublicKey().Bytes()); err != nil {
+		err = errors.Wrap(err, "creating key wrapping AEAD failed")
+		return
+	}
+
+	// Open
+	if key, err = a.Open(nil, make([]byte, a.NonceSize()), wrapped[size:], nil); err != nil {
+		err = errors.Wrap(err, "opening key failed")
+		return
+	}
+	return
+}
+
+// ecdhKeyWrappingAEAD derives the key wrapping key from a shared secret and both public keys and creates its AEAD
+func ecdhKeyWrappingAEAD(shared, ephemeral, recipient []byte) (a cipher.AEAD, err error) {
+	// Derive key
+	var k = make([]byte, aesKeyBits/8)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, shared, append(append([]byte{}, ephemeral...), recipient...), []byte(ecdhKeyWrapInfo)), k); err != nil {
+		err = errors.Wrap(err, "deriving key failed")
+		return
+	}
+
+	// Create AES block
+	var b cipher.Block
+	if b, err = aes.NewCipher(k); err != nil {
+		err = errors.Wrap(err, "creating AES block failed")
+		return
+	}
+
+	// Create GCM
+	if a, err = cipher.NewGCM(b); err != nil {
+		err = errors.Wrap(err, "cipher.NewGCM failed")
+		return
+	}
+	return
+}
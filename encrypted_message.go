@@ -1,46 +1,140 @@
 package asticrypt
 
 import (
-	"crypto"
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha512"
 	"encoding/json"
+	"fmt"
+	"strings"
 
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Encryption modes
+const (
+	EncryptionModeAES256CFB         = "aes-256-cfb"
+	EncryptionModeAES256GCM         = "aes-256-gcm"
+	EncryptionModeChaCha20Poly1305  = "chacha20-poly1305"
+	EncryptionModeXChaCha20Poly1305 = "xchacha20-poly1305"
+)
+
+// Key wrap algorithms
+const (
+	KeyWrapECDHP256HKDFSHA256 = "ecdh-p256-hkdf-sha256-aes256gcm"
+	KeyWrapECDHP384HKDFSHA256 = "ecdh-p384-hkdf-sha256-aes256gcm"
+	// The key is wrapped for an ephemeral key of the recipient rather than for its long-term key
+	KeyWrapEphemeralX25519HKDFSHA256 = "ephemeral-x25519-hkdf-sha256-chacha20poly1305"
+	KeyWrapRSAOAEPSHA512             = "rsa-oaep-sha512"
+	KeyWrapX25519HKDFSHA256          = "x25519-hkdf-sha256-chacha20poly1305"
+)
+
+// Signature schemes
+const (
+	SignatureSchemeECDSAP256SHA512   = "ecdsa-p256-sha512"
+	SignatureSchemeECDSAP384SHA512   = "ecdsa-p384-sha512"
+	SignatureSchemeEd25519           = "ed25519"
+	SignatureSchemeRSAPKCS1v15SHA512 = "rsa-pkcs1v15-sha512"
+)
+
+// Encrypted message versions
+// Messages without a version were created before the envelope was introduced
+const (
+	EncryptedMessageVersionLegacy = 0
+	EncryptedMessageVersion1      = 1
+	EncryptedMessageVersion2      = 2
 )
 
 // EncryptedMessage represents an encrypted message
 type EncryptedMessage struct {
-	Hash      []byte `json:"hash,omitempty"`
-	IV        []byte `json:"iv,omitempty"`
-	Key       []byte `json:"key,omitempty"`
-	Message   []byte `json:"message,omitempty"`
-	Signature []byte `json:"signature,omitempty"`
+	Hash            []byte                      `json:"hash,omitempty"`
+	IV              []byte                      `json:"iv,omitempty"`
+	Key             []byte                      `json:"key,omitempty"`
+	KeyWrap         string                      `json:"key_wrap,omitempty"`
+	Message         []byte                      `json:"message,omitempty"`
+	Mode            string                      `json:"mode,omitempty"`
+	Recipient       []byte                      `json:"recipient,omitempty"`
+	Recipients      []EncryptedMessageRecipient `json:"recipients,omitempty"`
+	Signature       []byte                      `json:"signature,omitempty"`
+	SignatureScheme string                      `json:"signature_scheme,omitempty"`
+	Version         int                         `json:"version,omitempty"`
 }
 
-// NewEncryptedMessage encrypts a message
-func NewEncryptedMessage(i interface{}, prvSrc *PrivateKey, pubDst *PublicKey) (em *EncryptedMessage, err error) {
-	// Generate random key
-	var key = make([]byte, aesKeyBits/8)
-	if _, err = rand.Read(key); err != nil {
-		err = errors.Wrap(err, "generating random key failed")
-		return
+// EncryptedMessageRecipient represents the key of an encrypted message wrapped for a specific recipient
+type EncryptedMessageRecipient struct {
+	Hash    []byte `json:"hash"`
+	Key     []byte `json:"key"`
+	KeyWrap string `json:"key_wrap"`
+}
+
+// ErrNotRecipient is returned when a message has not been encrypted for a private key
+var ErrNotRecipient = errors.New("asticrypt: message is not intended for this private key")
+
+// UnsupportedVersionError is returned when an encrypted message version is not supported
+type UnsupportedVersionError struct {
+	Version int
+}
+
+// Error implements the error interface
+func (e UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("asticrypt: encrypted message version %d is not supported", e.Version)
+}
+
+// UnsupportedAlgorithmError is returned when an encrypted message algorithm is not supported
+type UnsupportedAlgorithmError struct {
+	Algorithm string
+	Kind      string
+}
+
+// Error implements the error interface
+func (e UnsupportedAlgorithmError) Error() string {
+	return fmt.Sprintf("asticrypt: %s %s is not supported", e.Kind, e.Algorithm)
+}
+
+// EncryptedMessageOptions represents encrypted message options
+type EncryptedMessageOptions struct {
+	// If set, the key is wrapped for this ephemeral X25519 public key of the recipient instead of its long-term key
+	// so that compromising long-term keys doesn't expose the message. Long-term keys are then only used to sign.
+	// Only one recipient is allowed and encrypted streams don't support it.
+	EphemeralKey []byte
+	Mode         string
+}
+
+// NewEncryptedMessage encrypts a message with the default options
+func NewEncryptedMessage(i interface{}, prvSrc *PrivateKey, pubDst *PublicKey) (*EncryptedMessage, error) {
+	return NewEncryptedMessageWithOptions(i, prvSrc, pubDst, EncryptedMessageOptions{})
+}
+
+// NewEncryptedMessageWithOptions encrypts a message with specific options
+func NewEncryptedMessageWithOptions(i interface{}, prvSrc *PrivateKey, pubDst *PublicKey, o EncryptedMessageOptions) (*EncryptedMessage, error) {
+	return NewEncryptedMessageForRecipients(i, prvSrc, []*PublicKey{pubDst}, o)
+}
+
+// NewEncryptedMessageForRecipients encrypts a message once and wraps its key for each recipient
+func NewEncryptedMessageForRecipients(i interface{}, prvSrc *PrivateKey, pubDsts []*PublicKey, o EncryptedMessageOptions) (em *EncryptedMessage, err error) {
+	// Init
+	em = &EncryptedMessage{
+		Mode:            o.Mode,
+		SignatureScheme: prvSrc.Public().signatureScheme(),
+		Version:         encryptedMessageVersionCurrent,
+	}
+	if len(em.Mode) == 0 {
+		em.Mode = encryptionModeDefault
 	}
 
-	// Create AES block
-	var b cipher.Block
-	if b, err = aes.NewCipher(key); err != nil {
-		err = errors.Wrap(err, "create AES block failed")
+	// Check mode
+	if !isSupported(em.Mode, supportedEncryptionModes) {
+		err = UnsupportedAlgorithmError{Algorithm: em.Mode, Kind: "encryption mode"}
 		return
 	}
 
-	// Generate random IV
-	em = &EncryptedMessage{IV: make([]byte, b.BlockSize())}
-	if _, err = rand.Read(em.IV); err != nil {
-		err = errors.Wrap(err, "generate random IV failed")
+	// Generate random key
+	var key = make([]byte, aesKeyBits/8)
+	if _, err = rand.Read(key); err != nil {
+		err = errors.Wrap(err, "generating random key failed")
 		return
 	}
 
@@ -51,56 +145,384 @@ func NewEncryptedMessage(i interface{}, prvSrc *PrivateKey, pubDst *PublicKey) (
 		return
 	}
 
-	// AES encrypt the message
-	em.Message = make([]byte, len(msg))
-	var cfb = cipher.NewCFBEncrypter(b, em.IV)
-	cfb.XORKeyStream(em.Message, msg)
+	// Wrap the key
+	if len(o.EphemeralKey) > 0 {
+		// Check recipients
+		if len(pubDsts) != 1 {
+			err = fmt.Errorf("%d recipients for an ephemeral key", len(pubDsts))
+			return
+		}
 
-	// RSA encrypt the AES key
-	if em.Key, err = rsa.EncryptOAEP(sha512.New(), rand.Reader, pubDst.Key(), key, nil); err != nil {
-		err = errors.Wrap(err, "rsa.EncryptOAEP failed")
+		// Wrap the key for the ephemeral key
+		var r = EncryptedMessageRecipient{Hash: pubDsts[0].Hash(), KeyWrap: KeyWrapEphemeralX25519HKDFSHA256}
+		if r.Key, err = wrapKeyX25519(o.EphemeralKey, key); err != nil {
+			err = errors.Wrap(err, "wrapping key failed")
+			return
+		}
+		em.Recipients = []EncryptedMessageRecipient{r}
+	} else if em.Recipients, err = newRecipients(key, pubDsts); err != nil {
+		err = errors.Wrap(err, "creating recipients failed")
 		return
 	}
 
+	// Switch on mode
+	switch em.Mode {
+	case EncryptionModeAES256CFB:
+		// Create AES block
+		var b cipher.Block
+		if b, err = aes.NewCipher(key); err != nil {
+			err = errors.Wrap(err, "create AES block failed")
+			return
+		}
+
+		// Generate random IV
+		em.IV = make([]byte, b.BlockSize())
+		if _, err = rand.Read(em.IV); err != nil {
+			err = errors.Wrap(err, "generate random IV failed")
+			return
+		}
+
+		// AES encrypt the message
+		em.Message = make([]byte, len(msg))
+		var cfb = cipher.NewCFBEncrypter(b, em.IV)
+		cfb.XORKeyStream(em.Message, msg)
+	default:
+		// Create AEAD
+		var a cipher.AEAD
+		if a, err = newAEAD(em.Mode, key); err != nil {
+			err = errors.Wrap(err, "creating AEAD failed")
+			return
+		}
+
+		// Generate random IV
+		em.IV = make([]byte, a.NonceSize())
+		if _, err = rand.Read(em.IV); err != nil {
+			err = errors.Wrap(err, "generate random IV failed")
+			return
+		}
+
+		// AEAD encrypt the message
+		em.Message = a.Seal(nil, em.IV, msg, em.additionalData(prvSrc.Public(), nil))
+	}
+
 	// Hash message
-	var h = sha512.New()
-	h.Write(em.Message)
-	em.Hash = h.Sum(nil)
+	em.Hash = em.hash(prvSrc.Public(), nil)
 
 	// Sign the message
-	if em.Signature, err = rsa.SignPKCS1v15(rand.Reader, prvSrc.Key(), crypto.SHA512, em.Hash); err != nil {
-		err = errors.Wrap(err, "rsa.SignPKCS1v15 failed")
+	if em.Signature, err = prvSrc.sign(em.Hash); err != nil {
+		err = errors.Wrap(err, "signing failed")
+		return
+	}
+	return
+}
+
+// newRecipients wraps a key for each recipient
+func newRecipients(key []byte, pubDsts []*PublicKey) (rs []EncryptedMessageRecipient, err error) {
+	// Check recipients
+	if len(pubDsts) == 0 {
+		err = errors.New("no recipients")
 		return
 	}
+
+	// Loop through recipients
+	var hashes = make(map[string]bool)
+	for _, pubDst := range pubDsts {
+		// Recipient has already been processed
+		if hashes[string(pubDst.Hash())] {
+			continue
+		}
+		hashes[string(pubDst.Hash())] = true
+
+		// Wrap the key
+		var r = EncryptedMessageRecipient{Hash: pubDst.Hash()}
+		if r.Key, r.KeyWrap, err = pubDst.wrapKey(key); err != nil {
+			err = errors.Wrap(err, "wrapping key failed")
+			return
+		}
+		rs = append(rs, r)
+	}
+	return
+}
+
+// findRecipient finds the recipient matching a public key
+func findRecipient(rs []EncryptedMessageRecipient, pubRecipient *PublicKey) (r EncryptedMessageRecipient, err error) {
+	for _, r = range rs {
+		if bytes.Equal(r.Hash, pubRecipient.Hash()) {
+			// Check key wrap
+			if !isSupported(r.KeyWrap, supportedKeyWraps) {
+				err = UnsupportedAlgorithmError{Algorithm: r.KeyWrap, Kind: "key wrap"}
+			}
+			return
+		}
+	}
+	err = ErrNotRecipient
+	return
+}
+
+// newAEAD creates a new AEAD based on a mode
+func newAEAD(mode string, key []byte) (a cipher.AEAD, err error) {
+	switch mode {
+	case EncryptionModeAES256GCM:
+		// Create AES block
+		var b cipher.Block
+		if b, err = aes.NewCipher(key); err != nil {
+			err = errors.Wrap(err, "creating AES block failed")
+			return
+		}
+
+		// Create GCM
+		if a, err = cipher.NewGCM(b); err != nil {
+			err = errors.Wrap(err, "cipher.NewGCM failed")
+			return
+		}
+	case EncryptionModeChaCha20Poly1305:
+		if a, err = chacha20poly1305.New(key); err != nil {
+			err = errors.Wrap(err, "chacha20poly1305.New failed")
+			return
+		}
+	case EncryptionModeXChaCha20Poly1305:
+		if a, err = chacha20poly1305.NewX(key); err != nil {
+			err = errors.Wrap(err, "chacha20poly1305.NewX failed")
+			return
+		}
+	default:
+		err = fmt.Errorf("Unknown encryption mode %s", mode)
+	}
+	return
+}
+
+// NegotiateEncryptionMode returns the first mode of the list that is supported or an error if none is
+func NegotiateEncryptionMode(modes []string) (mode string, err error) {
+	for _, m := range modes {
+		if isSupported(m, supportedEncryptionModes) {
+			mode = m
+			return
+		}
+	}
+	err = UnsupportedAlgorithmError{Algorithm: strings.Join(modes, ", "), Kind: "encryption modes"}
 	return
 }
 
+// isSupported checks whether an algorithm is part of a list
+func isSupported(algorithm string, algorithms []string) bool {
+	for _, a := range algorithms {
+		if a == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// header returns the envelope fields that are authenticated in versioned messages
+func (m EncryptedMessage) header() []byte {
+	if m.Version == EncryptedMessageVersionLegacy {
+		return nil
+	}
+	return []byte(fmt.Sprintf("asticrypt/%d|%s|%s|%s|", m.Version, m.Mode, m.KeyWrap, m.SignatureScheme))
+}
+
+// additionalData returns the data authenticated alongside the message in AEAD modes
+// The recipient is only used by messages that have a single recipient
+func (m EncryptedMessage) additionalData(pubSender, pubRecipient *PublicKey) (o []byte) {
+	o = append(o, m.header()...)
+	o = append(o, m.IV...)
+	if m.Version >= EncryptedMessageVersion2 {
+		for _, r := range m.Recipients {
+			o = append(o, r.Hash...)
+			o = append(o, r.Key...)
+			o = append(o, []byte(r.KeyWrap)...)
+		}
+		o = append(o, pubSender.Hash()...)
+		return
+	}
+	o = append(o, m.Key...)
+	o = append(o, pubSender.Hash()...)
+	o = append(o, pubRecipient.Hash()...)
+	return
+}
+
+// hash hashes the parts of the message that are signed
+func (m EncryptedMessage) hash(pubSender, pubRecipient *PublicKey) []byte {
+	var h = sha512.New()
+	if m.isAEAD() || m.Version >= EncryptedMessageVersion2 {
+		h.Write(m.additionalData(pubSender, pubRecipient))
+	} else {
+		h.Write(m.header())
+	}
+	h.Write(m.Message)
+	return h.Sum(nil)
+}
+
+// isAEAD checks whether the message has been encrypted with an AEAD mode
+func (m EncryptedMessage) isAEAD() bool {
+	return len(m.Mode) > 0 && m.Mode != EncryptionModeAES256CFB
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface
+// If the version is not supported, only the version is kept so that Decrypt can return a proper error
+func (m *EncryptedMessage) UnmarshalJSON(b []byte) (err error) {
+	// Unmarshal version
+	var v struct {
+		Version int `json:"version"`
+	}
+	if err = json.Unmarshal(b, &v); err != nil {
+		err = errors.Wrap(err, "unmarshaling version failed")
+		return
+	}
+
+	// Version is not supported
+	if v.Version > encryptedMessageVersionCurrent || v.Version < EncryptedMessageVersionLegacy {
+		*m = EncryptedMessage{Version: v.Version}
+		return
+	}
+
+	// Unmarshal message
+	type alias EncryptedMessage
+	var a alias
+	if err = json.Unmarshal(b, &a); err != nil {
+		err = errors.Wrap(err, "unmarshaling message failed")
+		return
+	}
+	*m = EncryptedMessage(a)
+	return
+}
+
+// validate checks that the envelope can be processed and returns the key wrapped for the recipient
+func (m EncryptedMessage) validate(pubRecipient *PublicKey) (r EncryptedMessageRecipient, err error) {
+	// Check version
+	if m.Version > encryptedMessageVersionCurrent || m.Version < EncryptedMessageVersionLegacy {
+		err = UnsupportedVersionError{Version: m.Version}
+		return
+	}
+
+	// Legacy messages don't describe their algorithms
+	if m.Version == EncryptedMessageVersionLegacy {
+		r = EncryptedMessageRecipient{Key: m.Key, KeyWrap: KeyWrapRSAOAEPSHA512}
+		return
+	}
+
+	// Check algorithms
+	if !isSupported(m.Mode, supportedEncryptionModes) {
+		err = UnsupportedAlgorithmError{Algorithm: m.Mode, Kind: "encryption mode"}
+		return
+	} else if !isSupported(m.SignatureScheme, supportedSignatureSchemes) {
+		err = UnsupportedAlgorithmError{Algorithm: m.SignatureScheme, Kind: "signature scheme"}
+		return
+	}
+
+	// Messages with a single recipient
+	if m.Version == EncryptedMessageVersion1 {
+		// Check key wrap
+		if m.KeyWrap != KeyWrapRSAOAEPSHA512 {
+			err = UnsupportedAlgorithmError{Algorithm: m.KeyWrap, Kind: "key wrap"}
+			return
+		}
+
+		// Check recipient
+		if !bytes.Equal(m.Recipient, pubRecipient.Hash()) {
+			err = ErrNotRecipient
+			return
+		}
+		r = EncryptedMessageRecipient{Hash: m.Recipient, Key: m.Key, KeyWrap: m.KeyWrap}
+		return
+	}
+
+	// Find recipient
+	r, err = findRecipient(m.Recipients, pubRecipient)
+	return
+}
+
+// EncryptedMessageDecryptOptions represents encrypted message decrypt options
+type EncryptedMessageDecryptOptions struct {
+	// Required to decrypt messages whose key has been wrapped for an ephemeral key
+	EphemeralKey *EphemeralKey
+}
+
 // Decrypt decrypts a message
-func (m EncryptedMessage) Decrypt(o interface{}, prvSrc *PrivateKey, pubDst *PublicKey) (err error) {
+func (m EncryptedMessage) Decrypt(o interface{}, prvSrc *PrivateKey, pubDst *PublicKey) error {
+	return m.DecryptWithOptions(o, prvSrc, pubDst, EncryptedMessageDecryptOptions{})
+}
+
+// DecryptWithOptions decrypts a message with specific options
+func (m EncryptedMessage) DecryptWithOptions(o interface{}, prvSrc *PrivateKey, pubDst *PublicKey, do EncryptedMessageDecryptOptions) (err error) {
+	// Validate envelope
+	var r EncryptedMessageRecipient
+	if r, err = m.validate(prvSrc.Public()); err != nil {
+		err = errors.Wrap(err, "validating envelope failed")
+		return
+	}
+
 	// Verify signature
-	if err = rsa.VerifyPKCS1v15(pubDst.Key(), crypto.SHA512, m.Hash, m.Signature); err != nil {
-		err = errors.Wrap(err, "rsa.VerifyPKCS1v15 failed")
+	if err = pubDst.verify(m.SignatureScheme, m.Hash, m.Signature); err != nil {
+		err = errors.Wrap(err, "verifying signature failed")
 		return
 	}
 
-	// RSA decrypt the AES key
-	var key []byte
-	if key, err = rsa.DecryptOAEP(sha512.New(), rand.Reader, prvSrc.Key(), m.Key, nil); err != nil {
-		err = errors.Wrap(err, "rsa.DecryptOAEP failed")
+	// Check hash
+	if !bytes.Equal(m.Hash, m.hash(pubDst, prvSrc.Public())) {
+		err = errors.New("hash mismatch")
 		return
 	}
 
-	// Create AES block
-	var c cipher.Block
-	if c, err = aes.NewCipher(key); err != nil {
-		err = errors.Wrap(err, "creating AES block failed")
+	// Unwrap the key
+	var key []byte
+	if r.KeyWrap == KeyWrapEphemeralX25519HKDFSHA256 {
+		// Check ephemeral key
+		if do.EphemeralKey == nil {
+			err = errors.New("key has been wrapped for an ephemeral key but none was provided")
+			return
+		}
+
+		// Unwrap the key with the ephemeral key
+		if key, err = do.EphemeralKey.unwrapKey(r.Key); err != nil {
+			err = errors.Wrap(err, "unwrapping key with ephemeral key failed")
+			return
+		}
+	} else if key, err = prvSrc.unwrapKey(r.KeyWrap, r.Key); err != nil {
+		err = errors.Wrap(err, "unwrapping key failed")
 		return
 	}
 
-	// AES decrypt the message
-	var msg = make([]byte, len(m.Message))
-	var cfb = cipher.NewCFBDecrypter(c, m.IV)
-	cfb.XORKeyStream(msg, m.Message)
+	// Decrypt message
+	var msg []byte
+	if m.isAEAD() {
+		// Create AEAD
+		var a cipher.AEAD
+		if a, err = newAEAD(m.Mode, key); err != nil {
+			err = errors.Wrap(err, "creating AEAD failed")
+			return
+		}
+
+		// Check IV
+		if len(m.IV) != a.NonceSize() {
+			err = fmt.Errorf("IV size %d is invalid", len(m.IV))
+			return
+		}
+
+		// AEAD decrypt the message
+		if msg, err = a.Open(nil, m.IV, m.Message, m.additionalData(pubDst, prvSrc.Public())); err != nil {
+			err = errors.Wrap(err, "opening AEAD failed")
+			return
+		}
+	} else {
+		// Create AES block
+		var c cipher.Block
+		if c, err = aes.NewCipher(key); err != nil {
+			err = errors.Wrap(err, "creating AES block failed")
+			return
+		}
+
+		// Check IV
+		if len(m.IV) != c.BlockSize() {
+			err = fmt.Errorf("IV size %d is invalid", len(m.IV))
+			return
+		}
+
+		// AES decrypt the message
+		msg = make([]byte, len(m.Message))
+		var cfb = cipher.NewCFBDecrypter(c, m.IV)
+		cfb.XORKeyStream(msg, m.Message)
+	}
 
 	// Unmarshal message
 	if err = json.Unmarshal(msg, o); err != nil {
@@ -1,9 +1,11 @@
 package asticrypt_test
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/asticode/go-asticrypt"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -19,8 +21,182 @@ func TestEncryptedMessage(t *testing.T) {
 	// Assert
 	m, err := asticrypt.NewEncryptedMessage("test", pk2, pk1.Public())
 	assert.NoError(t, err)
+	assert.Equal(t, asticrypt.EncryptionModeAES256GCM, m.Mode)
 	var b string
 	err = m.Decrypt(&b, pk1, pk2.Public())
 	assert.NoError(t, err)
 	assert.Equal(t, "test", string(b))
+
+	// Modes
+	for _, mode := range []string{asticrypt.EncryptionModeAES256CFB, asticrypt.EncryptionModeAES256GCM, asticrypt.EncryptionModeChaCha20Poly1305} {
+		m, err = asticrypt.NewEncryptedMessageWithOptions("test", pk2, pk1.Public(), asticrypt.EncryptedMessageOptions{Mode: mode})
+		assert.NoError(t, err)
+		b = ""
+		err = m.Decrypt(&b, pk1, pk2.Public())
+		assert.NoError(t, err, mode)
+		assert.Equal(t, "test", b, mode)
+	}
+
+	// Legacy messages are still readable
+	m = &asticrypt.EncryptedMessage{}
+	err = json.Unmarshal([]byte(msgLegacy), m)
+	assert.NoError(t, err)
+	b = ""
+	err = m.Decrypt(&b, pk1, pk2.Public())
+	assert.NoError(t, err)
+	assert.Equal(t, "test", b)
+
+	// Legacy messages with an invalid IV return an error instead of panicking
+	m.IV = m.IV[:4]
+	err = m.Decrypt(&b, pk1, pk2.Public())
+	assert.Error(t, err)
+
+	// Tampering with the IV is detected
+	m, err = asticrypt.NewEncryptedMessage("test", pk2, pk1.Public())
+	assert.NoError(t, err)
+	m.IV[0] ^= 0xff
+	err = m.Decrypt(&b, pk1, pk2.Public())
+	assert.Error(t, err)
+
+	// Wrong recipient
+	m, err = asticrypt.NewEncryptedMessage("test", pk2, pk1.Public())
+	assert.NoError(t, err)
+	assert.Equal(t, asticrypt.EncryptedMessageVersion2, m.Version)
+	err = m.Decrypt(&b, pk2, pk1.Public())
+	assert.Equal(t, asticrypt.ErrNotRecipient, errors.Cause(err))
+
+	// Unsupported algorithm
+	m.Mode = "invalid"
+	err = m.Decrypt(&b, pk1, pk2.Public())
+	assert.IsType(t, asticrypt.UnsupportedAlgorithmError{}, errors.Cause(err))
+
+	// Unsupported version
+	m = &asticrypt.EncryptedMessage{}
+	err = json.Unmarshal([]byte(`{"version":1000,"message":{"unknown":"structure"}}`), m)
+	assert.NoError(t, err)
+	err = m.Decrypt(&b, pk1, pk2.Public())
+	assert.Equal(t, asticrypt.UnsupportedVersionError{Version: 1000}, errors.Cause(err))
+}
+
+func TestEncryptedMessageForRecipients(t *testing.T) {
+	// Init
+	var pk1, pk2 = &asticrypt.PrivateKey{}, &asticrypt.PrivateKey{}
+	pk1.SetPassphrase("test")
+	err := pk1.UnmarshalText([]byte(prv1))
+	assert.NoError(t, err)
+	err = pk2.UnmarshalText([]byte(prv2))
+	assert.NoError(t, err)
+
+	// Assert
+	m, err := asticrypt.NewEncryptedMessageForRecipients("test", pk2, []*asticrypt.PublicKey{pk1.Public(), pk2.Public(), pk1.Public()}, asticrypt.EncryptedMessageOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, m.Recipients, 2)
+	for _, pk := range []*asticrypt.PrivateKey{pk1, pk2} {
+		var b string
+		err = m.Decrypt(&b, pk, pk2.Public())
+		assert.NoError(t, err)
+		assert.Equal(t, "test", b)
+	}
+
+	// Tampering with a recipient is detected
+	m.Recipients = m.Recipients[1:]
+	var b string
+	err = m.Decrypt(&b, pk2, pk2.Public())
+	assert.Error(t, err)
+}
+
+func TestEncryptedMessageEphemeral(t *testing.T) {
+	// Init
+	var pk1, pk2 = &asticrypt.PrivateKey{}, &asticrypt.PrivateKey{}
+	pk1.SetPassphrase("test")
+	err := pk1.UnmarshalText([]byte(prv1))
+	assert.NoError(t, err)
+	err = pk2.UnmarshalText([]byte(prv2))
+	assert.NoError(t, err)
+	k, err := asticrypt.GenerateEphemeralKey()
+	assert.NoError(t, err)
+
+	// Assert
+	m, err := asticrypt.NewEncryptedMessageWithOptions("test", pk2, pk1.Public(), asticrypt.EncryptedMessageOptions{EphemeralKey: k.Public()})
+	assert.NoError(t, err)
+	assert.Equal(t, asticrypt.KeyWrapEphemeralX25519HKDFSHA256, m.Recipients[0].KeyWrap)
+	var b string
+	err = m.DecryptWithOptions(&b, pk1, pk2.Public(), asticrypt.EncryptedMessageDecryptOptions{EphemeralKey: k})
+	assert.NoError(t, err)
+	assert.Equal(t, "test", b)
+
+	// The long-term key alone can't decrypt the message
+	err = m.Decrypt(&b, pk1, pk2.Public())
+	assert.Error(t, err)
+
+	// Another ephemeral key can't decrypt the message
+	k2, err := asticrypt.GenerateEphemeralKey()
+	assert.NoError(t, err)
+	err = m.DecryptWithOptions(&b, pk1, pk2.Public(), asticrypt.EncryptedMessageDecryptOptions{EphemeralKey: k2})
+	assert.Error(t, err)
+
+	// Only one recipient is allowed
+	_, err = asticrypt.NewEncryptedMessageForRecipients("test", pk2, []*asticrypt.PublicKey{pk1.Public(), pk2.Public()}, asticrypt.EncryptedMessageOptions{EphemeralKey: k.Public()})
+	assert.Error(t, err)
+}
+
+func TestEncryptedMessageEd25519(t *testing.T) {
+	// Init
+	var pk1 = &asticrypt.PrivateKey{}
+	pk1.SetPassphrase("test")
+	err := pk1.UnmarshalText([]byte(prv1))
+	assert.NoError(t, err)
+	pk2, err := asticrypt.GeneratePrivateKeyWithType(asticrypt.KeyTypeEd25519, "")
+	assert.NoError(t, err)
+	pk3, err := asticrypt.GeneratePrivateKeyWithType(asticrypt.KeyTypeEd25519, "")
+	assert.NoError(t, err)
+
+	// Assert
+	m, err := asticrypt.NewEncryptedMessageForRecipients("test", pk2, []*asticrypt.PublicKey{pk1.Public(), pk3.Public()}, asticrypt.EncryptedMessageOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, asticrypt.SignatureSchemeEd25519, m.SignatureScheme)
+	assert.Equal(t, asticrypt.KeyWrapRSAOAEPSHA512, m.Recipients[0].KeyWrap)
+	assert.Equal(t, asticrypt.KeyWrapX25519HKDFSHA256, m.Recipients[1].KeyWrap)
+	for _, pk := range []*asticrypt.PrivateKey{pk1, pk3} {
+		var b string
+		err = m.Decrypt(&b, pk, pk2.Public())
+		assert.NoError(t, err)
+		assert.Equal(t, "test", b)
+	}
+
+	// Signature is verified with the proper key
+	var b string
+	err = m.Decrypt(&b, pk3, pk3.Public())
+	assert.Error(t, err)
+	err = m.Decrypt(&b, pk3, pk1.Public())
+	assert.Error(t, err)
+}
+
+func TestEncryptedMessageECDSA(t *testing.T) {
+	// Init
+	pk1, err := asticrypt.GeneratePrivateKeyWithType(asticrypt.KeyTypeECDSAP256, "")
+	assert.NoError(t, err)
+	pk2, err := asticrypt.GeneratePrivateKeyWithType(asticrypt.KeyTypeECDSAP384, "")
+	assert.NoError(t, err)
+
+	// Assert
+	m, err := asticrypt.NewEncryptedMessageForRecipients("test", pk2, []*asticrypt.PublicKey{pk1.Public(), pk2.Public()}, asticrypt.EncryptedMessageOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, asticrypt.SignatureSchemeECDSAP384SHA512, m.SignatureScheme)
+	assert.Equal(t, asticrypt.KeyWrapECDHP256HKDFSHA256, m.Recipients[0].KeyWrap)
+	assert.Equal(t, asticrypt.KeyWrapECDHP384HKDFSHA256, m.Recipients[1].KeyWrap)
+	for _, pk := range []*asticrypt.PrivateKey{pk1, pk2} {
+		var b string
+		err = m.Decrypt(&b, pk, pk2.Public())
+		assert.NoError(t, err)
+		assert.Equal(t, "test", b)
+	}
+}
+
+func TestNegotiateEncryptionMode(t *testing.T) {
+	m, err := asticrypt.NegotiateEncryptionMode([]string{"invalid", asticrypt.EncryptionModeChaCha20Poly1305, asticrypt.EncryptionModeAES256GCM})
+	assert.NoError(t, err)
+	assert.Equal(t, asticrypt.EncryptionModeChaCha20Poly1305, m)
+	_, err = asticrypt.NegotiateEncryptionMode([]string{"invalid"})
+	assert.Error(t, err)
 }
@@ -0,0 +1,439 @@
+package asticrypt
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Encrypted stream versions
+const (
+	EncryptedStreamVersion1 = 1
+)
+
+// Encrypted stream frame types
+const (
+	encryptedStreamFrameChunk      byte = 2
+	encryptedStreamFrameFinalChunk byte = 3
+	encryptedStreamFrameHeader     byte = 1
+	encryptedStreamFrameTrailer    byte = 4
+)
+
+// Encrypted stream limits
+const (
+	encryptedStreamMaxChunkSize  = 16 * 1024 * 1024
+	encryptedStreamMaxHeaderSize = 1024 * 1024
+)
+
+// encryptedStreamHeader represents the header of an encrypted stream
+type encryptedStreamHeader struct {
+	ChunkSize       int                         `json:"chunk_size"`
+	Mode            string                      `json:"mode"`
+	Recipients      []EncryptedMessageRecipient `json:"recipients"`
+	Sender          []byte                      `json:"sender"`
+	SignatureScheme string                      `json:"signature_scheme"`
+	Version         int                         `json:"version"`
+}
+
+// EncryptedStreamWriter encrypts what is written to it in authenticated chunks
+// The underlying writer receives a header containing the wrapped keys, the chunks and a signed trailer
+type EncryptedStreamWriter struct {
+	aead      cipher.AEAD
+	ad        []byte
+	buf       []byte
+	chunkSize int
+	closed    bool
+	counter   uint64
+	err       error
+	hash      hash.Hash
+	prvSrc    *PrivateKey
+	w         io.Writer
+}
+
+// NewEncryptedStreamWriter creates a new encrypted stream writer and writes the header
+// Ephemeral keys are not supported, an error is returned rather than silently falling back to long-term keys
+func NewEncryptedStreamWriter(w io.Writer, prvSrc *PrivateKey, pubDsts []*PublicKey, o EncryptedMessageOptions) (sw *EncryptedStreamWriter, err error) {
+	// Check options
+	if len(o.EphemeralKey) > 0 {
+		err = errors.New("ephemeral keys are not supported by encrypted streams")
+		return
+	}
+
+	// Init
+	sw = &EncryptedStreamWriter{
+		buf:       make([]byte, 0, encryptedStreamChunkSize),
+		chunkSize: encryptedStreamChunkSize,
+		hash:      sha512.New(),
+		prvSrc:    prvSrc,
+		w:         w,
+	}
+	var h = encryptedStreamHeader{
+		ChunkSize:       sw.chunkSize,
+		Mode:            o.Mode,
+		Sender:          prvSrc.Public().Hash(),
+		SignatureScheme: prvSrc.Public().signatureScheme(),
+		Version:         EncryptedStreamVersion1,
+	}
+	if len(h.Mode) == 0 {
+		h.Mode = encryptionModeDefault
+	}
+
+	// Generate random key
+	var key = make([]byte, aesKeyBits/8)
+	if _, err = rand.Read(key); err != nil {
+		err = errors.Wrap(err, "generating random key failed")
+		return
+	}
+
+	// Create AEAD
+	if sw.aead, err = newAEAD(h.Mode, key); err != nil {
+		err = errors.Wrap(err, "creating AEAD failed")
+		return
+	}
+
+	// Wrap the key for each recipient
+	if h.Recipients, err = newRecipients(key, pubDsts); err != nil {
+		err = errors.Wrap(err, "creating recipients failed")
+		return
+	}
+
+	// Marshal header
+	var b []byte
+	if b, err = json.Marshal(h); err != nil {
+		err = errors.Wrap(err, "marshaling header failed")
+		return
+	}
+
+	// Write header
+	if err = writeEncryptedStreamFrame(sw.w, encryptedStreamFrameHeader, b); err != nil {
+		err = errors.Wrap(err, "writing header failed")
+		return
+	}
+	sw.hash.Write(b)
+	sw.ad = hashSHA512(b)
+	return
+}
+
+// Write implements the io.Writer interface
+// Data is consumed chunk by chunk so that at most one chunk is buffered whatever the size of p
+func (sw *EncryptedStreamWriter) Write(p []byte) (n int, err error) {
+	// Writer is closed or has failed
+	if sw.closed {
+		err = errors.New("writer is closed")
+		return
+	} else if sw.err != nil {
+		err = sw.err
+		return
+	}
+
+	// Loop through data
+	// The last chunk is kept in the buffer until more data is written or Close is called since it may be the
+	// final one
+	var buffered int
+	for len(p) > 0 {
+		// Seal full chunk
+		if len(sw.buf) == sw.chunkSize {
+			if err = sw.seal(sw.buf, false); err != nil {
+				// Bytes of p that were part of the chunk have not been committed
+				n -= buffered
+				sw.err = errors.Wrap(err, "sealing chunk failed")
+				err = sw.err
+				return
+			}
+			sw.buf = sw.buf[:0]
+			buffered = 0
+		}
+
+		// Buffer data
+		var l = sw.chunkSize - len(sw.buf)
+		if l > len(p) {
+			l = len(p)
+		}
+		sw.buf = append(sw.buf, p[:l]...)
+		p = p[l:]
+		n += l
+		buffered += l
+	}
+	return
+}
+
+// seal seals a chunk and writes it
+func (sw *EncryptedStreamWriter) seal(p []byte, final bool) (err error) {
+	// Seal
+	var c = sw.aead.Seal(nil, encryptedStreamNonce(sw.aead.NonceSize(), sw.counter, final), p, sw.ad)
+	sw.counter++
+
+	// Write
+	var t = encryptedStreamFrameChunk
+	if final {
+		t = encryptedStreamFrameFinalChunk
+	}
+	if err = writeEncryptedStreamFrame(sw.w, t, c); err != nil {
+		err = errors.Wrap(err, "writing chunk failed")
+		return
+	}
+	sw.hash.Write(c)
+	return
+}
+
+// Close seals the final chunk and writes the signed trailer
+// It doesn't close the underlying writer
+func (sw *EncryptedStreamWriter) Close() (err error) {
+	// Writer is already closed or has failed
+	if sw.closed {
+		return
+	}
+	sw.closed = true
+	if sw.err != nil {
+		err = sw.err
+		return
+	}
+
+	// Seal final chunk
+	if err = sw.seal(sw.buf, true); err != nil {
+		err = errors.Wrap(err, "sealing final chunk failed")
+		return
+	}
+	sw.buf = nil
+
+	// Sign
+	var s []byte
+	if s, err = sw.prvSrc.sign(sw.hash.Sum(nil)); err != nil {
+		err = errors.Wrap(err, "signing failed")
+		return
+	}
+
+	// Write trailer
+	if err = writeEncryptedStreamFrame(sw.w, encryptedStreamFrameTrailer, s); err != nil {
+		err = errors.Wrap(err, "writing trailer failed")
+		return
+	}
+	return
+}
+
+// EncryptedStreamReader decrypts a stream created by an EncryptedStreamWriter
+// Each chunk is authenticated before being returned but the sender's signature is only verified once the
+// trailer is reached, therefore data must not be trusted until Read has returned io.EOF
+type EncryptedStreamReader struct {
+	aead    cipher.AEAD
+	ad      []byte
+	buf     []byte
+	counter uint64
+	done    bool
+	err     error
+	hash    hash.Hash
+	header  encryptedStreamHeader
+	pubSrc  *PublicKey
+	r       io.Reader
+}
+
+// NewEncryptedStreamReader creates a new encrypted stream reader and reads the header
+func NewEncryptedStreamReader(r io.Reader, prvDst *PrivateKey, pubSrc *PublicKey) (sr *EncryptedStreamReader, err error) {
+	// Init
+	sr = &EncryptedStreamReader{
+		hash:   sha512.New(),
+		pubSrc: pubSrc,
+		r:      r,
+	}
+
+	// Read header
+	var t byte
+	var b []byte
+	if t, b, err = readEncryptedStreamFrame(sr.r, encryptedStreamMaxHeaderSize); err != nil {
+		err = errors.Wrap(err, "reading header failed")
+		return
+	} else if t != encryptedStreamFrameHeader {
+		err = fmt.Errorf("frame type %d is not a header", t)
+		return
+	}
+	sr.hash.Write(b)
+	sr.ad = hashSHA512(b)
+
+	// Unmarshal header
+	if err = json.Unmarshal(b, &sr.header); err != nil {
+		err = errors.Wrap(err, "unmarshaling header failed")
+		return
+	}
+
+	// Validate header
+	if sr.header.Version != EncryptedStreamVersion1 {
+		err = UnsupportedVersionError{Version: sr.header.Version}
+		return
+	} else if !isSupported(sr.header.SignatureScheme, supportedSignatureSchemes) {
+		err = UnsupportedAlgorithmError{Algorithm: sr.header.SignatureScheme, Kind: "signature scheme"}
+		return
+	} else if sr.header.ChunkSize <= 0 || sr.header.ChunkSize > encryptedStreamMaxChunkSize {
+		err = fmt.Errorf("chunk size %d is invalid", sr.header.ChunkSize)
+		return
+	} else if !bytes.Equal(sr.header.Sender, pubSrc.Hash()) {
+		err = errors.New("stream has not been sent by this public key")
+		return
+	}
+
+	// Find recipient
+	var rc EncryptedMessageRecipient
+	if rc, err = findRecipient(sr.header.Recipients, prvDst.Public()); err != nil {
+		err = errors.Wrap(err, "finding recipient failed")
+		return
+	}
+
+	// Unwrap the key
+	var key []byte
+	if key, err = prvDst.unwrapKey(rc.KeyWrap, rc.Key); err != nil {
+		err = errors.Wrap(err, "unwrapping key failed")
+		return
+	}
+
+	// Create AEAD
+	if sr.aead, err = newAEAD(sr.header.Mode, key); err != nil {
+		err = errors.Wrap(err, "creating AEAD failed")
+		return
+	}
+	return
+}
+
+// Read implements the io.Reader interface
+// Once a chunk can't be opened, the same error is returned by all subsequent calls
+func (sr *EncryptedStreamReader) Read(p []byte) (n int, err error) {
+	// Fill buffer
+	for len(sr.buf) == 0 {
+		// Stream is done
+		if sr.err != nil {
+			err = sr.err
+			return
+		} else if sr.done {
+			err = io.EOF
+			return
+		}
+
+		// Open next chunk
+		if err = sr.open(); err != nil {
+			sr.buf = nil
+			sr.err = errors.Wrap(err, "opening chunk failed")
+			err = sr.err
+			return
+		}
+	}
+
+	// Copy
+	n = copy(p, sr.buf)
+	sr.buf = sr.buf[n:]
+	return
+}
+
+// open reads and opens the next chunk
+func (sr *EncryptedStreamReader) open() (err error) {
+	// Read chunk
+	var t byte
+	var c []byte
+	if t, c, err = readEncryptedStreamFrame(sr.r, sr.header.ChunkSize+sr.aead.Overhead()); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		err = errors.Wrap(err, "reading chunk failed")
+		return
+	} else if t != encryptedStreamFrameChunk && t != encryptedStreamFrameFinalChunk {
+		err = fmt.Errorf("frame type %d is not a chunk", t)
+		return
+	}
+	var final = t == encryptedStreamFrameFinalChunk
+	sr.hash.Write(c)
+
+	// Open
+	if sr.buf, err = sr.aead.Open(nil, encryptedStreamNonce(sr.aead.NonceSize(), sr.counter, final), c, sr.ad); err != nil {
+		err = errors.Wrap(err, "opening AEAD failed")
+		return
+	}
+	sr.counter++
+
+	// Not the final chunk
+	if !final {
+		return
+	}
+
+	// Read trailer
+	var s []byte
+	if t, s, err = readEncryptedStreamFrame(sr.r, encryptedStreamMaxHeaderSize); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		err = errors.Wrap(err, "reading trailer failed")
+		return
+	} else if t != encryptedStreamFrameTrailer {
+		err = fmt.Errorf("frame type %d is not a trailer", t)
+		return
+	}
+
+	// Verify signature
+	if err = sr.pubSrc.verify(sr.header.SignatureScheme, sr.hash.Sum(nil), s); err != nil {
+		sr.buf = nil
+		err = errors.Wrap(err, "verifying signature failed")
+		return
+	}
+	sr.done = true
+	return
+}
+
+// encryptedStreamNonce builds the nonce of a chunk based on its position and whether it's the final one
+// so that reordering and truncation are detected
+func encryptedStreamNonce(size int, counter uint64, final bool) (n []byte) {
+	n = make([]byte, size)
+	binary.BigEndian.PutUint64(n[size-9:size-1], counter)
+	if final {
+		n[size-1] = 1
+	}
+	return
+}
+
+// writeEncryptedStreamFrame writes a frame made of its type, its length and its payload
+func writeEncryptedStreamFrame(w io.Writer, t byte, p []byte) (err error) {
+	var b = make([]byte, 5)
+	b[0] = t
+	binary.BigEndian.PutUint32(b[1:], uint32(len(p)))
+	if _, err = w.Write(append(b, p...)); err != nil {
+		err = errors.Wrap(err, "writing failed")
+		return
+	}
+	return
+}
+
+// readEncryptedStreamFrame reads a frame written by writeEncryptedStreamFrame
+func readEncryptedStreamFrame(r io.Reader, maxSize int) (t byte, p []byte, err error) {
+	// Read type and length
+	var b = make([]byte, 5)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return
+	}
+	t = b[0]
+
+	// Check length
+	var l = binary.BigEndian.Uint32(b[1:])
+	if int64(l) > int64(maxSize) {
+		err = fmt.Errorf("frame size %d is bigger than %d", l, maxSize)
+		return
+	}
+
+	// Read payload
+	p = make([]byte, l)
+	if _, err = io.ReadFull(r, p); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	return
+}
+
+// hashSHA512 returns the SHA-512 of a payload
+func hashSHA512(p []byte) []byte {
+	var h = sha512.Sum512(p)
+	return h[:]
+}
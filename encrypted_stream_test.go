@@ -0,0 +1,120 @@
+package asticrypt_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/asticode/go-asticrypt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptedStream(t *testing.T) {
+	// Init
+	var pk1, pk2 = &asticrypt.PrivateKey{}, &asticrypt.PrivateKey{}
+	pk1.SetPassphrase("test")
+	err := pk1.UnmarshalText([]byte(prv1))
+	assert.NoError(t, err)
+	err = pk2.UnmarshalText([]byte(prv2))
+	assert.NoError(t, err)
+	var data = make([]byte, 300*1024)
+	_, err = rand.Read(data)
+	assert.NoError(t, err)
+
+	// Ephemeral keys are not supported
+	k, err := asticrypt.GenerateEphemeralKey()
+	assert.NoError(t, err)
+	_, err = asticrypt.NewEncryptedStreamWriter(&bytes.Buffer{}, pk2, []*asticrypt.PublicKey{pk1.Public()}, asticrypt.EncryptedMessageOptions{EphemeralKey: k.Public()})
+	assert.Error(t, err)
+
+	// Encrypt
+	var buf = &bytes.Buffer{}
+	w, err := asticrypt.NewEncryptedStreamWriter(buf, pk2, []*asticrypt.PublicKey{pk1.Public()}, asticrypt.EncryptedMessageOptions{})
+	assert.NoError(t, err)
+	for i := 0; i < len(data); i += 1000 {
+		var j = i + 1000
+		if j > len(data) {
+			j = len(data)
+		}
+		_, err = w.Write(data[i:j])
+		assert.NoError(t, err)
+	}
+	err = w.Close()
+	assert.NoError(t, err)
+	var encrypted = buf.Bytes()
+
+	// Decrypt
+	r, err := asticrypt.NewEncryptedStreamReader(bytes.NewReader(encrypted), pk1, pk2.Public())
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, data, b)
+
+	// Truncation is detected
+	r, err = asticrypt.NewEncryptedStreamReader(bytes.NewReader(encrypted[:len(encrypted)-1000]), pk1, pk2.Public())
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	assert.Error(t, err)
+
+	// Tampering is detected
+	var tampered = append([]byte{}, encrypted...)
+	tampered[len(tampered)/2] ^= 0xff
+	var tr = bytes.NewReader(tampered)
+	r, err = asticrypt.NewEncryptedStreamReader(tr, pk1, pk2.Public())
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	assert.Error(t, err)
+
+	// Frames following a tampered chunk are not consumed
+	var l = tr.Len()
+	assert.Greater(t, l, 0)
+	_, err2 := r.Read(make([]byte, 10))
+	assert.Equal(t, err, err2)
+	assert.Equal(t, l, tr.Len())
+
+	// Wrong sender
+	_, err = asticrypt.NewEncryptedStreamReader(bytes.NewReader(encrypted), pk1, pk1.Public())
+	assert.Error(t, err)
+
+	// Ed25519
+	pk3, err := asticrypt.GeneratePrivateKeyWithType(asticrypt.KeyTypeEd25519, "")
+	assert.NoError(t, err)
+	buf.Reset()
+	w, err = asticrypt.NewEncryptedStreamWriter(buf, pk3, []*asticrypt.PublicKey{pk3.Public()}, asticrypt.EncryptedMessageOptions{Mode: asticrypt.EncryptionModeChaCha20Poly1305})
+	assert.NoError(t, err)
+	_, err = w.Write(data)
+	assert.NoError(t, err)
+	err = w.Close()
+	assert.NoError(t, err)
+	r, err = asticrypt.NewEncryptedStreamReader(buf, pk3, pk3.Public())
+	assert.NoError(t, err)
+	b, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, data, b)
+
+	// Bytes that could not be committed are not reported as written
+	w, err = asticrypt.NewEncryptedStreamWriter(&failingWriter{n: 1}, pk3, []*asticrypt.PublicKey{pk3.Public()}, asticrypt.EncryptedMessageOptions{})
+	assert.NoError(t, err)
+	n, err := w.Write(data)
+	assert.Error(t, err)
+	assert.Less(t, n, len(data))
+	_, err = w.Write(data)
+	assert.Error(t, err)
+	err = w.Close()
+	assert.Error(t, err)
+}
+
+// failingWriter is a writer failing once n writes have succeeded
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n <= 0 {
+		return 0, errors.New("failing writer")
+	}
+	w.n--
+	return len(p), nil
+}
@@ -0,0 +1,93 @@
+package asticrypt
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+// ephemeralSessionKeyInfo is the HKDF info used when deriving session keys from ephemeral keys
+const ephemeralSessionKeyInfo = "asticrypt ephemeral session key"
+
+// EphemeralKey represents an ephemeral X25519 key pair
+// It provides forward secrecy: once it has been dropped, compromising long-term keys doesn't expose what it protected
+// Long-term keys are then only used to authenticate ephemeral public keys
+type EphemeralKey struct {
+	k *ecdh.PrivateKey
+}
+
+// GenerateEphemeralKey generates a new ephemeral key
+func GenerateEphemeralKey() (k *EphemeralKey, err error) {
+	k = &EphemeralKey{}
+	if k.k, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+		err = errors.Wrap(err, "generating X25519 key failed")
+		return
+	}
+	return
+}
+
+// newEphemeralKeyFromBytes creates an ephemeral key from its private bytes
+func newEphemeralKeyFromBytes(b []byte) (k *EphemeralKey, err error) {
+	k = &EphemeralKey{}
+	if k.k, err = ecdh.X25519().NewPrivateKey(b); err != nil {
+		err = errors.Wrap(err, "creating X25519 key failed")
+		return
+	}
+	return
+}
+
+// Public returns the ephemeral public key
+func (k *EphemeralKey) Public() []byte {
+	return k.k.PublicKey().Bytes()
+}
+
+// bytes returns the ephemeral private bytes
+func (k *EphemeralKey) bytes() []byte {
+	return k.k.Bytes()
+}
+
+// sharedSecret computes the shared secret between the ephemeral key and a peer public key
+func (k *EphemeralKey) sharedSecret(peer []byte) (shared []byte, err error) {
+	// Parse peer public key
+	var p *ecdh.PublicKey
+	if p, err = ecdh.X25519().NewPublicKey(peer); err != nil {
+		err = errors.Wrap(err, "parsing peer public key failed")
+		return
+	}
+
+	// Compute shared secret
+	if shared, err = k.k.ECDH(p); err != nil {
+		err = errors.Wrap(err, "computing shared secret failed")
+		return
+	}
+	return
+}
+
+// unwrapKey unwraps a key wrapped for the ephemeral public key
+func (k *EphemeralKey) unwrapKey(wrapped []byte) ([]byte, error) {
+	return unwrapKeyX25519(k.bytes(), wrapped)
+}
+
+// deriveSessionKey derives a session key from the key agreement between the ephemeral key and a peer ephemeral
+// public key
+// Both public keys are bound to the derived key in the order provided
+func (k *EphemeralKey) deriveSessionKey(peer, clientPub, serverPub []byte) (key []byte, err error) {
+	// Compute shared secret
+	var shared []byte
+	if shared, err = k.sharedSecret(peer); err != nil {
+		err = errors.Wrap(err, "computing shared secret failed")
+		return
+	}
+
+	// Derive key
+	key = make([]byte, aesKeyBits/8)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, shared, append(append([]byte{}, clientPub...), serverPub...), []byte(ephemeralSessionKeyInfo)), key); err != nil {
+		err = errors.Wrap(err, "deriving key failed")
+		return
+	}
+	return
+}
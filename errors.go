@@ -0,0 +1,163 @@
+package asticrypt
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Error codes
+const (
+	ErrorCodeBadRequest      = "bad_request"
+	ErrorCodeConflict        = "conflict"
+	ErrorCodeInternal        = "internal"
+	ErrorCodeNotFound        = "not_found"
+	ErrorCodeSessionExpired  = "session_expired"
+	ErrorCodeTooManyRequests = "too_many_requests"
+	ErrorCodeUnauthorized    = "unauthorized"
+	ErrorCodeUpgradeRequired = "upgrade_required"
+)
+
+// Sentinel errors
+// Servers wrap errors with them using WithCode to set the code of the error sent to clients, clients check them with
+// errors.Is
+var (
+	ErrBadRequest      = errors.New("asticrypt: bad request")
+	ErrConflict        = errors.New("asticrypt: conflict")
+	ErrInternal        = errors.New("asticrypt: internal error")
+	ErrNotFound        = errors.New("asticrypt: not found")
+	ErrTooManyRequests = errors.New("asticrypt: too many requests")
+	ErrUnauthorized    = errors.New("asticrypt: unauthorized")
+	ErrUpgradeRequired = errors.New("asticrypt: upgrade required")
+)
+
+// errorCodes indexes error codes by sentinel error
+var errorCodes = []struct {
+	code   string
+	err    error
+	status int
+}{
+	{code: ErrorCodeBadRequest, err: ErrBadRequest, status: http.StatusBadRequest},
+	{code: ErrorCodeConflict, err: ErrConflict, status: http.StatusConflict},
+	{code: ErrorCodeInternal, err: ErrInternal, status: http.StatusInternalServerError},
+	{code: ErrorCodeNotFound, err: ErrNotFound, status: http.StatusNotFound},
+	{code: ErrorCodeSessionExpired, err: ErrSessionExpired, status: http.StatusUnauthorized},
+	{code: ErrorCodeTooManyRequests, err: ErrTooManyRequests, status: http.StatusTooManyRequests},
+	{code: ErrorCodeUnauthorized, err: ErrUnauthorized, status: http.StatusUnauthorized},
+	{code: ErrorCodeUpgradeRequired, err: ErrUpgradeRequired, status: http.StatusUpgradeRequired},
+}
+
+// BodyError is a body containing an error
+type BodyError struct {
+	Code    string            `json:"code,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+	Label   string            `json:"label"`
+	// Allows users to report errors that operators can then find in logs
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// NewBodyError builds a body containing an error that can be sent to clients
+// The code is the one of the first sentinel error wrapped by err and the label and details are the ones of the
+// first HandlerError wrapped by err. The error message itself is never sent.
+func NewBodyError(err error, defaultLabel string) (b BodyError) {
+	// Init
+	b = BodyError{Code: ErrorCodeInternal, Label: defaultLabel}
+
+	// Code
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			b.Code = c.code
+			break
+		}
+	}
+
+	// Label and details
+	var e HandlerError
+	if errors.As(err, &e) {
+		if len(e.Label) > 0 {
+			b.Label = e.Label
+		}
+		b.Details = e.Details
+	}
+	return
+}
+
+// Error implements the error interface
+func (b BodyError) Error() string {
+	return b.Label
+}
+
+// HTTPStatus returns the HTTP status matching the error code
+func (b BodyError) HTTPStatus() int {
+	for _, c := range errorCodes {
+		if c.code == b.Code {
+			return c.status
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// Is allows checking the code of an error with errors.Is and the sentinel errors
+func (b BodyError) Is(target error) bool {
+	for _, c := range errorCodes {
+		if c.err == target {
+			return c.code == b.Code
+		}
+	}
+	return false
+}
+
+// HandlerError represents an error returned by a handler alongside a label and details that can be sent to clients
+// The underlying error is never sent to clients
+type HandlerError struct {
+	Details map[string]string
+	Err     error
+	Label   string
+}
+
+// Error implements the error interface
+func (e HandlerError) Error() string {
+	return e.Err.Error()
+}
+
+// Cause returns the underlying error
+func (e HandlerError) Cause() error {
+	return e.Err
+}
+
+// Unwrap returns the underlying error
+func (e HandlerError) Unwrap() error {
+	return e.Err
+}
+
+// codedError represents an error wrapped with a sentinel error setting its code
+type codedError struct {
+	code error
+	err  error
+}
+
+// WithCode wraps an error with a sentinel error so that its code can be retrieved by NewBodyError and checked with
+// errors.Is
+func WithCode(code, err error) error {
+	return codedError{code: code, err: err}
+}
+
+// Error implements the error interface
+func (e codedError) Error() string {
+	return e.code.Error() + ": " + e.err.Error()
+}
+
+// Cause returns the underlying error
+func (e codedError) Cause() error {
+	return e.err
+}
+
+// Is allows checking the sentinel error with errors.Is
+func (e codedError) Is(target error) bool {
+	return e.code == target
+}
+
+// Unwrap returns the underlying error
+func (e codedError) Unwrap() error {
+	return e.err
+}
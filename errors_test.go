@@ -0,0 +1,46 @@
+package asticrypt_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/asticode/go-asticrypt"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBodyError(t *testing.T) {
+	// Default
+	b := asticrypt.NewBodyError(errors.New("test"), "label")
+	assert.Equal(t, asticrypt.BodyError{Code: asticrypt.ErrorCodeInternal, Label: "label"}, b)
+	assert.Equal(t, http.StatusInternalServerError, b.HTTPStatus())
+
+	// Sentinel and handler error
+	b = asticrypt.NewBodyError(errors.Wrap(asticrypt.HandlerError{
+		Details: map[string]string{"key": "value"},
+		Err:     asticrypt.WithCode(asticrypt.ErrConflict, errors.New("test")),
+		Label:   "handler label",
+	}, "wrapped"), "label")
+	assert.Equal(t, asticrypt.BodyError{Code: asticrypt.ErrorCodeConflict, Details: map[string]string{"key": "value"}, Label: "handler label"}, b)
+	assert.Equal(t, http.StatusConflict, b.HTTPStatus())
+	assert.True(t, errors.Is(b, asticrypt.ErrConflict))
+	assert.False(t, errors.Is(b, asticrypt.ErrNotFound))
+
+	// Coded error
+	err := asticrypt.WithCode(asticrypt.ErrBadRequest, errors.Wrap(errors.New("test"), "wrapped"))
+	assert.Equal(t, "asticrypt: bad request: wrapped: test", err.Error())
+	assert.True(t, errors.Is(err, asticrypt.ErrBadRequest))
+	assert.False(t, errors.Is(err, asticrypt.ErrConflict))
+	assert.Equal(t, "test", errors.Cause(err).Error())
+
+	// Status mapping
+	for code, status := range map[string]int{
+		asticrypt.ErrorCodeBadRequest:      http.StatusBadRequest,
+		asticrypt.ErrorCodeNotFound:        http.StatusNotFound,
+		asticrypt.ErrorCodeTooManyRequests: http.StatusTooManyRequests,
+		asticrypt.ErrorCodeUnauthorized:    http.StatusUnauthorized,
+		"unknown":                          http.StatusInternalServerError,
+	} {
+		assert.Equal(t, status, asticrypt.BodyError{Code: code}.HTTPStatus())
+	}
+}
@@ -0,0 +1,72 @@
+package asticrypt
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Safety number constants
+const (
+	safetyNumberIterations = 5200
+	safetyNumberVersion    = 0
+)
+
+// FingerprintHex returns the fingerprint as groups of 4 hex characters
+func (p PublicKey) FingerprintHex() string {
+	return groupString(hex.EncodeToString(p.fingerprint), 4, " ")
+}
+
+// FingerprintBase32 returns the fingerprint as words of 4 base32 characters
+func (p PublicKey) FingerprintBase32() string {
+	return groupString(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(p.fingerprint), 4, "-")
+}
+
+// SafetyNumber returns a numeric safety number computed from two keys, Signal style
+// Both parties get the same result whatever the order of the keys, and can compare it out of band
+func SafetyNumber(k1, k2 *PublicKey) string {
+	// Compute both fingerprints
+	var f1, f2 = safetyNumberFingerprint(k1), safetyNumberFingerprint(k2)
+
+	// Sort them so that the order of the keys doesn't matter
+	if f1 > f2 {
+		f1, f2 = f2, f1
+	}
+	return groupString(f1+f2, 5, " ")
+}
+
+// safetyNumberFingerprint returns the 30 digits that represent a key in a safety number
+func safetyNumberFingerprint(k *PublicKey) (o string) {
+	// Hash the key fingerprint iteratively
+	var v = make([]byte, 2)
+	binary.BigEndian.PutUint16(v, safetyNumberVersion)
+	var h = sha512.Sum512(append(v, k.fingerprint...))
+	for i := 0; i < safetyNumberIterations; i++ {
+		h = sha512.Sum512(append(h[:], k.fingerprint...))
+	}
+
+	// Convert each 5 bytes chunk to 5 digits
+	var buf bytes.Buffer
+	for i := 0; i < 30; i += 5 {
+		var c = uint64(h[i])<<32 | uint64(h[i+1])<<24 | uint64(h[i+2])<<16 | uint64(h[i+3])<<8 | uint64(h[i+4])
+		buf.WriteString(fmt.Sprintf("%05d", c%100000))
+	}
+	return buf.String()
+}
+
+// groupString splits a string in groups of n characters joined by a separator
+func groupString(i string, n int, sep string) string {
+	var gs []string
+	for len(i) > n {
+		gs = append(gs, i[:n])
+		i = i[n:]
+	}
+	if len(i) > 0 {
+		gs = append(gs, i)
+	}
+	return strings.Join(gs, sep)
+}
@@ -0,0 +1,27 @@
+package asticrypt_test
+
+import (
+	"testing"
+
+	"github.com/asticode/go-asticrypt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFingerprint(t *testing.T) {
+	// Init
+	var k1, k2 = &asticrypt.PublicKey{}, &asticrypt.PublicKey{}
+	err := k1.UnmarshalText([]byte(pub1))
+	assert.NoError(t, err)
+	err = k2.UnmarshalText([]byte(pub2))
+	assert.NoError(t, err)
+
+	// Assert
+	assert.Len(t, k1.Fingerprint(), 32)
+	assert.Len(t, k1.FingerprintHex(), 64+15)
+	assert.Regexp(t, "^([0-9a-f]{4} ){15}[0-9a-f]{4}$", k1.FingerprintHex())
+	assert.Regexp(t, "^([A-Z2-7]{4}-){12}[A-Z2-7]{4}$", k1.FingerprintBase32())
+	var n = asticrypt.SafetyNumber(k1, k2)
+	assert.Regexp(t, "^([0-9]{5} ){11}[0-9]{5}$", n)
+	assert.Equal(t, n, asticrypt.SafetyNumber(k2, k1))
+	assert.NotEqual(t, n, asticrypt.SafetyNumber(k1, k1))
+}
@@ -0,0 +1,406 @@
+package asticrypt
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Group skip limits
+// They prevent a malicious sender from making members compute or store a huge number of keys
+const (
+	// Maximum number of message keys that can be skipped by a single message
+	groupMaxSkip = 1000
+	// Maximum number of skipped message keys stored per sender key, the oldest ones are evicted first
+	groupMaxSkipped = 2000
+)
+
+// Group chain KDF constants
+var (
+	groupChainKeyConstant   = []byte{0x02}
+	groupMessageKeyConstant = []byte{0x01}
+)
+
+// ErrNotGroupMember is returned when a group message or a sender key doesn't come from a member of the group
+var ErrNotGroupMember = errors.New("asticrypt: sender is not a member of the group")
+
+// SenderKey represents the symmetric chain a member of a group uses to encrypt its messages
+// The chain key is ratcheted forward after each message so that compromising it doesn't expose previous messages
+type SenderKey struct {
+	ChainKey  []byte `json:"chain_key"`
+	GroupID   string `json:"group_id"`
+	ID        string `json:"id"`
+	Iteration uint32 `json:"iteration"`
+	// Message keys that have been skipped when receiving messages out of order, indexed by iteration
+	Skipped map[uint32][]byte `json:"skipped,omitempty"`
+}
+
+// newSenderKey generates a new sender key
+func newSenderKey(groupID string) (k *SenderKey, err error) {
+	// Init
+	k = &SenderKey{
+		ChainKey: make([]byte, aesKeyBits/8),
+		GroupID:  groupID,
+	}
+
+	// Generate ID
+	if k.ID, err = NewRequestID(); err != nil {
+		err = errors.Wrap(err, "generating ID failed")
+		return
+	}
+
+	// Generate chain key
+	if _, err = rand.Read(k.ChainKey); err != nil {
+		err = errors.Wrap(err, "generating chain key failed")
+		return
+	}
+	return
+}
+
+// next returns the message key of the current iteration and ratchets the chain forward
+func (k *SenderKey) next() (key []byte) {
+	key = hmacSHA256(k.ChainKey, groupMessageKeyConstant)
+	k.ChainKey = hmacSHA256(k.ChainKey, groupChainKeyConstant)
+	k.Iteration++
+	return
+}
+
+// messageKey returns the message key of an iteration, ratcheting the chain forward if needed
+// Message keys of skipped iterations are kept so that messages received out of order can be decrypted
+func (k *SenderKey) messageKey(iteration uint32) (key []byte, err error) {
+	// Message key has been skipped
+	if iteration < k.Iteration {
+		var ok bool
+		if key, ok = k.Skipped[iteration]; !ok {
+			err = fmt.Errorf("message key of iteration %d doesn't exist anymore", iteration)
+			return
+		}
+		delete(k.Skipped, iteration)
+		return
+	}
+
+	// Check skip
+	if iteration-k.Iteration > groupMaxSkip {
+		err = fmt.Errorf("skipping %d message keys is not allowed", iteration-k.Iteration)
+		return
+	}
+
+	// Ratchet the chain forward
+	for k.Iteration < iteration {
+		if k.Skipped == nil {
+			k.Skipped = make(map[uint32][]byte)
+		}
+		var i = k.Iteration
+		k.Skipped[i] = k.next()
+	}
+	key = k.next()
+
+	// Evict the oldest skipped message keys
+	// Messages lost for good would otherwise prevent the chain from moving forward
+	if len(k.Skipped) > groupMaxSkipped {
+		var is []uint32
+		for i := range k.Skipped {
+			is = append(is, i)
+		}
+		sort.Slice(is, func(a, b int) bool { return is[a] < is[b] })
+		for _, i := range is[:len(is)-groupMaxSkipped] {
+			delete(k.Skipped, i)
+		}
+	}
+	return
+}
+
+// Group represents the state of a group as seen by one of its members
+// Each member encrypts its messages once with its own sender key which is distributed to the other members through
+// an EncryptedMessage. Sender keys are rotated whenever the membership changes.
+// It must be stored by the member and saved each time it's updated. It's not safe for concurrent use.
+type Group struct {
+	ID string `json:"id"`
+	// Other members of the group
+	Members []*PublicKey `json:"members"`
+	// Own sender key
+	SenderKey *SenderKey `json:"sender_key,omitempty"`
+	// Sender keys of the other members, indexed by hex encoded public key hash
+	SenderKeys map[string]*SenderKey `json:"sender_keys,omitempty"`
+}
+
+// NewGroup creates a new group with the other members
+func NewGroup(id string, members []*PublicKey) *Group {
+	var g = &Group{
+		ID:         id,
+		SenderKeys: make(map[string]*SenderKey),
+	}
+	for _, m := range members {
+		if g.member(m.Hash()) == nil {
+			g.Members = append(g.Members, m)
+		}
+	}
+	return g
+}
+
+// member returns the member matching a public key hash
+func (g *Group) member(hash []byte) *PublicKey {
+	for _, m := range g.Members {
+		if bytes.Equal(m.Hash(), hash) {
+			return m
+		}
+	}
+	return nil
+}
+
+// Rotate generates a new sender key and returns the message distributing it to the other members
+func (g *Group) Rotate(prv *PrivateKey) (m *EncryptedMessage, err error) {
+	// Check members
+	if len(g.Members) == 0 {
+		err = errors.New("group has no other members")
+		return
+	}
+
+	// Generate sender key
+	var k *SenderKey
+	if k, err = newSenderKey(g.ID); err != nil {
+		err = errors.Wrap(err, "generating sender key failed")
+		return
+	}
+
+	// Encrypt sender key once for all members
+	if m, err = NewEncryptedMessageForRecipients(k, prv, g.Members, EncryptedMessageOptions{}); err != nil {
+		err = errors.Wrap(err, "encrypting sender key failed")
+		return
+	}
+	g.SenderKey = k
+	return
+}
+
+// AddMember adds a member and rotates the sender key
+// The returned message must be sent to all members, including the new one
+func (g *Group) AddMember(prv *PrivateKey, pub *PublicKey) (m *EncryptedMessage, err error) {
+	// Add member
+	if g.member(pub.Hash()) == nil {
+		g.Members = append(g.Members, pub)
+	}
+
+	// Rotate
+	if m, err = g.Rotate(prv); err != nil {
+		err = errors.Wrap(err, "rotating failed")
+		return
+	}
+	return
+}
+
+// RemoveMember removes a member, drops its sender key and rotates the sender key so that the removed member can't
+// decrypt messages anymore
+// The returned message must be sent to the remaining members who must remove the member as well. It's nil if no
+// members remain.
+func (g *Group) RemoveMember(prv *PrivateKey, pub *PublicKey) (m *EncryptedMessage, err error) {
+	// Remove member
+	for idx, v := range g.Members {
+		if bytes.Equal(v.Hash(), pub.Hash()) {
+			g.Members = append(g.Members[:idx], g.Members[idx+1:]...)
+			break
+		}
+	}
+	delete(g.SenderKeys, hex.EncodeToString(pub.Hash()))
+
+	// No members remain
+	if len(g.Members) == 0 {
+		g.SenderKey = nil
+		return
+	}
+
+	// Rotate
+	if m, err = g.Rotate(prv); err != nil {
+		err = errors.Wrap(err, "rotating failed")
+		return
+	}
+	return
+}
+
+// ProcessSenderKey decrypts the sender key distributed by a member and stores it
+func (g *Group) ProcessSenderKey(m *EncryptedMessage, prv *PrivateKey, sender *PublicKey) (err error) {
+	// Check sender
+	if g.member(sender.Hash()) == nil {
+		err = ErrNotGroupMember
+		return
+	}
+
+	// Decrypt sender key
+	var k SenderKey
+	if err = m.Decrypt(&k, prv, sender); err != nil {
+		err = errors.Wrap(err, "decrypting sender key failed")
+		return
+	}
+
+	// Check group
+	if k.GroupID != g.ID {
+		err = fmt.Errorf("sender key group %s != group %s", k.GroupID, g.ID)
+		return
+	}
+
+	// Store sender key
+	if g.SenderKeys == nil {
+		g.SenderKeys = make(map[string]*SenderKey)
+	}
+	g.SenderKeys[hex.EncodeToString(sender.Hash())] = &k
+	return
+}
+
+// GroupMessage represents a message encrypted once for all the members of a group
+type GroupMessage struct {
+	GroupID         string `json:"group_id"`
+	Iteration       uint32 `json:"iteration"`
+	KeyID           string `json:"key_id"`
+	Message         []byte `json:"message"`
+	Nonce           []byte `json:"nonce"`
+	Sender          []byte `json:"sender"`
+	Signature       []byte `json:"signature"`
+	SignatureScheme string `json:"signature_scheme"`
+}
+
+// additionalData returns the data authenticated alongside the message
+func (m GroupMessage) additionalData() (o []byte) {
+	o = append(o, []byte(fmt.Sprintf("asticrypt/group|%s|%s|%d|%s|", m.GroupID, m.KeyID, m.Iteration, m.SignatureScheme))...)
+	o = append(o, m.Sender...)
+	o = append(o, m.Nonce...)
+	return
+}
+
+// hash hashes the parts of the message that are signed
+func (m GroupMessage) hash() []byte {
+	var h = sha512.New()
+	h.Write(m.additionalData())
+	h.Write(m.Message)
+	return h.Sum(nil)
+}
+
+// Encrypt encrypts a message with the sender key and signs it
+// The sender key must have been distributed with Rotate beforehand
+func (g *Group) Encrypt(i interface{}, prv *PrivateKey) (m *GroupMessage, err error) {
+	// Check sender key
+	if g.SenderKey == nil {
+		err = errors.New("sender key doesn't exist")
+		return
+	}
+
+	// Init
+	m = &GroupMessage{
+		GroupID:         g.ID,
+		Iteration:       g.SenderKey.Iteration,
+		KeyID:           g.SenderKey.ID,
+		Sender:          prv.Public().Hash(),
+		SignatureScheme: prv.Public().signatureScheme(),
+	}
+
+	// Marshal message
+	var msg []byte
+	if msg, err = json.Marshal(i); err != nil {
+		err = errors.Wrap(err, "marshaling message failed")
+		return
+	}
+
+	// Create AEAD
+	var a cipher.AEAD
+	if a, err = newAEAD(EncryptionModeAES256GCM, g.SenderKey.next()); err != nil {
+		err = errors.Wrap(err, "creating AEAD failed")
+		return
+	}
+
+	// Generate nonce
+	m.Nonce = make([]byte, a.NonceSize())
+	if _, err = rand.Read(m.Nonce); err != nil {
+		err = errors.Wrap(err, "generating nonce failed")
+		return
+	}
+
+	// Seal
+	m.Message = a.Seal(nil, m.Nonce, msg, m.additionalData())
+
+	// Sign
+	if m.Signature, err = prv.sign(m.hash()); err != nil {
+		err = errors.Wrap(err, "signing failed")
+		return
+	}
+	return
+}
+
+// Decrypt verifies and decrypts a message sent by a member
+// It returns the public key of the sender
+func (g *Group) Decrypt(m *GroupMessage, o interface{}) (sender *PublicKey, err error) {
+	// Check group
+	if m.GroupID != g.ID {
+		err = fmt.Errorf("message group %s != group %s", m.GroupID, g.ID)
+		return
+	}
+
+	// Get sender
+	if sender = g.member(m.Sender); sender == nil {
+		err = ErrNotGroupMember
+		return
+	}
+
+	// Verify signature
+	if err = sender.verify(m.SignatureScheme, m.hash(), m.Signature); err != nil {
+		err = errors.Wrap(err, "verifying signature failed")
+		return
+	}
+
+	// Get sender key
+	k, ok := g.SenderKeys[hex.EncodeToString(m.Sender)]
+	if !ok {
+		err = errors.New("sender key doesn't exist")
+		return
+	} else if k.ID != m.KeyID {
+		err = fmt.Errorf("sender key %s != message key %s", k.ID, m.KeyID)
+		return
+	}
+
+	// Get message key
+	// The sender key is only updated once the message has been opened so that forged messages can't advance it
+	var c = *k
+	c.Skipped = make(map[uint32][]byte, len(k.Skipped))
+	for i, v := range k.Skipped {
+		c.Skipped[i] = v
+	}
+	var key []byte
+	if key, err = c.messageKey(m.Iteration); err != nil {
+		err = errors.Wrap(err, "getting message key failed")
+		return
+	}
+
+	// Create AEAD
+	var a cipher.AEAD
+	if a, err = newAEAD(EncryptionModeAES256GCM, key); err != nil {
+		err = errors.Wrap(err, "creating AEAD failed")
+		return
+	}
+
+	// Check nonce
+	if len(m.Nonce) != a.NonceSize() {
+		err = fmt.Errorf("nonce size %d is invalid", len(m.Nonce))
+		return
+	}
+
+	// Open
+	var msg []byte
+	if msg, err = a.Open(nil, m.Nonce, m.Message, m.additionalData()); err != nil {
+		err = errors.Wrap(err, "opening AEAD failed")
+		return
+	}
+
+	// Unmarshal message
+	if err = json.Unmarshal(msg, o); err != nil {
+		err = errors.Wrap(err, "unmarshaling message failed")
+		return
+	}
+
+	// Update sender key
+	*k = c
+	return
+}
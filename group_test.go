@@ -0,0 +1,157 @@
+package asticrypt_test
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/asticode/go-asticrypt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroup(t *testing.T) {
+	// Init
+	pka, err := asticrypt.GeneratePrivateKeyWithType(asticrypt.KeyTypeEd25519, "")
+	assert.NoError(t, err)
+	pkb, err := asticrypt.GeneratePrivateKeyWithType(asticrypt.KeyTypeEd25519, "")
+	assert.NoError(t, err)
+	pkc, err := asticrypt.GeneratePrivateKeyWithType(asticrypt.KeyTypeECDSAP256, "")
+	assert.NoError(t, err)
+	var ga = asticrypt.NewGroup("group", []*asticrypt.PublicKey{pkb.Public()})
+	var gb = asticrypt.NewGroup("group", []*asticrypt.PublicKey{pka.Public()})
+
+	// Distribute sender keys
+	m, err := ga.Rotate(pka)
+	assert.NoError(t, err)
+	err = gb.ProcessSenderKey(m, pkb, pka.Public())
+	assert.NoError(t, err)
+
+	// Encrypt
+	var ms []*asticrypt.GroupMessage
+	for _, v := range []string{"1", "2", "3"} {
+		gm, err := ga.Encrypt(v, pka)
+		assert.NoError(t, err)
+		ms = append(ms, gm)
+	}
+
+	// Decrypt out of order
+	for _, idx := range []int{0, 2, 1} {
+		var o string
+		s, err := gb.Decrypt(ms[idx], &o)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"1", "2", "3"}[idx], o)
+		assert.Equal(t, pka.Public().Hash(), s.Hash())
+	}
+
+	// Replayed messages are rejected
+	var o string
+	_, err = gb.Decrypt(ms[0], &o)
+	assert.Error(t, err)
+
+	// Tampering is detected and doesn't advance the chain
+	gm, err := ga.Encrypt("4", pka)
+	assert.NoError(t, err)
+	var gmt = *gm
+	gmt.Message = append([]byte{}, gm.Message...)
+	gmt.Message[0] ^= 0xff
+	_, err = gb.Decrypt(&gmt, &o)
+	assert.Error(t, err)
+	_, err = gb.Decrypt(gm, &o)
+	assert.NoError(t, err)
+	assert.Equal(t, "4", o)
+
+	// Group survives being saved
+	b, err := json.Marshal(gb)
+	assert.NoError(t, err)
+	gb = &asticrypt.Group{}
+	err = json.Unmarshal(b, gb)
+	assert.NoError(t, err)
+
+	// Add member
+	var gc = asticrypt.NewGroup("group", []*asticrypt.PublicKey{pka.Public(), pkb.Public()})
+	m, err = ga.AddMember(pka, pkc.Public())
+	assert.NoError(t, err)
+	err = gb.ProcessSenderKey(m, pkb, pka.Public())
+	assert.NoError(t, err)
+	err = gc.ProcessSenderKey(m, pkc, pka.Public())
+	assert.NoError(t, err)
+	gm, err = ga.Encrypt("5", pka)
+	assert.NoError(t, err)
+	for _, g := range []*asticrypt.Group{gb, gc} {
+		_, err = g.Decrypt(gm, &o)
+		assert.NoError(t, err)
+		assert.Equal(t, "5", o)
+	}
+
+	// New members can't decrypt messages sent before they joined
+	_, err = gc.Decrypt(ms[0], &o)
+	assert.Error(t, err)
+
+	// Remove member
+	m, err = ga.RemoveMember(pka, pkc.Public())
+	assert.NoError(t, err)
+	err = gb.ProcessSenderKey(m, pkb, pka.Public())
+	assert.NoError(t, err)
+	err = gc.ProcessSenderKey(m, pkc, pka.Public())
+	assert.Error(t, err)
+	gm, err = ga.Encrypt("6", pka)
+	assert.NoError(t, err)
+	_, err = gb.Decrypt(gm, &o)
+	assert.NoError(t, err)
+	assert.Equal(t, "6", o)
+	_, err = gc.Decrypt(gm, &o)
+	assert.Error(t, err)
+
+	// Non members are rejected
+	var gd = asticrypt.NewGroup("group", []*asticrypt.PublicKey{pkb.Public()})
+	m, err = gd.Rotate(pkc)
+	assert.NoError(t, err)
+	err = gb.ProcessSenderKey(m, pkb, pkc.Public())
+	assert.Equal(t, asticrypt.ErrNotGroupMember, err)
+}
+
+func TestGroupLostMessages(t *testing.T) {
+	// Init
+	pka, err := asticrypt.GeneratePrivateKeyWithType(asticrypt.KeyTypeEd25519, "")
+	assert.NoError(t, err)
+	pkb, err := asticrypt.GeneratePrivateKeyWithType(asticrypt.KeyTypeEd25519, "")
+	assert.NoError(t, err)
+	var ga = asticrypt.NewGroup("group", []*asticrypt.PublicKey{pkb.Public()})
+	var gb = asticrypt.NewGroup("group", []*asticrypt.PublicKey{pka.Public()})
+	m, err := ga.Rotate(pka)
+	assert.NoError(t, err)
+	err = gb.ProcessSenderKey(m, pkb, pka.Public())
+	assert.NoError(t, err)
+
+	// Encrypt
+	var ms []*asticrypt.GroupMessage
+	for i := 0; i <= 4000; i++ {
+		gm, err := ga.Encrypt(i, pka)
+		assert.NoError(t, err)
+		ms = append(ms, gm)
+	}
+
+	// Most messages are lost but the chain keeps moving forward
+	var o int
+	for i := 1000; i < len(ms); i += 1000 {
+		_, err = gb.Decrypt(ms[i], &o)
+		assert.NoError(t, err)
+		assert.Equal(t, i, o)
+	}
+	assert.LessOrEqual(t, len(gb.SenderKeys[hex.EncodeToString(pka.Public().Hash())].Skipped), 2000)
+
+	// Recent skipped message keys are kept, the oldest ones are evicted
+	_, err = gb.Decrypt(ms[3999], &o)
+	assert.NoError(t, err)
+	_, err = gb.Decrypt(ms[0], &o)
+	assert.Error(t, err)
+
+	// A single message can't skip too many message keys
+	for i := 0; i < 1002; i++ {
+		gm, err := ga.Encrypt(i, pka)
+		assert.NoError(t, err)
+		ms = append(ms, gm)
+	}
+	_, err = gb.Decrypt(ms[len(ms)-1], &o)
+	assert.Error(t, err)
+}
@@ -1,6 +1,8 @@
 package asticrypt
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"time"
@@ -10,32 +12,50 @@ import (
 
 // Body names
 const (
-	NameAccountAdd   = "account.add"
-	NameAccountFetch = "account.fetch"
-	NameAccountList  = "account.list"
-	NameError        = "error"
-	NameReferences   = "references"
+	NameAccountAdd          = "account.add"
+	NameAccountFetch        = "account.fetch"
+	NameAccountList         = "account.list"
+	NameBatch               = "batch"
+	NameError               = "error"
+	NamePrekeyBundleFetch   = "prekey_bundle.fetch"
+	NamePrekeyBundlePublish = "prekey_bundle.publish"
+	NameReferences          = "references"
+	NameSessionOpen         = "session.open"
 )
 
-// BodyError is a body containing an error
-type BodyError struct {
-	Label string `json:"label"`
+// HeaderRequestID is the plain HTTP header carrying the request ID so that requests can be correlated without
+// decrypting anything
+// It is not authenticated: the authenticated request ID is the one inside the encrypted message
+const HeaderRequestID = "X-Request-ID"
+
+// BodyMessageValidityDefault is the default duration a message creation date can differ from now
+const BodyMessageValidityDefault = 5 * time.Second
+
+// BodyBatchItem represents a sub-request of a batch
+type BodyBatchItem struct {
+	Name    string          `json:"name"`
+	Payload json.RawMessage `json:"payload,omitempty"`
 }
 
-// Error implements the error interface
-func (b BodyError) Error() string {
-	return b.Label
+// BodyBatchResult represents the result of a sub-request of a batch
+// Results are in the same order as sub-requests
+type BodyBatchResult struct {
+	Error   *BodyError      `json:"error,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
 }
 
 // BodyKey is a body containing a key
 type BodyKey struct {
-	Key *PublicKey `json:"key,omitempty"`
+	Capabilities *BodyCapabilities `json:"capabilities,omitempty"`
+	Key          *PublicKey        `json:"key,omitempty"`
 }
 
 // BodyMessage is a body containing an encrypted message
+// Messages are either encrypted with public keys or sealed within a session
 type BodyMessage struct {
-	Message *EncryptedMessage `json:"message,omitempty"`
-	Key     *PublicKey        `json:"key,omitempty"`
+	Message *EncryptedMessage   `json:"message,omitempty"`
+	Key     *PublicKey          `json:"key,omitempty"`
+	Session *BodySessionMessage `json:"session,omitempty"`
 }
 
 // BodyMessageIn represents the body of a message coming in
@@ -44,20 +64,79 @@ type BodyMessageIn struct {
 	Payload json.RawMessage `json:"payload"`
 }
 
+// BodyMessageDecryptOptions represents the options used when decrypting a body containing a message
+type BodyMessageDecryptOptions struct {
+	// If set, messages already seen within the scope are rejected
+	ReplayCache ReplayCache
+	ReplayScope string
+	// Set when decrypting the response to a request sent within a session
+	Response bool
+	// Required to decrypt messages sealed within a session
+	Session *Session
+	// Defaults to BodyMessageValidityDefault
+	Validity time.Duration
+}
+
 // BodyMessageOut represents the body of a message going out
 type BodyMessageOut struct {
-	CreatedAt time.Time   `json:"created_at"`
-	Name      string      `json:"name"`
-	Payload   interface{} `json:"payload"`
+	CreatedAt       time.Time   `json:"created_at"`
+	ID              string      `json:"id"`
+	Name            string      `json:"name"`
+	Payload         interface{} `json:"payload"`
+	ProtocolVersion int         `json:"protocol_version,omitempty"`
+	// Shared by a request and its response
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// BodyMessageOptions represents the options used when building a body containing a message
+type BodyMessageOptions struct {
+	// Defaults to the message ID, which is what requests want. Responses must use the request ID of the request.
+	RequestID string
+	// Set when responding to a request sent within a session
+	Response bool
+	// If set, the message is sealed within the session instead of being encrypted with public keys
+	Session *Session
 }
 
 // NewBodyMessage builds a new body containing an encrypted message and a name
 func NewBodyMessage(name string, i interface{}, prvSrc *PrivateKey, pubSrc, pubDst *PublicKey, now time.Time) (b BodyMessage, err error) {
-	// Init
-	b = BodyMessage{Key: pubSrc}
+	return NewBodyMessageWithOptions(name, i, prvSrc, pubSrc, pubDst, now, BodyMessageOptions{})
+}
+
+// NewBodyMessageWithOptions builds a new body containing an encrypted message and a name with specific options
+func NewBodyMessageWithOptions(name string, i interface{}, prvSrc *PrivateKey, pubSrc, pubDst *PublicKey, now time.Time, o BodyMessageOptions) (b BodyMessage, err error) {
+	// Generate ID
+	var id string
+	if id, err = NewRequestID(); err != nil {
+		err = errors.Wrap(err, "generating ID failed")
+		return
+	}
+	if len(o.RequestID) == 0 {
+		o.RequestID = id
+	}
+
+	// Build message
+	var m = BodyMessageOut{
+		CreatedAt:       now,
+		ID:              id,
+		Name:            name,
+		Payload:         i,
+		ProtocolVersion: ProtocolVersionCurrent,
+		RequestID:       o.RequestID,
+	}
+
+	// Seal message within session
+	if o.Session != nil {
+		if b.Session, err = o.Session.seal(m, o.Response); err != nil {
+			err = errors.Wrap(err, "sealing message within session failed")
+			return
+		}
+		return
+	}
 
 	// Encrypt message
-	if b.Message, err = NewEncryptedMessage(BodyMessageOut{CreatedAt: now, Name: name, Payload: i}, prvSrc, pubDst); err != nil {
+	b.Key = pubSrc
+	if b.Message, err = NewEncryptedMessage(m, prvSrc, pubDst); err != nil {
 		err = errors.Wrap(err, "creating new encrypted message failed")
 		return
 	}
@@ -66,23 +145,113 @@ func NewBodyMessage(name string, i interface{}, prvSrc *PrivateKey, pubSrc, pubD
 
 // Decrypt decrypts the body containing the message
 func (b *BodyMessage) Decrypt(prvSrc *PrivateKey, pubDst *PublicKey, now time.Time) (m BodyMessageIn, err error) {
+	return b.DecryptWithOptions(prvSrc, pubDst, now, BodyMessageDecryptOptions{})
+}
+
+// DecryptOnce decrypts the body containing the message and makes sure it hasn't been seen before within the scope
+func (b *BodyMessage) DecryptOnce(prvSrc *PrivateKey, pubDst *PublicKey, now time.Time, c ReplayCache, scope string) (m BodyMessageIn, err error) {
+	return b.DecryptWithOptions(prvSrc, pubDst, now, BodyMessageDecryptOptions{ReplayCache: c, ReplayScope: scope})
+}
+
+// DecryptWithOptions decrypts the body containing the message with specific options
+func (b *BodyMessage) DecryptWithOptions(prvSrc *PrivateKey, pubDst *PublicKey, now time.Time, o BodyMessageDecryptOptions) (m BodyMessageIn, err error) {
+	// Init
+	if o.Validity <= 0 {
+		o.Validity = BodyMessageValidityDefault
+	}
+
 	// Decrypt the message
-	if err = b.Message.Decrypt(&m, prvSrc, pubDst); err != nil {
-		err = errors.Wrap(err, "decrypting message failed")
+	if b.Session != nil {
+		// Check session
+		if o.Session == nil {
+			err = errors.New("message is sealed within a session but no session was provided")
+			return
+		} else if o.Session.IsExpired(now) {
+			err = ErrSessionExpired
+			return
+		}
+
+		// Open
+		if err = o.Session.open(b.Session, &m, o.Response); err != nil {
+			err = errors.Wrap(err, "opening message sealed within session failed")
+			return
+		}
+	} else if b.Message != nil {
+		if err = b.Message.Decrypt(&m, prvSrc, pubDst); err != nil {
+			err = errors.Wrap(err, "decrypting message failed")
+			return
+		}
+	} else {
+		err = errors.New("body contains no message")
 		return
 	}
 
 	// Validate the message creation date
-	if m.CreatedAt.After(now.Add(5*time.Second)) || m.CreatedAt.Before(now.Add(-5*time.Second)) {
+	if m.CreatedAt.After(now.Add(o.Validity)) || m.CreatedAt.Before(now.Add(-o.Validity)) {
 		err = fmt.Errorf("Request creation date %s is invalid compared to now %s", m.CreatedAt, now)
 		return
 	}
+
+	// Validate the message ID
+	if len(m.ID) == 0 {
+		err = errors.New("Request ID is empty")
+		return
+	}
+
+	// Add to replay cache
+	// The ID must be kept as long as the message is valid
+	if o.ReplayCache != nil {
+		if err = o.ReplayCache.Add(o.ReplayScope, m.ID, m.CreatedAt.Add(o.Validity)); err != nil {
+			if err != ErrReplayedMessage {
+				err = errors.Wrap(err, "adding to replay cache failed")
+			}
+			return
+		}
+	}
 	return
 }
 
 // BodyReferences represents a body containing references
 type BodyReferences struct {
-	GoogleClientID     string    `json:"google_client_id"`
-	GoogleClientSecret string    `json:"google_client_secret"`
-	Now                time.Time `json:"now"`
+	Capabilities       BodyCapabilities `json:"capabilities"`
+	GoogleClientID     string           `json:"google_client_id"`
+	GoogleClientSecret string           `json:"google_client_secret"`
+	Now                time.Time        `json:"now"`
+}
+
+// BodyTime represents a body containing the server time
+// It is not authenticated: it is only used to compensate clock drifts, messages are still authenticated by signatures
+type BodyTime struct {
+	Now time.Time `json:"now"`
+}
+
+// ClockOffset returns the offset to add to the local clock to match the server clock
+// The server time is assumed to have been read halfway between the moment the request was sent and the moment the
+// response was received
+func ClockOffset(serverNow, sentAt, receivedAt time.Time) time.Duration {
+	return serverNow.Sub(sentAt.Add(receivedAt.Sub(sentAt) / 2))
+}
+
+// NewRequestID generates a random ID suitable for messages and requests
+func NewRequestID() (id string, err error) {
+	var b = make([]byte, 16)
+	if _, err = rand.Read(b); err != nil {
+		err = errors.Wrap(err, "reading random bytes failed")
+		return
+	}
+	id = hex.EncodeToString(b)
+	return
+}
+
+// IsValidRequestID checks whether a request ID can safely be logged and sent back in a header
+func IsValidRequestID(id string) bool {
+	if len(id) == 0 || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
 }
@@ -1,6 +1,7 @@
 package asticrypt_test
 
 import (
+	"strings"
 	"testing"
 	"time"
 
@@ -24,4 +25,54 @@ func TestBodyMessage(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "\"test\"", string(m.Payload))
 	assert.Equal(t, "name", m.Name)
+	assert.NotEmpty(t, m.ID)
+
+	// Replay
+	var c = asticrypt.NewReplayCacheMemory()
+	_, err = b.DecryptOnce(pk2, pk1.Public(), time.Now(), c, "scope")
+	assert.NoError(t, err)
+	_, err = b.DecryptOnce(pk2, pk1.Public(), time.Now(), c, "scope")
+	assert.Equal(t, asticrypt.ErrReplayedMessage, err)
+	_, err = b.DecryptOnce(pk2, pk1.Public(), time.Now(), c, "other")
+	assert.NoError(t, err)
+	b2, err := asticrypt.NewBodyMessage("name", "test", pk1, pk1.Public(), pk2.Public(), time.Now())
+	assert.NoError(t, err)
+	_, err = b2.DecryptOnce(pk2, pk1.Public(), time.Now(), c, "scope")
+	assert.NoError(t, err)
+}
+
+func TestBodyMessageValidity(t *testing.T) {
+	// Init
+	var pk1, pk2 = &asticrypt.PrivateKey{}, &asticrypt.PrivateKey{}
+	pk1.SetPassphrase("test")
+	err := pk1.UnmarshalText([]byte(prv1))
+	assert.NoError(t, err)
+	err = pk2.UnmarshalText([]byte(prv2))
+	assert.NoError(t, err)
+	var now = time.Now()
+	b, err := asticrypt.NewBodyMessage("name", "test", pk1, pk1.Public(), pk2.Public(), now.Add(-10*time.Second))
+	assert.NoError(t, err)
+
+	// Assert
+	_, err = b.Decrypt(pk2, pk1.Public(), now)
+	assert.Error(t, err)
+	_, err = b.DecryptWithOptions(pk2, pk1.Public(), now, asticrypt.BodyMessageDecryptOptions{Validity: 15 * time.Second})
+	assert.NoError(t, err)
+}
+
+func TestClockOffset(t *testing.T) {
+	var sentAt = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, 9*time.Second, asticrypt.ClockOffset(sentAt.Add(10*time.Second), sentAt, sentAt.Add(2*time.Second)))
+	assert.Equal(t, -11*time.Second, asticrypt.ClockOffset(sentAt.Add(-10*time.Second), sentAt, sentAt.Add(2*time.Second)))
+}
+
+func TestIsValidRequestID(t *testing.T) {
+	id, err := asticrypt.NewRequestID()
+	assert.NoError(t, err)
+	assert.True(t, asticrypt.IsValidRequestID(id))
+	assert.True(t, asticrypt.IsValidRequestID("plain-id_1"))
+	assert.False(t, asticrypt.IsValidRequestID(""))
+	assert.False(t, asticrypt.IsValidRequestID(strings.Repeat("a", 65)))
+	assert.False(t, asticrypt.IsValidRequestID("id\nforged log line"))
+	assert.False(t, asticrypt.IsValidRequestID("[id]"))
 }
@@ -0,0 +1,328 @@
+package asticrypt
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Passphrase key derivation functions
+const (
+	KDFArgon2id = "argon2id"
+	KDFScrypt   = "scrypt"
+)
+
+// Passphrase pem block type and headers
+const (
+	pemHeaderCipher            = "Cipher"
+	pemHeaderInnerType         = "Inner-Type"
+	pemHeaderKDF               = "KDF"
+	pemHeaderKDFParams         = "KDF-Params"
+	pemHeaderNonce             = "Nonce"
+	pemHeaderSalt              = "Salt"
+	pemTypeEncryptedPrivateKey = "ASTICRYPT ENCRYPTED PRIVATE KEY"
+)
+
+// Passphrase limits
+// They prevent a crafted key from exhausting resources when being unmarshaled
+const (
+	passphraseMaxArgon2Threads = 16
+	passphraseMaxArgon2Time    = 10
+	passphraseMaxMemory        = 256 * 1024 * 1024 // In bytes
+	passphraseMaxScryptP       = 16
+	passphraseMaxScryptR       = 32
+	passphraseSaltSize         = 16
+)
+
+// ErrWrongPassphrase is returned when a private key can't be decrypted with the provided passphrase
+var ErrWrongPassphrase = errors.New("asticrypt: wrong passphrase")
+
+// PassphraseOptions represents the options used to protect a private key with a passphrase
+// Zero values are replaced with defaults
+type PassphraseOptions struct {
+	Argon2Memory  uint32 // In KiB
+	Argon2Threads uint8
+	Argon2Time    uint32
+	Cipher        string
+	KDF           string
+	ScryptN       int
+	ScryptP       int
+	ScryptR       int
+}
+
+// withDefaults returns the options with defaults for zero values
+func (o PassphraseOptions) withDefaults() PassphraseOptions {
+	if len(o.Cipher) == 0 {
+		o.Cipher = EncryptionModeAES256GCM
+	}
+	if len(o.KDF) == 0 {
+		o.KDF = KDFArgon2id
+	}
+	if o.Argon2Memory == 0 {
+		o.Argon2Memory = 64 * 1024
+	}
+	if o.Argon2Threads == 0 {
+		o.Argon2Threads = 4
+	}
+	if o.Argon2Time == 0 {
+		o.Argon2Time = 3
+	}
+	if o.ScryptN == 0 {
+		o.ScryptN = 1 << 15
+	}
+	if o.ScryptP == 0 {
+		o.ScryptP = 1
+	}
+	if o.ScryptR == 0 {
+		o.ScryptR = 8
+	}
+	return o
+}
+
+// kdfParams returns the serialized KDF params
+func (o PassphraseOptions) kdfParams() string {
+	if o.KDF == KDFScrypt {
+		return fmt.Sprintf("n=%d,r=%d,p=%d", o.ScryptN, o.ScryptR, o.ScryptP)
+	}
+	return fmt.Sprintf("t=%d,m=%d,p=%d", o.Argon2Time, o.Argon2Memory, o.Argon2Threads)
+}
+
+// passphraseKDFParams are the KDF params each KDF requires
+var passphraseKDFParams = map[string][]string{
+	KDFArgon2id: {"t", "m", "p"},
+	KDFScrypt:   {"n", "r", "p"},
+}
+
+// parsePassphraseOptions parses passphrase options from pem headers
+// Every param of the KDF is required and must be positive since a zero value would make the KDF panic
+func parsePassphraseOptions(h map[string]string) (o PassphraseOptions, err error) {
+	// Init
+	o = PassphraseOptions{Cipher: h[pemHeaderCipher], KDF: h[pemHeaderKDF]}
+
+	// Get KDF params
+	names, ok := passphraseKDFParams[o.KDF]
+	if !ok {
+		err = UnsupportedAlgorithmError{Algorithm: o.KDF, Kind: "KDF"}
+		return
+	}
+
+	// Parse params
+	var ps = make(map[string]int)
+	for _, p := range strings.Split(h[pemHeaderKDFParams], ",") {
+		var kv = strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			err = fmt.Errorf("KDF param %s is invalid", p)
+			return
+		}
+		if !isSupported(kv[0], names) {
+			err = fmt.Errorf("KDF param %s is unknown", p)
+			return
+		}
+		if _, ok = ps[kv[0]]; ok {
+			err = fmt.Errorf("KDF param %s is duplicated", p)
+			return
+		}
+		if ps[kv[0]], err = strconv.Atoi(kv[1]); err != nil || ps[kv[0]] <= 0 {
+			err = fmt.Errorf("KDF param %s is invalid", p)
+			return
+		}
+	}
+
+	// Check required params
+	for _, n := range names {
+		if _, ok = ps[n]; !ok {
+			err = fmt.Errorf("KDF param %s is missing", n)
+			return
+		}
+	}
+
+	// Switch on KDF
+	switch o.KDF {
+	case KDFArgon2id:
+		if ps["p"] > passphraseMaxArgon2Threads || ps["t"] > passphraseMaxArgon2Time || ps["m"] > passphraseMaxMemory/1024 {
+			err = fmt.Errorf("KDF params %s are out of bounds", h[pemHeaderKDFParams])
+			return
+		}
+		o.Argon2Time, o.Argon2Memory, o.Argon2Threads = uint32(ps["t"]), uint32(ps["m"]), uint8(ps["p"])
+	case KDFScrypt:
+		if ps["n"] < 2 || ps["n"]&(ps["n"]-1) != 0 {
+			err = fmt.Errorf("KDF param n=%d is not a power of two", ps["n"])
+			return
+		}
+		if ps["n"] > passphraseMaxMemory/128 || ps["r"] > passphraseMaxScryptR || ps["p"] > passphraseMaxScryptP {
+			err = fmt.Errorf("KDF params %s are out of bounds", h[pemHeaderKDFParams])
+			return
+		}
+		o.ScryptN, o.ScryptR, o.ScryptP = ps["n"], ps["r"], ps["p"]
+	}
+
+	// Check limits
+	if err = o.checkLimits(); err != nil {
+		err = fmt.Errorf("KDF params %s are out of bounds: %s", h[pemHeaderKDFParams], err)
+		return
+	}
+	return
+}
+
+// checkLimits checks that the memory the KDF needs is within limits
+func (o PassphraseOptions) checkLimits() error {
+	var m uint64
+	switch o.KDF {
+	case KDFArgon2id:
+		m = uint64(o.Argon2Memory) * 1024
+	case KDFScrypt:
+		// scrypt allocates 128*r*p bytes for B and 128*r*N bytes for V
+		m = 128 * uint64(o.ScryptR) * (uint64(o.ScryptN) + uint64(o.ScryptP))
+	}
+	if m > passphraseMaxMemory {
+		return fmt.Errorf("KDF memory %d is bigger than %d", m, passphraseMaxMemory)
+	}
+	return nil
+}
+
+// deriveKey derives a key from a passphrase
+func (o PassphraseOptions) deriveKey(passphrase string, salt []byte) (k []byte, err error) {
+	switch o.KDF {
+	case KDFArgon2id:
+		k = argon2.IDKey([]byte(passphrase), salt, o.Argon2Time, o.Argon2Memory, o.Argon2Threads, uint32(aesKeyBits/8))
+	case KDFScrypt:
+		if k, err = scrypt.Key([]byte(passphrase), salt, o.ScryptN, o.ScryptR, o.ScryptP, aesKeyBits/8); err != nil {
+			err = errors.Wrap(err, "scrypt.Key failed")
+			return
+		}
+	default:
+		err = UnsupportedAlgorithmError{Algorithm: o.KDF, Kind: "KDF"}
+	}
+	return
+}
+
+// passphraseAdditionalData returns the pem headers authenticated alongside the private key
+func passphraseAdditionalData(h map[string]string) []byte {
+	var ks []string
+	for k := range h {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	var b []byte
+	for _, k := range ks {
+		b = append(b, []byte(k+": "+h[k]+"\n")...)
+	}
+	return b
+}
+
+// encryptPEMBlock encrypts a pem block with a passphrase
+func encryptPEMBlock(i *pem.Block, passphrase string, o PassphraseOptions) (b *pem.Block, err error) {
+	// Init
+	o = o.withDefaults()
+	b = &pem.Block{
+		Headers: map[string]string{
+			pemHeaderCipher:    o.Cipher,
+			pemHeaderInnerType: i.Type,
+			pemHeaderKDF:       o.KDF,
+			pemHeaderKDFParams: o.kdfParams(),
+		},
+		Type: pemTypeEncryptedPrivateKey,
+	}
+
+	// Check limits
+	// Otherwise the private key couldn't be unmarshaled
+	if err = o.checkLimits(); err != nil {
+		err = errors.Wrap(err, "checking limits failed")
+		return
+	}
+
+	// Generate salt
+	var salt = make([]byte, passphraseSaltSize)
+	if _, err = rand.Read(salt); err != nil {
+		err = errors.Wrap(err, "generating salt failed")
+		return
+	}
+	b.Headers[pemHeaderSalt] = hex.EncodeToString(salt)
+
+	// Derive key
+	var k []byte
+	if k, err = o.deriveKey(passphrase, salt); err != nil {
+		err = errors.Wrap(err, "deriving key failed")
+		return
+	}
+
+	// Create AEAD
+	var a cipher.AEAD
+	if a, err = newAEAD(o.Cipher, k); err != nil {
+		err = errors.Wrap(err, "creating AEAD failed")
+		return
+	}
+
+	// Generate nonce
+	var nonce = make([]byte, a.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		err = errors.Wrap(err, "generating nonce failed")
+		return
+	}
+	b.Headers[pemHeaderNonce] = hex.EncodeToString(nonce)
+
+	// Seal
+	b.Bytes = a.Seal(nil, nonce, i.Bytes, passphraseAdditionalData(b.Headers))
+	return
+}
+
+// decryptPEMBlock decrypts a pem block encrypted by encryptPEMBlock
+func decryptPEMBlock(i *pem.Block, passphrase string) (b *pem.Block, err error) {
+	// Parse options
+	var o PassphraseOptions
+	if o, err = parsePassphraseOptions(i.Headers); err != nil {
+		err = errors.Wrap(err, "parsing passphrase options failed")
+		return
+	}
+
+	// Decode salt
+	var salt []byte
+	if salt, err = hex.DecodeString(i.Headers[pemHeaderSalt]); err != nil {
+		err = errors.Wrap(err, "decoding salt failed")
+		return
+	}
+
+	// Decode nonce
+	var nonce []byte
+	if nonce, err = hex.DecodeString(i.Headers[pemHeaderNonce]); err != nil {
+		err = errors.Wrap(err, "decoding nonce failed")
+		return
+	}
+
+	// Derive key
+	var k []byte
+	if k, err = o.deriveKey(passphrase, salt); err != nil {
+		err = errors.Wrap(err, "deriving key failed")
+		return
+	}
+
+	// Create AEAD
+	var a cipher.AEAD
+	if a, err = newAEAD(o.Cipher, k); err != nil {
+		err = errors.Wrap(err, "creating AEAD failed")
+		return
+	}
+
+	// Check nonce
+	if len(nonce) != a.NonceSize() {
+		err = fmt.Errorf("nonce size %d is invalid", len(nonce))
+		return
+	}
+
+	// Open
+	b = &pem.Block{Type: i.Headers[pemHeaderInnerType]}
+	if b.Bytes, err = a.Open(nil, nonce, i.Bytes, passphraseAdditionalData(i.Headers)); err != nil {
+		err = ErrWrongPassphrase
+		return
+	}
+	return
+}
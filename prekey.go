@@ -0,0 +1,365 @@
+package asticrypt
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+// prekeyInfo is the HKDF info used when deriving keys from prekeys
+const prekeyInfo = "asticrypt prekey"
+
+// Prekey represents a public X25519 prekey
+type Prekey struct {
+	ID  string `json:"id"`
+	Key []byte `json:"key"`
+}
+
+// PrekeyBundle represents the keys a user publishes so that senders can derive a shared secret with them while they
+// are offline
+// The signed prekey is signed by the identity key, which is the long-term key of the user, and is rotated regularly.
+// Each one-time prekey is only served once: servers only send one of them when a bundle is fetched.
+type PrekeyBundle struct {
+	IdentityKey           *PublicKey `json:"identity_key"`
+	OneTimePrekeys        []Prekey   `json:"one_time_prekeys,omitempty"`
+	SignatureScheme       string     `json:"signature_scheme"`
+	SignedPrekey          Prekey     `json:"signed_prekey"`
+	SignedPrekeySignature []byte     `json:"signed_prekey_signature"`
+}
+
+// BodyPrekeyBundleFetch represents the payload sent to fetch the prekey bundle of the user owning an account
+type BodyPrekeyBundleFetch struct {
+	Account string `json:"account"`
+}
+
+// PrekeySecrets represents the private keys matching the published prekeys, indexed by prekey ID
+// It must be stored securely alongside the private key and saved each time it's updated since one-time prekeys are
+// removed once used
+type PrekeySecrets struct {
+	OneTimePrekeys map[string][]byte `json:"one_time_prekeys,omitempty"`
+	SignedPrekeys  map[string][]byte `json:"signed_prekeys,omitempty"`
+}
+
+// SignedPrekey returns the private key of a signed prekey
+// It's used as the initial ratchet key of the recipient of a PrekeyMessage
+func (s PrekeySecrets) SignedPrekey(id string) (k *EphemeralKey, err error) {
+	// Get signed prekey
+	b, ok := s.SignedPrekeys[id]
+	if !ok {
+		err = fmt.Errorf("signed prekey %s doesn't exist", id)
+		return
+	}
+
+	// Create key
+	if k, err = newEphemeralKeyFromBytes(b); err != nil {
+		err = errors.Wrap(err, "creating key failed")
+		return
+	}
+	return
+}
+
+// newPrekey generates a new prekey and stores its private key
+func newPrekey(secrets map[string][]byte) (p Prekey, err error) {
+	// Generate ID
+	if p.ID, err = NewRequestID(); err != nil {
+		err = errors.Wrap(err, "generating ID failed")
+		return
+	}
+
+	// Generate key
+	var k *EphemeralKey
+	if k, err = GenerateEphemeralKey(); err != nil {
+		err = errors.Wrap(err, "generating key failed")
+		return
+	}
+	p.Key = k.Public()
+	secrets[p.ID] = k.bytes()
+	return
+}
+
+// signedPrekeyDigest returns the digest of a signed prekey
+func signedPrekeyDigest(p Prekey) []byte {
+	var h = sha512.Sum512([]byte(fmt.Sprintf("asticrypt/prekey|%s|%x", p.ID, p.Key)))
+	return h[:]
+}
+
+// NewPrekeyBundle generates a new signed prekey and one-time prekeys, stores their private keys in the secrets and
+// returns the bundle to publish
+// Previous signed prekeys are kept in the secrets so that messages sent with them can still be decrypted
+func NewPrekeyBundle(prv *PrivateKey, s *PrekeySecrets, oneTimePrekeys int) (b PrekeyBundle, err error) {
+	// Init
+	if s.OneTimePrekeys == nil {
+		s.OneTimePrekeys = make(map[string][]byte)
+	}
+	if s.SignedPrekeys == nil {
+		s.SignedPrekeys = make(map[string][]byte)
+	}
+	b = PrekeyBundle{
+		IdentityKey:     prv.Public(),
+		SignatureScheme: prv.Public().signatureScheme(),
+	}
+
+	// Generate signed prekey
+	if b.SignedPrekey, err = newPrekey(s.SignedPrekeys); err != nil {
+		err = errors.Wrap(err, "generating signed prekey failed")
+		return
+	}
+
+	// Sign signed prekey
+	if b.SignedPrekeySignature, err = prv.sign(signedPrekeyDigest(b.SignedPrekey)); err != nil {
+		err = errors.Wrap(err, "signing signed prekey failed")
+		return
+	}
+
+	// Generate one-time prekeys
+	for idx := 0; idx < oneTimePrekeys; idx++ {
+		var p Prekey
+		if p, err = newPrekey(s.OneTimePrekeys); err != nil {
+			err = errors.Wrap(err, "generating one-time prekey failed")
+			return
+		}
+		b.OneTimePrekeys = append(b.OneTimePrekeys, p)
+	}
+	return
+}
+
+// Verify verifies the signature of the signed prekey with the identity key
+func (b PrekeyBundle) Verify() (err error) {
+	// Check identity key
+	if b.IdentityKey == nil {
+		err = errors.New("identity key is missing")
+		return
+	}
+
+	// Verify signature
+	if err = b.IdentityKey.verify(b.SignatureScheme, signedPrekeyDigest(b.SignedPrekey), b.SignedPrekeySignature); err != nil {
+		err = errors.Wrap(err, "verifying signature failed")
+		return
+	}
+	return
+}
+
+// PrekeyMessage represents the first message sent to a user based on its prekey bundle
+// It carries everything the recipient needs to derive the same shared secret once it's back online
+type PrekeyMessage struct {
+	EphemeralKey    []byte     `json:"ephemeral_key"`
+	Message         []byte     `json:"message"`
+	Nonce           []byte     `json:"nonce"`
+	OneTimePrekeyID string     `json:"one_time_prekey_id,omitempty"`
+	Recipient       []byte     `json:"recipient"`
+	Sender          *PublicKey `json:"sender"`
+	Signature       []byte     `json:"signature"`
+	SignatureScheme string     `json:"signature_scheme"`
+	SignedPrekeyID  string     `json:"signed_prekey_id"`
+}
+
+// NewPrekeyMessage encrypts a message for the owner of a prekey bundle and returns the shared secret derived with it
+// The shared secret is derived from a new ephemeral key and the signed prekey as well as the first one-time prekey if
+// any. Since identity keys may not support key agreement, identities are authenticated with signatures: the signed
+// prekey is signed by the recipient and the message is signed by the sender.
+func NewPrekeyMessage(i interface{}, prvSrc *PrivateKey, b PrekeyBundle) (m *PrekeyMessage, secret []byte, err error) {
+	// Verify bundle
+	if err = b.Verify(); err != nil {
+		err = errors.Wrap(err, "verifying bundle failed")
+		return
+	}
+
+	// Generate ephemeral key
+	var k *EphemeralKey
+	if k, err = GenerateEphemeralKey(); err != nil {
+		err = errors.Wrap(err, "generating ephemeral key failed")
+		return
+	}
+
+	// Init
+	m = &PrekeyMessage{
+		EphemeralKey:    k.Public(),
+		Recipient:       b.IdentityKey.Hash(),
+		Sender:          prvSrc.Public(),
+		SignatureScheme: prvSrc.Public().signatureScheme(),
+		SignedPrekeyID:  b.SignedPrekey.ID,
+	}
+
+	// Compute shared secrets
+	var shared []byte
+	if shared, err = k.sharedSecret(b.SignedPrekey.Key); err != nil {
+		err = errors.Wrap(err, "computing shared secret with signed prekey failed")
+		return
+	}
+	if len(b.OneTimePrekeys) > 0 {
+		var s []byte
+		if s, err = k.sharedSecret(b.OneTimePrekeys[0].Key); err != nil {
+			err = errors.Wrap(err, "computing shared secret with one-time prekey failed")
+			return
+		}
+		shared = append(shared, s...)
+		m.OneTimePrekeyID = b.OneTimePrekeys[0].ID
+	}
+
+	// Derive keys
+	var key []byte
+	if key, secret, err = m.deriveKeys(shared); err != nil {
+		err = errors.Wrap(err, "deriving keys failed")
+		return
+	}
+
+	// Marshal message
+	var msg []byte
+	if msg, err = json.Marshal(i); err != nil {
+		err = errors.Wrap(err, "marshaling message failed")
+		return
+	}
+
+	// Create AEAD
+	var a cipher.AEAD
+	if a, err = newAEAD(EncryptionModeAES256GCM, key); err != nil {
+		err = errors.Wrap(err, "creating AEAD failed")
+		return
+	}
+
+	// Generate nonce
+	m.Nonce = make([]byte, a.NonceSize())
+	if _, err = rand.Read(m.Nonce); err != nil {
+		err = errors.Wrap(err, "generating nonce failed")
+		return
+	}
+
+	// Seal
+	m.Message = a.Seal(nil, m.Nonce, msg, m.additionalData())
+
+	// Sign
+	if m.Signature, err = prvSrc.sign(m.hash()); err != nil {
+		err = errors.Wrap(err, "signing failed")
+		return
+	}
+	return
+}
+
+// deriveKeys derives the key encrypting the message and the shared secret returned to callers
+func (m PrekeyMessage) deriveKeys(shared []byte) (key, secret []byte, err error) {
+	var b = make([]byte, 2*aesKeyBits/8)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, shared, append(append([]byte{}, m.Sender.Hash()...), m.Recipient...), []byte(prekeyInfo)), b); err != nil {
+		err = errors.Wrap(err, "deriving keys failed")
+		return
+	}
+	key, secret = b[:aesKeyBits/8], b[aesKeyBits/8:]
+	return
+}
+
+// additionalData returns the data authenticated alongside the message
+func (m PrekeyMessage) additionalData() (o []byte) {
+	o = append(o, []byte(fmt.Sprintf("asticrypt/prekey|%s|%s|%s|", m.SignatureScheme, m.SignedPrekeyID, m.OneTimePrekeyID))...)
+	o = append(o, m.Sender.Hash()...)
+	o = append(o, m.Recipient...)
+	o = append(o, m.EphemeralKey...)
+	o = append(o, m.Nonce...)
+	return
+}
+
+// hash hashes the parts of the message that are signed
+func (m PrekeyMessage) hash() []byte {
+	var h = sha512.New()
+	h.Write(m.additionalData())
+	h.Write(m.Message)
+	return h.Sum(nil)
+}
+
+// Decrypt decrypts a message sent based on a prekey bundle and returns the shared secret derived with the sender
+// Callers must check that Sender is the expected sender. The one-time prekey is removed from the secrets which must
+// then be saved.
+func (m PrekeyMessage) Decrypt(o interface{}, prvSrc *PrivateKey, s *PrekeySecrets) (secret []byte, err error) {
+	// Check recipient
+	if !bytes.Equal(m.Recipient, prvSrc.Public().Hash()) {
+		err = ErrNotRecipient
+		return
+	}
+
+	// Verify signature
+	if m.Sender == nil {
+		err = errors.New("sender is missing")
+		return
+	} else if err = m.Sender.verify(m.SignatureScheme, m.hash(), m.Signature); err != nil {
+		err = errors.Wrap(err, "verifying signature failed")
+		return
+	}
+
+	// Get signed prekey
+	var k *EphemeralKey
+	if k, err = s.SignedPrekey(m.SignedPrekeyID); err != nil {
+		err = errors.Wrap(err, "getting signed prekey failed")
+		return
+	}
+
+	// Compute shared secrets
+	var shared []byte
+	if shared, err = k.sharedSecret(m.EphemeralKey); err != nil {
+		err = errors.Wrap(err, "computing shared secret with signed prekey failed")
+		return
+	}
+	if len(m.OneTimePrekeyID) > 0 {
+		// Get one-time prekey
+		// It doesn't exist anymore if the message is replayed
+		b, ok := s.OneTimePrekeys[m.OneTimePrekeyID]
+		if !ok {
+			err = fmt.Errorf("one-time prekey %s doesn't exist", m.OneTimePrekeyID)
+			return
+		}
+		if k, err = newEphemeralKeyFromBytes(b); err != nil {
+			err = errors.Wrap(err, "creating one-time prekey failed")
+			return
+		}
+
+		// Compute shared secret
+		var sh []byte
+		if sh, err = k.sharedSecret(m.EphemeralKey); err != nil {
+			err = errors.Wrap(err, "computing shared secret with one-time prekey failed")
+			return
+		}
+		shared = append(shared, sh...)
+	}
+
+	// Derive keys
+	var key []byte
+	if key, secret, err = m.deriveKeys(shared); err != nil {
+		err = errors.Wrap(err, "deriving keys failed")
+		return
+	}
+
+	// Create AEAD
+	var a cipher.AEAD
+	if a, err = newAEAD(EncryptionModeAES256GCM, key); err != nil {
+		err = errors.Wrap(err, "creating AEAD failed")
+		return
+	}
+
+	// Check nonce
+	if len(m.Nonce) != a.NonceSize() {
+		err = fmt.Errorf("nonce size %d is invalid", len(m.Nonce))
+		return
+	}
+
+	// Open
+	var msg []byte
+	if msg, err = a.Open(nil, m.Nonce, m.Message, m.additionalData()); err != nil {
+		err = errors.Wrap(err, "opening AEAD failed")
+		return
+	}
+
+	// Unmarshal message
+	if err = json.Unmarshal(msg, o); err != nil {
+		err = errors.Wrap(err, "unmarshaling message failed")
+		return
+	}
+
+	// Remove one-time prekey
+	delete(s.OneTimePrekeys, m.OneTimePrekeyID)
+	return
+}
@@ -0,0 +1,73 @@
+package asticrypt_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/asticode/go-asticrypt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrekeyMessage(t *testing.T) {
+	// Init
+	var pk1, pk2 = &asticrypt.PrivateKey{}, &asticrypt.PrivateKey{}
+	pk1.SetPassphrase("test")
+	err := pk1.UnmarshalText([]byte(prv1))
+	assert.NoError(t, err)
+	err = pk2.UnmarshalText([]byte(prv2))
+	assert.NoError(t, err)
+
+	// Bundle
+	var s asticrypt.PrekeySecrets
+	b, err := asticrypt.NewPrekeyBundle(pk1, &s, 2)
+	assert.NoError(t, err)
+	assert.Len(t, b.OneTimePrekeys, 2)
+	assert.Len(t, s.OneTimePrekeys, 2)
+	assert.Len(t, s.SignedPrekeys, 1)
+	bs, err := json.Marshal(b)
+	assert.NoError(t, err)
+	b = asticrypt.PrekeyBundle{}
+	err = json.Unmarshal(bs, &b)
+	assert.NoError(t, err)
+	assert.NoError(t, b.Verify())
+
+	// Tampering with the signed prekey is detected
+	var bt = b
+	bt.SignedPrekey.Key = b.OneTimePrekeys[0].Key
+	assert.Error(t, bt.Verify())
+	_, _, err = asticrypt.NewPrekeyMessage("test", pk2, bt)
+	assert.Error(t, err)
+
+	// With one-time prekey
+	m, secret1, err := asticrypt.NewPrekeyMessage("test", pk2, b)
+	assert.NoError(t, err)
+	assert.Equal(t, b.OneTimePrekeys[0].ID, m.OneTimePrekeyID)
+	var o string
+	secret2, err := m.Decrypt(&o, pk1, &s)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", o)
+	assert.Equal(t, secret1, secret2)
+	assert.Equal(t, pk2.Public().Hash(), m.Sender.Hash())
+	assert.Len(t, s.OneTimePrekeys, 1)
+
+	// Replayed messages are rejected since the one-time prekey has been used
+	_, err = m.Decrypt(&o, pk1, &s)
+	assert.Error(t, err)
+
+	// Without one-time prekey
+	b.OneTimePrekeys = nil
+	m, secret1, err = asticrypt.NewPrekeyMessage("test", pk2, b)
+	assert.NoError(t, err)
+	secret2, err = m.Decrypt(&o, pk1, &s)
+	assert.NoError(t, err)
+	assert.Equal(t, secret1, secret2)
+
+	// Wrong recipient
+	_, err = m.Decrypt(&o, pk2, &s)
+	assert.Equal(t, asticrypt.ErrNotRecipient, err)
+
+	// Tampering with the message is detected
+	m.SignedPrekeyID = "invalid"
+	_, err = m.Decrypt(&o, pk1, &s)
+	assert.Error(t, err)
+}
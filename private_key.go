@@ -1,8 +1,15 @@
 package asticrypt
 
 import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/subtle"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
@@ -10,20 +17,65 @@ import (
 	"github.com/pkg/errors"
 )
 
+// Key types
+const (
+	KeyTypeECDSAP256 = "ecdsa-p256"
+	KeyTypeECDSAP384 = "ecdsa-p384"
+	KeyTypeEd25519   = "ed25519"
+	KeyTypeRSA       = "rsa"
+)
+
+// Pem block types
+const (
+	pemTypeECPrivateKey  = "EC PRIVATE KEY"
+	pemTypePrivateKey    = "PRIVATE KEY"
+	pemTypeRSAPrivateKey = "RSA PRIVATE KEY"
+)
+
 // PrivateKey represents a marshalable/unmarshalable private key
 type PrivateKey struct {
-	key        *rsa.PrivateKey
-	passphrase string
-	public     *PublicKey
-	string     string
+	key               crypto.Signer
+	legacy            bool
+	passphrase        string
+	passphraseOptions PassphraseOptions
+	public            *PublicKey
+	string            string
 }
 
-// GeneratePrivateKey generates a new private key
+// GeneratePrivateKey generates a new RSA private key
 func GeneratePrivateKey(passphrase string) (p *PrivateKey, err error) {
+	return GeneratePrivateKeyWithType(KeyTypeRSA, passphrase)
+}
+
+// GeneratePrivateKeyWithType generates a new private key of a specific type
+// Ed25519 keys are used for signing and their X25519 counterparts for key wrapping
+// ECDSA keys are used for signing and their ECDH counterparts for key wrapping
+func GeneratePrivateKeyWithType(keyType, passphrase string) (p *PrivateKey, err error) {
 	// Generate key
-	var k *rsa.PrivateKey
-	if k, err = rsa.GenerateKey(rand.Reader, privateKeyBits); err != nil {
-		err = errors.Wrap(err, "generating private key failed")
+	var k crypto.Signer
+	switch keyType {
+	case KeyTypeECDSAP256:
+		if k, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			err = errors.Wrap(err, "generating ecdsa p256 private key failed")
+			return
+		}
+	case KeyTypeECDSAP384:
+		if k, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader); err != nil {
+			err = errors.Wrap(err, "generating ecdsa p384 private key failed")
+			return
+		}
+	case KeyTypeEd25519:
+		if _, k, err = ed25519.GenerateKey(rand.Reader); err != nil {
+			err = errors.Wrap(err, "generating ed25519 private key failed")
+			return
+		}
+	case KeyTypeRSA:
+		if k, err = rsa.GenerateKey(rand.Reader, privateKeyBits); err != nil {
+			err = errors.Wrap(err, "generating rsa private key failed")
+			return
+		}
+	default:
+		err = fmt.Errorf("Unknown key type %s", keyType)
 		return
 	}
 
@@ -32,11 +84,19 @@ func GeneratePrivateKey(passphrase string) (p *PrivateKey, err error) {
 		err = errors.Wrap(err, "building new private key failed")
 		return
 	}
+
+	// Set string field
+	var b []byte
+	if b, err = p.MarshalText(); err != nil {
+		err = errors.Wrap(err, "marshaling private key failed")
+		return
+	}
+	p.string = string(b)
 	return
 }
 
 // newPrivateKey builds a new private key with an optional passphrase
-func newPrivateKey(i *rsa.PrivateKey, passphrase string) (k *PrivateKey, err error) {
+func newPrivateKey(i crypto.Signer, passphrase string) (k *PrivateKey, err error) {
 	// Init private key
 	k = &PrivateKey{
 		key:        i,
@@ -48,32 +108,161 @@ func newPrivateKey(i *rsa.PrivateKey, passphrase string) (k *PrivateKey, err err
 		err = errors.Wrap(err, "creating public key failed")
 		return
 	}
+	return
+}
 
-	// Set string field
-	var b []byte
-	if b, err = k.MarshalText(); err != nil {
+// SetPassphrase sets the passphrase
+// It should be called before unmarshaling the key, use ChangePassphrase to re-encrypt an existing key
+func (p *PrivateKey) SetPassphrase(passphrase string) {
+	p.passphrase = passphrase
+}
+
+// ChangePassphrase re-encrypts the key with a new passphrase, updates its text and returns it
+// The old passphrase must match the one the key has been generated or unmarshaled with
+func (p *PrivateKey) ChangePassphrase(oldPassphrase, newPassphrase string) (o []byte, err error) {
+	// Check old passphrase
+	if subtle.ConstantTimeCompare([]byte(oldPassphrase), []byte(p.passphrase)) != 1 {
+		err = ErrWrongPassphrase
+		return
+	}
+
+	// Marshal
+	var k = *p
+	k.passphrase = newPassphrase
+	if o, err = k.MarshalText(); err != nil {
 		err = errors.Wrap(err, "marshaling private key failed")
 		return
 	}
-	k.string = string(b)
+
+	// Update
+	k.legacy = false
+	k.string = string(o)
+	*p = k
 	return
 }
 
-// SetPassphrase sets the passphrase
-func (p *PrivateKey) SetPassphrase(passphrase string) {
-	p.passphrase = passphrase
+// SetPassphraseOptions sets the options used to protect the key with its passphrase
+func (p *PrivateKey) SetPassphraseOptions(o PassphraseOptions) {
+	p.passphraseOptions = o
+}
+
+// IsLegacy returns whether the key has been unmarshaled from the legacy passphrase protection
+// which is deprecated and should be upgraded
+func (p PrivateKey) IsLegacy() bool {
+	return p.legacy
+}
+
+// Upgrade marshals the key again with the current passphrase protection and updates its text
+func (p *PrivateKey) Upgrade() (err error) {
+	var b []byte
+	if b, err = p.MarshalText(); err != nil {
+		err = errors.Wrap(err, "marshaling private key failed")
+		return
+	}
+	p.legacy = false
+	p.string = string(b)
+	return
 }
 
 // Key returns the *rsa.PrivateKey
+// It returns nil for other key types, use Signer instead
 func (p PrivateKey) Key() *rsa.PrivateKey {
+	k, _ := p.key.(*rsa.PrivateKey)
+	return k
+}
+
+// Signer returns the underlying private key which is either a *rsa.PrivateKey, an ed25519.PrivateKey or an
+// *ecdsa.PrivateKey
+func (p PrivateKey) Signer() crypto.Signer {
 	return p.key
 }
 
-// Public returns the *rsa.PublicKey
+// Public returns the public key
 func (p PrivateKey) Public() *PublicKey {
 	return p.public
 }
 
+// Type returns the key type
+func (p PrivateKey) Type() string {
+	return p.public.Type()
+}
+
+// sign signs a digest
+func (p PrivateKey) sign(digest []byte) (s []byte, err error) {
+	switch k := p.key.(type) {
+	case *ecdsa.PrivateKey:
+		if s, err = ecdsa.SignASN1(rand.Reader, k, digest); err != nil {
+			err = errors.Wrap(err, "ecdsa.SignASN1 failed")
+			return
+		}
+	case ed25519.PrivateKey:
+		s = ed25519.Sign(k, digest)
+	case *rsa.PrivateKey:
+		if s, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA512, digest); err != nil {
+			err = errors.Wrap(err, "rsa.SignPKCS1v15 failed")
+			return
+		}
+	default:
+		err = fmt.Errorf("Signing with private key %T is not supported", p.key)
+	}
+	return
+}
+
+// unwrapKey unwraps a key that has been wrapped for the public key
+func (p PrivateKey) unwrapKey(keyWrap string, wrapped []byte) (key []byte, err error) {
+	switch keyWrap {
+	case KeyWrapECDHP256HKDFSHA256, KeyWrapECDHP384HKDFSHA256:
+		// Assert key
+		k, ok := p.key.(*ecdsa.PrivateKey)
+		if !ok || ecdhKeyWrap(k.Curve) != keyWrap {
+			err = fmt.Errorf("Key wrap %s is not compatible with private key %s", keyWrap, p.Type())
+			return
+		}
+
+		// Convert key
+		var e *ecdh.PrivateKey
+		if e, err = k.ECDH(); err != nil {
+			err = errors.Wrap(err, "converting ecdsa private key to ecdh failed")
+			return
+		}
+
+		// Unwrap
+		if key, err = unwrapKeyECDH(e, wrapped); err != nil {
+			err = errors.Wrap(err, "unwrapping ecdh key failed")
+			return
+		}
+	case KeyWrapRSAOAEPSHA512:
+		// Assert key
+		k, ok := p.key.(*rsa.PrivateKey)
+		if !ok {
+			err = fmt.Errorf("Key wrap %s is not compatible with private key %T", keyWrap, p.key)
+			return
+		}
+
+		// Decrypt
+		if key, err = rsa.DecryptOAEP(sha512.New(), rand.Reader, k, wrapped, nil); err != nil {
+			err = errors.Wrap(err, "rsa.DecryptOAEP failed")
+			return
+		}
+	case KeyWrapX25519HKDFSHA256:
+		// Assert key
+		k, ok := p.key.(ed25519.PrivateKey)
+		if !ok {
+			err = fmt.Errorf("Key wrap %s is not compatible with private key %T", keyWrap, p.key)
+			return
+		}
+
+		// Unwrap
+		if key, err = unwrapKeyX25519(ed25519PrivateKeyToX25519(k), wrapped); err != nil {
+			err = errors.Wrap(err, "unwrapping x25519 key failed")
+			return
+		}
+	default:
+		err = UnsupportedAlgorithmError{Algorithm: keyWrap, Kind: "key wrap"}
+	}
+	return
+}
+
 // String allows PrivateKey to implement the Stringer interface
 func (p PrivateKey) String() string {
 	return p.string
@@ -82,15 +271,23 @@ func (p PrivateKey) String() string {
 // MarshalText allows PrivateKey to implement the TextMarshaler interface
 func (p PrivateKey) MarshalText() (o []byte, err error) {
 	// Convert it to pem
-	var block = &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(p.key),
+	var block = &pem.Block{}
+	switch k := p.key.(type) {
+	case *rsa.PrivateKey:
+		block.Type = pemTypeRSAPrivateKey
+		block.Bytes = x509.MarshalPKCS1PrivateKey(k)
+	default:
+		block.Type = pemTypePrivateKey
+		if block.Bytes, err = x509.MarshalPKCS8PrivateKey(k); err != nil {
+			err = errors.Wrap(err, "x509.MarshalPKCS8PrivateKey failed")
+			return
+		}
 	}
 
 	// Encrypt the pem
 	if len(p.passphrase) > 0 {
-		if block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, []byte(p.passphrase), x509.PEMCipherAES256); err != nil {
-			err = errors.Wrap(err, "x509.EncryptPEMBlock failed")
+		if block, err = encryptPEMBlock(block, p.passphrase, p.passphraseOptions); err != nil {
+			err = errors.Wrap(err, "encrypting pem block failed")
 			return
 		}
 	}
@@ -134,18 +331,44 @@ func (p *PrivateKey) UnmarshalText(i []byte) (err error) {
 	}
 
 	// Decrypt block
-	b = block.Bytes
-	if len(p.passphrase) > 0 {
-		if b, err = x509.DecryptPEMBlock(block, []byte(p.passphrase)); err != nil {
+	var legacy bool
+	if block.Type == pemTypeEncryptedPrivateKey {
+		// No passphrase
+		if len(p.passphrase) == 0 {
+			err = ErrWrongPassphrase
+			return
+		}
+
+		// Decrypt
+		if block, err = decryptPEMBlock(block, p.passphrase); err != nil {
+			err = errors.Wrap(err, "decrypting pem block failed")
+			return
+		}
+	} else if x509.IsEncryptedPEMBlock(block) {
+		// No passphrase
+		if legacy = true; len(p.passphrase) == 0 {
+			err = ErrWrongPassphrase
+			return
+		}
+
+		// Decrypt
+		if block.Bytes, err = x509.DecryptPEMBlock(block, []byte(p.passphrase)); err != nil {
+			if err == x509.IncorrectPasswordError {
+				err = ErrWrongPassphrase
+			}
 			err = errors.Wrap(err, "x509.DecryptPEMBlock failed")
 			return
 		}
 	}
-
 	// Parse private key
-	var rk *rsa.PrivateKey
-	if rk, err = x509.ParsePKCS1PrivateKey(b); err != nil {
-		err = errors.Wrap(err, "x509.ParsePKCS1PrivateKey failed")
+	var rk crypto.Signer
+	if rk, err = parsePrivateKeyPEMBlock(block); err != nil {
+		// The legacy protection has no integrity check therefore a wrong passphrase often results in a parsing error
+		if legacy {
+			err = errors.Wrap(ErrWrongPassphrase, err.Error())
+			return
+		}
+		err = errors.Wrap(err, "parsing private key failed")
 		return
 	}
 
@@ -155,8 +378,44 @@ func (p *PrivateKey) UnmarshalText(i []byte) (err error) {
 		err = errors.Wrap(err, "creating new private key failed")
 		return
 	}
+	k.legacy = legacy
+	k.passphraseOptions = p.passphraseOptions
+
 	// We need to assign the string field since marshaling generates a different result each time it's called
 	k.string = string(i)
 	*p = *k
 	return
 }
+
+// parsePrivateKeyPEMBlock parses a private key based on its pem block type
+func parsePrivateKeyPEMBlock(block *pem.Block) (k crypto.Signer, err error) {
+	switch block.Type {
+	case pemTypeECPrivateKey:
+		if k, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			err = errors.Wrap(err, "x509.ParseECPrivateKey failed")
+			return
+		}
+	case pemTypePrivateKey:
+		// Parse
+		var i interface{}
+		if i, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+			err = errors.Wrap(err, "x509.ParsePKCS8PrivateKey failed")
+			return
+		}
+
+		// Assert
+		var ok bool
+		if k, ok = i.(crypto.Signer); !ok {
+			err = fmt.Errorf("Private key %T is not supported", i)
+			return
+		}
+	case pemTypeRSAPrivateKey:
+		if k, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			err = errors.Wrap(err, "x509.ParsePKCS1PrivateKey failed")
+			return
+		}
+	default:
+		err = fmt.Errorf("Pem block type %s is not supported", block.Type)
+	}
+	return
+}
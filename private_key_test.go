@@ -1,9 +1,16 @@
 package asticrypt_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"testing"
 
 	"github.com/asticode/go-asticrypt"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -14,4 +21,151 @@ func TestPrivateKey(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, prv1, k.String())
 	assert.Equal(t, pub1, k.Public().String())
+	assert.True(t, k.IsLegacy())
+	assert.NotNil(t, k.Key())
+	assert.Equal(t, &k.Key().PublicKey, k.Public().Key())
+
+	// Wrong passphrase
+	var w = &asticrypt.PrivateKey{}
+	w.SetPassphrase("wrong")
+	err = w.UnmarshalText([]byte(prv1))
+	assert.Equal(t, asticrypt.ErrWrongPassphrase, errors.Cause(err))
+	w.SetPassphrase("")
+	err = w.UnmarshalText([]byte(prv1))
+	assert.Equal(t, asticrypt.ErrWrongPassphrase, errors.Cause(err))
+
+	// Upgrade
+	for _, o := range []asticrypt.PassphraseOptions{
+		{Argon2Memory: 1024, Argon2Time: 1},
+		{Cipher: asticrypt.EncryptionModeXChaCha20Poly1305, KDF: asticrypt.KDFScrypt, ScryptN: 1024},
+	} {
+		k.SetPassphraseOptions(o)
+		err = k.Upgrade()
+		assert.NoError(t, err)
+		assert.False(t, k.IsLegacy())
+		assert.NotEqual(t, prv1, k.String())
+		var u = &asticrypt.PrivateKey{}
+		u.SetPassphrase("test")
+		err = u.UnmarshalText([]byte(k.String()))
+		assert.NoError(t, err)
+		assert.False(t, u.IsLegacy())
+		assert.Equal(t, pub1, u.Public().String())
+		u.SetPassphrase("wrong")
+		err = u.UnmarshalText([]byte(k.String()))
+		assert.Equal(t, asticrypt.ErrWrongPassphrase, errors.Cause(err))
+	}
+}
+
+func TestPrivateKeyKDFParams(t *testing.T) {
+	for kdf, c := range map[string]struct {
+		o         asticrypt.PassphraseOptions
+		invalid   []string
+		oversized []string
+	}{
+		asticrypt.KDFArgon2id: {
+			o:         asticrypt.PassphraseOptions{Argon2Memory: 1024, Argon2Threads: 1, Argon2Time: 1},
+			invalid:   []string{"m=1024,p=1", "t=1,p=1", "t=1,m=1024", "m=1024", "t=1,m=1024,p=1,x=1", "t=1,m=1024,p=1,p=1", "t=0,m=1024,p=1"},
+			oversized: []string{"t=1,m=4194304,p=1", "t=100,m=1024,p=1", "t=1,m=1024,p=255"},
+		},
+		asticrypt.KDFScrypt: {
+			o:         asticrypt.PassphraseOptions{KDF: asticrypt.KDFScrypt, ScryptN: 1024, ScryptP: 1, ScryptR: 8},
+			invalid:   []string{"r=8,p=1", "n=1024,p=1", "n=1024,r=8", "n=1000,r=8,p=1", "n=1,r=8,p=1", "n=1024,r=8,p=1,t=1"},
+			oversized: []string{"n=4194304,r=1000000,p=1", "n=1024,r=8,p=1000000", "n=1048576,r=8,p=1"},
+		},
+	} {
+		// Generate key
+		k, err := asticrypt.GeneratePrivateKeyWithType(asticrypt.KeyTypeEd25519, "test")
+		assert.NoError(t, err)
+		k.SetPassphraseOptions(c.o)
+		o, err := k.ChangePassphrase("test", "test")
+		assert.NoError(t, err)
+		b, err := base64.StdEncoding.DecodeString(string(o))
+		assert.NoError(t, err)
+		block, _ := pem.Decode(b)
+		assert.NotNil(t, block)
+
+		// Malformed params must return an error instead of making the KDF panic
+		for _, p := range c.invalid {
+			block.Headers["KDF-Params"] = p
+			var u = &asticrypt.PrivateKey{}
+			u.SetPassphrase("test")
+			err = u.UnmarshalText([]byte(base64.StdEncoding.EncodeToString(pem.EncodeToMemory(block))))
+			assert.Error(t, err, "%s: %s", kdf, p)
+		}
+
+		// Oversized params must be rejected before the KDF is called
+		for _, p := range c.oversized {
+			block.Headers["KDF-Params"] = p
+			var u = &asticrypt.PrivateKey{}
+			u.SetPassphrase("test")
+			err = u.UnmarshalText([]byte(base64.StdEncoding.EncodeToString(pem.EncodeToMemory(block))))
+			if assert.Error(t, err, "%s: %s", kdf, p) {
+				assert.Contains(t, err.Error(), "out of bounds", "%s: %s", kdf, p)
+			}
+		}
+	}
+
+	// Keys can't be protected with oversized params either
+	k, err := asticrypt.GeneratePrivateKeyWithType(asticrypt.KeyTypeEd25519, "test")
+	assert.NoError(t, err)
+	k.SetPassphraseOptions(asticrypt.PassphraseOptions{Argon2Memory: 1024 * 1024})
+	_, err = k.ChangePassphrase("test", "test")
+	assert.Error(t, err)
+}
+
+func TestPrivateKeyEd25519(t *testing.T) {
+	k, err := asticrypt.GeneratePrivateKeyWithType(asticrypt.KeyTypeEd25519, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, asticrypt.KeyTypeEd25519, k.Type())
+	var u = &asticrypt.PrivateKey{}
+	u.SetPassphrase("test")
+	err = u.UnmarshalText([]byte(k.String()))
+	assert.NoError(t, err)
+	assert.Equal(t, k.Signer(), u.Signer())
+	assert.Equal(t, k.Public().String(), u.Public().String())
+	assert.Equal(t, k.Public().Hash(), u.Public().Hash())
+
+	// RSA accessors return nil for other key types
+	assert.Nil(t, k.Key())
+	assert.Nil(t, k.Public().Key())
+	assert.NotNil(t, k.Public().CryptoPublicKey())
+}
+
+func TestPrivateKeyECDSA(t *testing.T) {
+	for _, kt := range []string{asticrypt.KeyTypeECDSAP256, asticrypt.KeyTypeECDSAP384} {
+		k, err := asticrypt.GeneratePrivateKeyWithType(kt, "")
+		assert.NoError(t, err)
+		assert.Equal(t, kt, k.Type())
+		var u = &asticrypt.PrivateKey{}
+		err = u.UnmarshalText([]byte(k.String()))
+		assert.NoError(t, err)
+		assert.Equal(t, kt, u.Type())
+		assert.Equal(t, k.Public().String(), u.Public().String())
+	}
+
+	// SEC 1 keys are detected
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	b, err := x509.MarshalECPrivateKey(k)
+	assert.NoError(t, err)
+	var u = &asticrypt.PrivateKey{}
+	err = u.UnmarshalText([]byte(base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}))))
+	assert.NoError(t, err)
+	assert.Equal(t, asticrypt.KeyTypeECDSAP256, u.Type())
+}
+
+func TestPrivateKeyChangePassphrase(t *testing.T) {
+	k, err := asticrypt.GeneratePrivateKeyWithType(asticrypt.KeyTypeEd25519, "old")
+	assert.NoError(t, err)
+	k.SetPassphraseOptions(asticrypt.PassphraseOptions{Argon2Memory: 1024, Argon2Time: 1})
+	_, err = k.ChangePassphrase("wrong", "new")
+	assert.Equal(t, asticrypt.ErrWrongPassphrase, err)
+	b, err := k.ChangePassphrase("old", "new")
+	assert.NoError(t, err)
+	assert.Equal(t, string(b), k.String())
+	var u = &asticrypt.PrivateKey{}
+	u.SetPassphrase("new")
+	err = u.UnmarshalText(b)
+	assert.NoError(t, err)
+	assert.Equal(t, k.Public().String(), u.Public().String())
 }
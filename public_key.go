@@ -1,8 +1,16 @@
 package asticrypt
 
 import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/x509"
 	"fmt"
 
@@ -11,20 +19,36 @@ import (
 
 // PublicKey represents a marshalable/unmarshalable public key
 type PublicKey struct {
-	hash   []byte
-	key    *rsa.PublicKey
-	string string
+	fingerprint []byte
+	hash        []byte
+	key         crypto.PublicKey
+	keyType     string
+	string      string
 }
 
-// newPublicKey creates a new PublicKey based on a *rsa.PublicKey
+// newPublicKey creates a new PublicKey based on a *rsa.PublicKey, an ed25519.PublicKey or an *ecdsa.PublicKey
 func newPublicKey(i interface{}) (k *PublicKey, err error) {
 	// Init
-	k = &PublicKey{}
+	k = &PublicKey{key: i}
 
-	// Assert key
-	var ok bool
-	if k.key, ok = i.(*rsa.PublicKey); !ok {
-		err = fmt.Errorf("Public key %s is not a *rsa.PublicKey", i)
+	// Switch on key
+	switch v := i.(type) {
+	case *ecdsa.PublicKey:
+		switch v.Curve {
+		case elliptic.P256():
+			k.keyType = KeyTypeECDSAP256
+		case elliptic.P384():
+			k.keyType = KeyTypeECDSAP384
+		default:
+			err = fmt.Errorf("Curve %s is not supported", v.Curve.Params().Name)
+			return
+		}
+	case ed25519.PublicKey:
+		k.keyType = KeyTypeEd25519
+	case *rsa.PublicKey:
+		k.keyType = KeyTypeRSA
+	default:
+		err = fmt.Errorf("Public key %T is not supported", i)
 		return
 	}
 
@@ -40,6 +64,15 @@ func newPublicKey(i interface{}) (k *PublicKey, err error) {
 	var h = sha1.New()
 	h.Write(b)
 	k.hash = h.Sum(nil)
+
+	// Set fingerprint field
+	var der []byte
+	if der, err = x509.MarshalPKIXPublicKey(k.key); err != nil {
+		err = errors.Wrap(err, "x509.MarshalPKIXPublicKey failed")
+		return
+	}
+	var f = sha256.Sum256(der)
+	k.fingerprint = f[:]
 	return
 }
 
@@ -48,11 +81,116 @@ func (p PublicKey) Hash() []byte {
 	return p.hash
 }
 
+// Fingerprint returns the SHA-256 of the DER encoded SubjectPublicKeyInfo
+func (p PublicKey) Fingerprint() []byte {
+	return p.fingerprint
+}
+
 // Key returns the *rsa.PublicKey
+// It returns nil for other key types, use CryptoPublicKey instead
 func (p PublicKey) Key() *rsa.PublicKey {
+	k, _ := p.key.(*rsa.PublicKey)
+	return k
+}
+
+// CryptoPublicKey returns the underlying public key which is either a *rsa.PublicKey, an ed25519.PublicKey or an
+// *ecdsa.PublicKey
+func (p PublicKey) CryptoPublicKey() crypto.PublicKey {
 	return p.key
 }
 
+// Type returns the key type
+func (p PublicKey) Type() string {
+	return p.keyType
+}
+
+// signatureScheme returns the signature scheme used by the key
+func (p PublicKey) signatureScheme() string {
+	switch p.keyType {
+	case KeyTypeECDSAP256:
+		return SignatureSchemeECDSAP256SHA512
+	case KeyTypeECDSAP384:
+		return SignatureSchemeECDSAP384SHA512
+	case KeyTypeEd25519:
+		return SignatureSchemeEd25519
+	}
+	return SignatureSchemeRSAPKCS1v15SHA512
+}
+
+// verify verifies the signature of a digest
+// An empty signature scheme is considered as RSA since it's what was used before schemes were introduced
+func (p PublicKey) verify(signatureScheme string, digest, signature []byte) (err error) {
+	// Check signature scheme
+	if len(signatureScheme) == 0 {
+		signatureScheme = SignatureSchemeRSAPKCS1v15SHA512
+	}
+	if signatureScheme != p.signatureScheme() {
+		err = fmt.Errorf("Signature scheme %s is not compatible with public key %s", signatureScheme, p.keyType)
+		return
+	}
+
+	// Switch on key
+	switch k := p.key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest, signature) {
+			err = errors.New("ecdsa.VerifyASN1 failed")
+			return
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, digest, signature) {
+			err = errors.New("ed25519.Verify failed")
+			return
+		}
+	case *rsa.PublicKey:
+		if err = rsa.VerifyPKCS1v15(k, crypto.SHA512, digest, signature); err != nil {
+			err = errors.Wrap(err, "rsa.VerifyPKCS1v15 failed")
+			return
+		}
+	}
+	return
+}
+
+// wrapKey wraps a key so that only the private key can unwrap it
+func (p PublicKey) wrapKey(key []byte) (wrapped []byte, keyWrap string, err error) {
+	switch k := p.key.(type) {
+	case *ecdsa.PublicKey:
+		// Convert key
+		keyWrap = ecdhKeyWrap(k.Curve)
+		var e *ecdh.PublicKey
+		if e, err = k.ECDH(); err != nil {
+			err = errors.Wrap(err, "converting ecdsa public key to ecdh failed")
+			return
+		}
+
+		// Wrap
+		if wrapped, err = wrapKeyECDH(e, key); err != nil {
+			err = errors.Wrap(err, "wrapping ecdh key failed")
+			return
+		}
+	case ed25519.PublicKey:
+		// Convert key
+		keyWrap = KeyWrapX25519HKDFSHA256
+		var x []byte
+		if x, err = ed25519PublicKeyToX25519(k); err != nil {
+			err = errors.Wrap(err, "converting ed25519 public key to x25519 failed")
+			return
+		}
+
+		// Wrap
+		if wrapped, err = wrapKeyX25519(x, key); err != nil {
+			err = errors.Wrap(err, "wrapping x25519 key failed")
+			return
+		}
+	case *rsa.PublicKey:
+		keyWrap = KeyWrapRSAOAEPSHA512
+		if wrapped, err = rsa.EncryptOAEP(sha512.New(), rand.Reader, k, key, nil); err != nil {
+			err = errors.Wrap(err, "rsa.EncryptOAEP failed")
+			return
+		}
+	}
+	return
+}
+
 // String allows PublicKey to implement the Stringer interface
 func (p PublicKey) String() string {
 	return p.string
@@ -14,3 +14,14 @@ func TestPublicKey(t *testing.T) {
 	assert.Equal(t, pub1, k.String())
 	assert.Equal(t, []byte{0xc7, 0x40, 0xf5, 0x48, 0xbf, 0x53, 0x13, 0x32, 0x85, 0xf0, 0x5a, 0xec, 0xb7, 0x35, 0xd1, 0xe9, 0xe6, 0x81, 0x8, 0xe}, k.Hash())
 }
+
+func TestPublicKeyEd25519(t *testing.T) {
+	pk, err := asticrypt.GeneratePrivateKeyWithType(asticrypt.KeyTypeEd25519, "")
+	assert.NoError(t, err)
+	var k = &asticrypt.PublicKey{}
+	err = k.Scan([]byte(pk.Public().String()))
+	assert.NoError(t, err)
+	assert.Equal(t, asticrypt.KeyTypeEd25519, k.Type())
+	assert.Equal(t, pk.Public().Key(), k.Key())
+	assert.Equal(t, pk.Public().Hash(), k.Hash())
+}
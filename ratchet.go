@@ -0,0 +1,394 @@
+package asticrypt
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Ratchet skip limits
+// They prevent a malicious sender from making the recipient compute and store a huge number of keys
+const (
+	// Maximum number of message keys that can be skipped in a receiving chain at once
+	ratchetMaxSkip = 1000
+	// Maximum number of skipped message keys stored across all receiving chains, the oldest ones are evicted first
+	ratchetMaxSkipped = 2000
+)
+
+// Ratchet HKDF infos
+const (
+	ratchetInfoMessage = "asticrypt ratchet message"
+	ratchetInfoRoot    = "asticrypt ratchet root"
+)
+
+// Ratchet chain KDF constants
+var (
+	ratchetChainKeyConstant   = []byte{0x02}
+	ratchetMessageKeyConstant = []byte{0x01}
+)
+
+// Ratchet represents a double ratchet session between two peers
+// Each message is encrypted with a new key derived from a symmetric chain which provides forward secrecy, and chains
+// are renewed with a new X25519 key agreement each time the peers take turns which provides post-compromise
+// security.
+// It can be marshaled to JSON to be stored locally and must be saved after each call. It's not safe for concurrent
+// use.
+type Ratchet struct {
+	ChainKeyReceiving []byte `json:"chain_key_receiving,omitempty"`
+	ChainKeySending   []byte `json:"chain_key_sending,omitempty"`
+	// Ratchet public key of the peer
+	KeyReceiving []byte `json:"key_receiving,omitempty"`
+	// Own ratchet private key
+	KeySending            []byte `json:"key_sending"`
+	NumberReceiving       uint32 `json:"number_receiving"`
+	NumberSending         uint32 `json:"number_sending"`
+	PreviousNumberSending uint32 `json:"previous_number_sending"`
+	RootKey               []byte `json:"root_key"`
+	// Message keys that have been skipped when receiving messages out of order, indexed by ratchet public key and
+	// message number
+	Skipped map[string][]byte `json:"skipped,omitempty"`
+	// Indexes of the skipped message keys from the oldest to the newest
+	SkippedOrder []string `json:"skipped_order,omitempty"`
+}
+
+// NewRatchetInitiator creates the ratchet of the peer sending the first message
+// The secret is usually the one returned by NewPrekeyMessage and the key the signed prekey of the bundle it was
+// created with.
+func NewRatchetInitiator(secret, key []byte) (r *Ratchet, err error) {
+	// Generate ratchet key
+	var k *EphemeralKey
+	if k, err = GenerateEphemeralKey(); err != nil {
+		err = errors.Wrap(err, "generating ratchet key failed")
+		return
+	}
+
+	// Init
+	r = &Ratchet{
+		KeyReceiving: key,
+		KeySending:   k.bytes(),
+	}
+
+	// Derive sending chain
+	if r.RootKey, r.ChainKeySending, err = ratchetRootKDF(secret, k, key); err != nil {
+		err = errors.Wrap(err, "deriving sending chain failed")
+		return
+	}
+	return
+}
+
+// NewRatchetResponder creates the ratchet of the peer receiving the first message
+// The secret is usually the one returned by PrekeyMessage.Decrypt and the key the matching signed prekey. The
+// responder can't send messages until it has received the first one.
+func NewRatchetResponder(secret []byte, key *EphemeralKey) *Ratchet {
+	return &Ratchet{
+		KeySending: key.bytes(),
+		RootKey:    secret,
+	}
+}
+
+// ratchetRootKDF derives a new root key and chain key from the key agreement between a ratchet key and a peer
+// ratchet public key
+func ratchetRootKDF(rootKey []byte, k *EphemeralKey, peer []byte) (newRootKey, chainKey []byte, err error) {
+	// Compute shared secret
+	var shared []byte
+	if shared, err = k.sharedSecret(peer); err != nil {
+		err = errors.Wrap(err, "computing shared secret failed")
+		return
+	}
+
+	// Derive keys
+	var b = make([]byte, 2*aesKeyBits/8)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, shared, rootKey, []byte(ratchetInfoRoot)), b); err != nil {
+		err = errors.Wrap(err, "deriving keys failed")
+		return
+	}
+	newRootKey, chainKey = b[:aesKeyBits/8], b[aesKeyBits/8:]
+	return
+}
+
+// ratchetChainKDF returns the message key of a chain key and the next chain key
+func ratchetChainKDF(chainKey []byte) (messageKey, nextChainKey []byte) {
+	return hmacSHA256(chainKey, ratchetMessageKeyConstant), hmacSHA256(chainKey, ratchetChainKeyConstant)
+}
+
+// ratchetAEAD derives the AEAD and nonce of a message key
+// Message keys are only used once which allows deriving the nonce
+func ratchetAEAD(messageKey []byte) (a cipher.AEAD, nonce []byte, err error) {
+	// Derive key and nonce
+	var b = make([]byte, aesKeyBits/8+12)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, messageKey, nil, []byte(ratchetInfoMessage)), b); err != nil {
+		err = errors.Wrap(err, "deriving key and nonce failed")
+		return
+	}
+
+	// Create AEAD
+	if a, err = newAEAD(EncryptionModeAES256GCM, b[:aesKeyBits/8]); err != nil {
+		err = errors.Wrap(err, "creating AEAD failed")
+		return
+	}
+	nonce = b[aesKeyBits/8:]
+	return
+}
+
+// RatchetHeader represents the plain header of a ratchet message
+type RatchetHeader struct {
+	Key            []byte `json:"key"`
+	Number         uint32 `json:"number"`
+	PreviousNumber uint32 `json:"previous_number"`
+}
+
+// bytes returns the header bytes authenticated alongside the message
+func (h RatchetHeader) bytes() (o []byte) {
+	o = append(o, h.Key...)
+	o = binary.BigEndian.AppendUint32(o, h.Number)
+	o = binary.BigEndian.AppendUint32(o, h.PreviousNumber)
+	return
+}
+
+// RatchetMessage represents a message encrypted with a ratchet
+type RatchetMessage struct {
+	Header  RatchetHeader `json:"header"`
+	Message []byte        `json:"message"`
+}
+
+// Encrypt encrypts the next message
+// The associated data is authenticated alongside the message, it usually contains the hashes of both peers' keys.
+func (r *Ratchet) Encrypt(i interface{}, ad []byte) (m *RatchetMessage, err error) {
+	// Check sending chain
+	if r.ChainKeySending == nil {
+		err = errors.New("sending chain doesn't exist, a message must be received first")
+		return
+	}
+
+	// Get ratchet key
+	var k *EphemeralKey
+	if k, err = newEphemeralKeyFromBytes(r.KeySending); err != nil {
+		err = errors.Wrap(err, "creating ratchet key failed")
+		return
+	}
+
+	// Marshal message
+	var msg []byte
+	if msg, err = json.Marshal(i); err != nil {
+		err = errors.Wrap(err, "marshaling message failed")
+		return
+	}
+
+	// Ratchet sending chain
+	var mk []byte
+	mk, r.ChainKeySending = ratchetChainKDF(r.ChainKeySending)
+	m = &RatchetMessage{Header: RatchetHeader{
+		Key:            k.Public(),
+		Number:         r.NumberSending,
+		PreviousNumber: r.PreviousNumberSending,
+	}}
+	r.NumberSending++
+
+	// Create AEAD
+	var a cipher.AEAD
+	var nonce []byte
+	if a, nonce, err = ratchetAEAD(mk); err != nil {
+		err = errors.Wrap(err, "creating AEAD failed")
+		return
+	}
+
+	// Seal
+	m.Message = a.Seal(nil, nonce, msg, append(append([]byte{}, ad...), m.Header.bytes()...))
+	return
+}
+
+// Decrypt decrypts a message
+// The ratchet is only updated if the message is decrypted successfully so that forged messages can't corrupt it.
+func (r *Ratchet) Decrypt(m *RatchetMessage, o interface{}, ad []byte) (err error) {
+	// Work on a copy
+	var c = r.clone()
+
+	// Get message key
+	var mk []byte
+	if mk, err = c.messageKey(m.Header); err != nil {
+		err = errors.Wrap(err, "getting message key failed")
+		return
+	}
+
+	// Create AEAD
+	var a cipher.AEAD
+	var nonce []byte
+	if a, nonce, err = ratchetAEAD(mk); err != nil {
+		err = errors.Wrap(err, "creating AEAD failed")
+		return
+	}
+
+	// Open
+	var msg []byte
+	if msg, err = a.Open(nil, nonce, m.Message, append(append([]byte{}, ad...), m.Header.bytes()...)); err != nil {
+		err = errors.Wrap(err, "opening AEAD failed")
+		return
+	}
+
+	// Unmarshal message
+	if err = json.Unmarshal(msg, o); err != nil {
+		err = errors.Wrap(err, "unmarshaling message failed")
+		return
+	}
+
+	// Update ratchet
+	*r = *c
+	return
+}
+
+// clone returns a deep copy of the ratchet
+func (r *Ratchet) clone() *Ratchet {
+	var c = *r
+	c.Skipped = make(map[string][]byte, len(r.Skipped))
+	for k, v := range r.Skipped {
+		c.Skipped[k] = v
+	}
+	c.SkippedOrder = append([]string{}, r.SkippedOrder...)
+
+	// Rebuild the order if it doesn't match the skipped message keys
+	if len(c.SkippedOrder) != len(c.Skipped) {
+		c.SkippedOrder = c.SkippedOrder[:0]
+		for k := range c.Skipped {
+			c.SkippedOrder = append(c.SkippedOrder, k)
+		}
+		sort.Strings(c.SkippedOrder)
+	}
+	return &c
+}
+
+// skippedKey returns the index of a skipped message key
+func skippedKey(key []byte, number uint32) string {
+	return fmt.Sprintf("%s:%d", hex.EncodeToString(key), number)
+}
+
+// messageKey returns the message key of a header, performing a key agreement ratchet step if the peer has a new
+// ratchet key
+func (r *Ratchet) messageKey(h RatchetHeader) (mk []byte, err error) {
+	// Message key has been skipped
+	var ok bool
+	if mk, ok = r.Skipped[skippedKey(h.Key, h.Number)]; ok {
+		r.deleteSkipped(skippedKey(h.Key, h.Number))
+		return
+	}
+
+	// Peer has a new ratchet key
+	if !bytes.Equal(h.Key, r.KeyReceiving) {
+		// Skip the remaining message keys of the current receiving chain
+		if err = r.skip(h.PreviousNumber); err != nil {
+			err = errors.Wrap(err, "skipping message keys failed")
+			return
+		}
+
+		// Ratchet
+		if err = r.ratchet(h.Key); err != nil {
+			err = errors.Wrap(err, "ratcheting failed")
+			return
+		}
+	}
+
+	// Skip message keys
+	if err = r.skip(h.Number); err != nil {
+		err = errors.Wrap(err, "skipping message keys failed")
+		return
+	}
+
+	// Ratchet receiving chain
+	mk, r.ChainKeyReceiving = ratchetChainKDF(r.ChainKeyReceiving)
+	r.NumberReceiving++
+	return
+}
+
+// skip stores the message keys of the receiving chain until a message number
+func (r *Ratchet) skip(until uint32) (err error) {
+	// No receiving chain
+	if r.ChainKeyReceiving == nil {
+		return
+	}
+
+	// Message has already been received
+	if until < r.NumberReceiving {
+		err = fmt.Errorf("message %d has already been received", until)
+		return
+	}
+
+	// Check skip
+	if until-r.NumberReceiving > ratchetMaxSkip {
+		err = fmt.Errorf("skipping %d message keys is not allowed", until-r.NumberReceiving)
+		return
+	}
+
+	// Store message keys
+	for r.NumberReceiving < until {
+		var mk []byte
+		mk, r.ChainKeyReceiving = ratchetChainKDF(r.ChainKeyReceiving)
+		r.storeSkipped(skippedKey(r.KeyReceiving, r.NumberReceiving), mk)
+		r.NumberReceiving++
+	}
+	return
+}
+
+// storeSkipped stores a skipped message key and evicts the oldest ones if there are too many
+func (r *Ratchet) storeSkipped(key string, mk []byte) {
+	r.Skipped[key] = mk
+	r.SkippedOrder = append(r.SkippedOrder, key)
+	for len(r.SkippedOrder) > ratchetMaxSkipped {
+		delete(r.Skipped, r.SkippedOrder[0])
+		r.SkippedOrder = r.SkippedOrder[1:]
+	}
+}
+
+// deleteSkipped deletes a skipped message key once it has been used
+func (r *Ratchet) deleteSkipped(key string) {
+	delete(r.Skipped, key)
+	for idx, v := range r.SkippedOrder {
+		if v == key {
+			r.SkippedOrder = append(r.SkippedOrder[:idx], r.SkippedOrder[idx+1:]...)
+			break
+		}
+	}
+}
+
+// ratchet performs a key agreement ratchet step with a new peer ratchet public key
+func (r *Ratchet) ratchet(key []byte) (err error) {
+	// Get ratchet key
+	var k *EphemeralKey
+	if k, err = newEphemeralKeyFromBytes(r.KeySending); err != nil {
+		err = errors.Wrap(err, "creating ratchet key failed")
+		return
+	}
+
+	// Update state
+	r.PreviousNumberSending = r.NumberSending
+	r.NumberSending = 0
+	r.NumberReceiving = 0
+	r.KeyReceiving = key
+
+	// Derive receiving chain
+	if r.RootKey, r.ChainKeyReceiving, err = ratchetRootKDF(r.RootKey, k, key); err != nil {
+		err = errors.Wrap(err, "deriving receiving chain failed")
+		return
+	}
+
+	// Generate ratchet key
+	if k, err = GenerateEphemeralKey(); err != nil {
+		err = errors.Wrap(err, "generating ratchet key failed")
+		return
+	}
+	r.KeySending = k.bytes()
+
+	// Derive sending chain
+	if r.RootKey, r.ChainKeySending, err = ratchetRootKDF(r.RootKey, k, key); err != nil {
+		err = errors.Wrap(err, "deriving sending chain failed")
+		return
+	}
+	return
+}
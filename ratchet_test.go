@@ -0,0 +1,270 @@
+package asticrypt_test
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/asticode/go-asticrypt"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	assert.NoError(t, err)
+	return b
+}
+
+// testHKDF derives n bytes with HKDF-SHA256
+func testHKDF(t *testing.T, secret, salt []byte, info string, n int) []byte {
+	var b = make([]byte, n)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), b)
+	assert.NoError(t, err)
+	return b
+}
+
+// testHMAC computes an HMAC-SHA256
+func testHMAC(key []byte, data byte) []byte {
+	var h = hmac.New(sha256.New, key)
+	h.Write([]byte{data})
+	return h.Sum(nil)
+}
+
+// Ratchet keys are the X25519 keys of RFC 7748 section 6.1 and expected values are derived from them in the test with
+// the standard library, following the ratchet KDFs, rather than with the ratchet itself:
+//   - root KDF: HKDF-SHA256 of the shared secret salted with the root key, info "asticrypt ratchet root", which
+//     outputs the new root key and the chain key
+//   - chain KDF: HMAC-SHA256 of the chain key with 0x01 for the message key and 0x02 for the next chain key
+//   - message keys: HKDF-SHA256 of the message key, info "asticrypt ratchet message", which outputs an AES-256-GCM
+//     key and nonce
+func TestRatchetVectors(t *testing.T) {
+	// Init
+	var secret = make([]byte, 32)
+	for idx := range secret {
+		secret[idx] = byte(idx)
+	}
+	var alicePrv = mustDecodeHex(t, "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a")
+	var alicePub = mustDecodeHex(t, "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a")
+	var bobPrv = mustDecodeHex(t, "5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb")
+	var bobPub = mustDecodeHex(t, "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f")
+	var ad = []byte("ad")
+
+	// Shared secret of RFC 7748 section 6.1
+	shared, err := curve25519.X25519(alicePrv, bobPub)
+	assert.NoError(t, err)
+	assert.Equal(t, mustDecodeHex(t, "4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742"), shared)
+
+	// Expected keys
+	var rk = testHKDF(t, shared, secret, "asticrypt ratchet root", 64)
+	var rootKey, ck0 = rk[:32], rk[32:]
+	var mk0, ck1 = testHMAC(ck0, 0x01), testHMAC(ck0, 0x02)
+	var mk1, ck2 = testHMAC(ck1, 0x01), testHMAC(ck1, 0x02)
+
+	// Initiator state once the root key has been derived from the secret and the shared secret
+	var a = &asticrypt.Ratchet{
+		ChainKeySending: ck0,
+		KeyReceiving:    bobPub,
+		KeySending:      alicePrv,
+		RootKey:         rootKey,
+	}
+
+	// Encrypt
+	m0, err := a.Encrypt("hello", ad)
+	assert.NoError(t, err)
+	assert.Equal(t, asticrypt.RatchetHeader{Key: alicePub}, m0.Header)
+	assert.Equal(t, ck1, a.ChainKeySending)
+	m1, err := a.Encrypt("world", ad)
+	assert.NoError(t, err)
+	assert.Equal(t, asticrypt.RatchetHeader{Key: alicePub, Number: 1}, m1.Header)
+	assert.Equal(t, ck2, a.ChainKeySending)
+
+	// Messages can be opened with the expected message keys
+	// The additional data is followed by the ratchet public key, the message number and the previous chain length
+	for _, v := range []struct {
+		ad  string
+		key []byte
+		m   *asticrypt.RatchetMessage
+		msg string
+	}{
+		{
+			ad:  "6164" + hex.EncodeToString(alicePub) + "0000000000000000",
+			key: mk0,
+			m:   m0,
+			msg: "\"hello\"",
+		},
+		{
+			ad:  "6164" + hex.EncodeToString(alicePub) + "0000000100000000",
+			key: mk1,
+			m:   m1,
+			msg: "\"world\"",
+		},
+	} {
+		var kn = testHKDF(t, v.key, nil, "asticrypt ratchet message", 44)
+		c, err := aes.NewCipher(kn[:32])
+		assert.NoError(t, err)
+		g, err := cipher.NewGCM(c)
+		assert.NoError(t, err)
+		b, err := g.Open(nil, kn[32:], v.m.Message, mustDecodeHex(t, v.ad))
+		assert.NoError(t, err)
+		assert.Equal(t, v.msg, string(b))
+	}
+
+	// Responder
+	k, err := asticrypt.PrekeySecrets{SignedPrekeys: map[string][]byte{"id": bobPrv}}.SignedPrekey("id")
+	assert.NoError(t, err)
+	var b = asticrypt.NewRatchetResponder(secret, k)
+	_, err = b.Encrypt("test", ad)
+	assert.Error(t, err)
+	var o string
+	err = b.Decrypt(m1, &o, ad)
+	assert.NoError(t, err)
+	assert.Equal(t, "world", o)
+	assert.Equal(t, ck2, b.ChainKeyReceiving)
+	assert.Len(t, b.Skipped, 1)
+	err = b.Decrypt(m0, &o, ad)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", o)
+	assert.Len(t, b.Skipped, 0)
+}
+
+// newTestRatchets creates the ratchets of two peers agreeing on a secret with a prekey bundle
+func newTestRatchets(t *testing.T) (a, b *asticrypt.Ratchet, ad []byte) {
+	// Init
+	var pk1, pk2 = &asticrypt.PrivateKey{}, &asticrypt.PrivateKey{}
+	pk1.SetPassphrase("test")
+	err := pk1.UnmarshalText([]byte(prv1))
+	assert.NoError(t, err)
+	err = pk2.UnmarshalText([]byte(prv2))
+	assert.NoError(t, err)
+	ad = append(append([]byte{}, pk2.Public().Hash()...), pk1.Public().Hash()...)
+
+	// Agree on a secret with a prekey bundle
+	var s asticrypt.PrekeySecrets
+	bd, err := asticrypt.NewPrekeyBundle(pk1, &s, 1)
+	assert.NoError(t, err)
+	pm, secret, err := asticrypt.NewPrekeyMessage("hello", pk2, bd)
+	assert.NoError(t, err)
+	a, err = asticrypt.NewRatchetInitiator(secret, bd.SignedPrekey.Key)
+	assert.NoError(t, err)
+	var o string
+	secret, err = pm.Decrypt(&o, pk1, &s)
+	assert.NoError(t, err)
+	k, err := s.SignedPrekey(pm.SignedPrekeyID)
+	assert.NoError(t, err)
+	b = asticrypt.NewRatchetResponder(secret, k)
+	return
+}
+
+func TestRatchet(t *testing.T) {
+	// Init
+	var a, b, ad = newTestRatchets(t)
+	var o string
+	var err error
+
+	// Send messages
+	var send = func(r *asticrypt.Ratchet, msgs ...string) (ms []*asticrypt.RatchetMessage) {
+		for _, msg := range msgs {
+			m, err := r.Encrypt(msg, ad)
+			assert.NoError(t, err)
+			ms = append(ms, m)
+		}
+		return
+	}
+	var receive = func(r *asticrypt.Ratchet, m *asticrypt.RatchetMessage, expected string) {
+		var o string
+		err := r.Decrypt(m, &o, ad)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, o)
+	}
+
+	// Out of order messages
+	var ams1 = send(a, "a1", "a2", "a3")
+	receive(b, ams1[2], "a3")
+	receive(b, ams1[0], "a1")
+
+	// Replies ratchet the keys
+	var bms1 = send(b, "b1", "b2")
+	assert.NotEqual(t, ams1[0].Header.Key, bms1[0].Header.Key)
+	receive(a, bms1[1], "b2")
+	var ams2 = send(a, "a4")
+	assert.NotEqual(t, ams1[0].Header.Key, ams2[0].Header.Key)
+	receive(b, ams2[0], "a4")
+
+	// Delayed messages of previous chains can still be decrypted
+	receive(b, ams1[1], "a2")
+	receive(a, bms1[0], "b1")
+
+	// Replayed messages are rejected
+	err = b.Decrypt(ams1[1], &o, ad)
+	assert.Error(t, err)
+	err = b.Decrypt(ams2[0], &o, ad)
+	assert.Error(t, err)
+
+	// Tampered messages are rejected and don't corrupt the ratchet
+	var ams3 = send(a, "a5")
+	var mt = *ams3[0]
+	mt.Message = append([]byte{}, ams3[0].Message...)
+	mt.Message[0] ^= 0xff
+	err = b.Decrypt(&mt, &o, ad)
+	assert.Error(t, err)
+	err = b.Decrypt(ams3[0], &o, []byte("invalid"))
+	assert.Error(t, err)
+	receive(b, ams3[0], "a5")
+
+	// Ratchets survive being saved
+	bs, err := json.Marshal(b)
+	assert.NoError(t, err)
+	b = &asticrypt.Ratchet{}
+	err = json.Unmarshal(bs, b)
+	assert.NoError(t, err)
+	receive(a, send(b, "b3")[0], "b3")
+
+	// Skipping too many message keys is not allowed
+	var ams4 = send(a, make([]string, 1002)...)
+	err = b.Decrypt(ams4[1001], &o, ad)
+	assert.Error(t, err)
+	receive(b, ams4[1000], "")
+}
+
+func TestRatchetSkippedLimit(t *testing.T) {
+	// Init
+	var a, b, ad = newTestRatchets(t)
+
+	// Skip as many message keys as possible at each ratchet step
+	var ms []*asticrypt.RatchetMessage
+	for i := 0; i < 4; i++ {
+		for j := 0; j <= 1000; j++ {
+			m, err := a.Encrypt(j, ad)
+			assert.NoError(t, err)
+			ms = append(ms, m)
+		}
+		var o int
+		err := b.Decrypt(ms[len(ms)-1], &o, ad)
+		assert.NoError(t, err)
+		assert.Equal(t, 1000, o)
+		m, err := b.Encrypt(i, ad)
+		assert.NoError(t, err)
+		err = a.Decrypt(m, &o, ad)
+		assert.NoError(t, err)
+	}
+
+	// Stored skipped message keys are capped
+	assert.Len(t, b.Skipped, 2000)
+	assert.Len(t, b.SkippedOrder, 2000)
+
+	// Recent skipped message keys are kept, the oldest ones are evicted
+	var o int
+	err := b.Decrypt(ms[len(ms)-2], &o, ad)
+	assert.NoError(t, err)
+	assert.Equal(t, 999, o)
+	assert.Len(t, b.Skipped, 1999)
+	err = b.Decrypt(ms[0], &o, ad)
+	assert.Error(t, err)
+}
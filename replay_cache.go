@@ -0,0 +1,62 @@
+package asticrypt
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrReplayedMessage is returned when a message has already been seen within its validity window
+var ErrReplayedMessage = errors.New("asticrypt: replayed message")
+
+// ReplayCache represents a cache of the messages already seen
+// Messages are scoped, for instance per user, so that IDs only need to be unique within a scope
+type ReplayCache interface {
+	// Add stores a message ID until it expires and returns ErrReplayedMessage if it is already stored
+	Add(scope, id string, expiresAt time.Time) error
+}
+
+// replayCacheMemory represents an in-memory replay cache
+type replayCacheMemory struct {
+	m        *sync.Mutex
+	purgedAt time.Time
+	ids      map[string]time.Time
+}
+
+// NewReplayCacheMemory creates a new in-memory replay cache
+// It is only suitable when a single process validates messages
+func NewReplayCacheMemory() ReplayCache {
+	return &replayCacheMemory{
+		ids: make(map[string]time.Time),
+		m:   &sync.Mutex{},
+	}
+}
+
+// Add implements the ReplayCache interface
+func (c *replayCacheMemory) Add(scope, id string, expiresAt time.Time) error {
+	// Lock
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	// Purge expired IDs
+	var now = time.Now()
+	if now.Sub(c.purgedAt) > time.Second {
+		for k, t := range c.ids {
+			if now.After(t) {
+				delete(c.ids, k)
+			}
+		}
+		c.purgedAt = now
+	}
+
+	// Check ID
+	var k = scope + "|" + id
+	if t, ok := c.ids[k]; ok && !now.After(t) {
+		return ErrReplayedMessage
+	}
+
+	// Store ID
+	c.ids[k] = expiresAt
+	return nil
+}
@@ -0,0 +1,387 @@
+package asticrypt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Router defaults
+const (
+	// routerErrorLabelDefault is the label sent to clients when an error has no label
+	routerErrorLabelDefault = "Communicating with server failed"
+	// routerMaxBatchSizeDefault is the max number of sub-requests in a batch
+	routerMaxBatchSizeDefault = 32
+)
+
+// RouterKeys represents the keys used to communicate with the sender of a message
+type RouterKeys struct {
+	// Passed to handlers, for instance to retrieve the user the keys belong to
+	Context context.Context
+	// Used to decrypt messages and encrypt replies
+	PrivateKey *PrivateKey
+	// Used to verify messages and encrypt replies
+	PublicKey *PublicKey
+	// Scope of the message IDs in the replay cache
+	ReplayScope string
+
+	// Set by the router when the message was sealed within a session
+	session *Session
+}
+
+// RouterKeysResolver resolves the keys used to communicate with the sender of a message based on its public key
+// Errors should wrap ErrUnauthorized when the key is unknown
+type RouterKeysResolver func(ctx context.Context, key *PublicKey) (RouterKeys, error)
+
+// RouterOptions represents the router options
+type RouterOptions struct {
+	ErrorLabel string
+	// Defaults to routerMaxBatchSizeDefault
+	MaxBatchSize int
+	// Messages with a lower protocol version are rejected with ErrUpgradeRequired
+	MinProtocolVersion int
+	// The context holds the request ID, see RequestIDFromContext
+	OnError     func(ctx context.Context, name string, err error)
+	ReplayCache ReplayCache
+	// If set, clients can open sessions
+	SessionStore SessionStore
+	// Defaults to sessionTTLDefault
+	SessionTTL time.Duration
+	Validity   time.Duration
+}
+
+// routerHandler represents an untyped handler
+type routerHandler func(ctx context.Context, payload json.RawMessage) (interface{}, error)
+
+// Router dispatches encrypted messages to handlers based on their names
+// It decrypts and validates incoming messages and encrypts replies, including errors which are sent under NameError
+// Handlers set the code of errors by wrapping sentinel errors and their label by returning a HandlerError
+type Router struct {
+	handlers map[string]routerHandler
+	keys     RouterKeysResolver
+	o        RouterOptions
+}
+
+// NewRouter creates a new router
+func NewRouter(keys RouterKeysResolver, o RouterOptions) *Router {
+	if len(o.ErrorLabel) == 0 {
+		o.ErrorLabel = routerErrorLabelDefault
+	}
+	if o.MaxBatchSize <= 0 {
+		o.MaxBatchSize = routerMaxBatchSizeDefault
+	}
+	if o.SessionTTL <= 0 {
+		o.SessionTTL = sessionTTLDefault
+	}
+	return &Router{
+		handlers: make(map[string]routerHandler),
+		keys:     keys,
+		o:        o,
+	}
+}
+
+// Handle registers a typed handler under a name
+// The message payload is unmarshaled into the request and the response is sent back under the same name
+func Handle[Req, Resp any](r *Router, name string, h func(ctx context.Context, req Req) (Resp, error)) {
+	r.handlers[name] = func(ctx context.Context, payload json.RawMessage) (resp interface{}, err error) {
+		// Unmarshal payload
+		var req Req
+		if len(payload) > 0 {
+			if err = json.Unmarshal(payload, &req); err != nil {
+				err = WithCode(ErrBadRequest, errors.Wrap(err, "unmarshaling payload failed"))
+				return
+			}
+		}
+
+		// Handle
+		return h(ctx, req)
+	}
+}
+
+// ServeHTTP implements the http.Handler interface
+func (r *Router) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// Init request ID
+	// Until the message is decrypted, the plain header is used if valid
+	var requestID = req.Header.Get(HeaderRequestID)
+	if !IsValidRequestID(requestID) {
+		var err error
+		if requestID, err = NewRequestID(); err != nil {
+			r.writeError(req.Context(), rw, "", WithCode(ErrInternal, errors.Wrap(err, "generating request ID failed")))
+			return
+		}
+	}
+	var ctx = context.WithValue(req.Context(), requestIDContextKey{}, requestID)
+	rw.Header().Set(HeaderRequestID, requestID)
+
+	// Decode body
+	var b BodyMessage
+	var err error
+	if err = json.NewDecoder(req.Body).Decode(&b); err != nil {
+		r.writeError(ctx, rw, "", WithCode(ErrBadRequest, errors.Wrap(err, "decoding body failed")))
+		return
+	}
+
+	// Get key
+	// Messages sealed within a session don't contain the key, it was stored when opening the session
+	var key = b.Key
+	var session *Session
+	if b.Session != nil {
+		// Get session
+		var ss StoredSession
+		if r.o.SessionStore == nil {
+			err = ErrSessionExpired
+		} else {
+			ss, err = r.o.SessionStore.Get(b.Session.ID)
+		}
+		if err != nil {
+			r.writeError(ctx, rw, "", errors.Wrap(err, "getting session failed"))
+			return
+		}
+		key = ss.PublicKey
+		session = &ss.Session
+	}
+
+	// Check key
+	if key == nil {
+		r.writeError(ctx, rw, "", WithCode(ErrBadRequest, errors.New("body has no key")))
+		return
+	}
+
+	// Resolve keys
+	var ks RouterKeys
+	if ks, err = r.keys(ctx, key); err != nil {
+		r.writeError(ctx, rw, "", errors.Wrap(err, "resolving keys failed"))
+		return
+	}
+	if ks.Context == nil {
+		ks.Context = ctx
+	}
+	ks.session = session
+
+	// Decrypt message
+	var m BodyMessageIn
+	if m, err = b.DecryptWithOptions(ks.PrivateKey, ks.PublicKey, time.Now(), BodyMessageDecryptOptions{
+		ReplayCache: r.o.ReplayCache,
+		ReplayScope: ks.ReplayScope,
+		Session:     session,
+		Validity:    r.o.Validity,
+	}); err != nil {
+		var code = ErrUnauthorized
+		if errors.Is(err, ErrReplayedMessage) {
+			code = ErrConflict
+		}
+		r.writeErrorEncrypted(rw, ks, "", WithCode(code, errors.Wrap(err, "decrypting message failed")))
+		return
+	}
+
+	// Update request ID
+	// From now on, the authenticated request ID is used
+	if IsValidRequestID(m.RequestID) && m.RequestID != requestID {
+		requestID = m.RequestID
+		ks.Context = context.WithValue(ks.Context, requestIDContextKey{}, requestID)
+		rw.Header().Set(HeaderRequestID, requestID)
+	}
+
+	// Check protocol version
+	if err = CheckProtocolVersion(m.ProtocolVersion, r.o.MinProtocolVersion); err != nil {
+		r.writeErrorEncrypted(rw, ks, m.Name, err)
+		return
+	}
+	ks.Context = context.WithValue(ks.Context, protocolVersionContextKey{}, m.ProtocolVersion)
+
+	// Handle
+	var resp interface{}
+	if m.Name == NameBatch {
+		resp, err = r.handleBatch(ks.Context, m.Payload)
+	} else if m.Name == NameSessionOpen && r.o.SessionStore != nil {
+		resp, err = r.openSession(ks, m.Payload)
+	} else {
+		resp, err = r.handle(ks.Context, m.Name, m.Payload)
+	}
+	if err != nil {
+		r.writeErrorEncrypted(rw, ks, m.Name, err)
+		return
+	}
+
+	// Build body
+	if b, err = NewBodyMessageWithOptions(m.Name, resp, ks.PrivateKey, ks.PrivateKey.Public(), ks.PublicKey, time.Now(), BodyMessageOptions{
+		RequestID: requestID,
+		Response:  true,
+		Session:   ks.session,
+	}); err != nil {
+		r.writeErrorEncrypted(rw, ks, m.Name, errors.Wrap(err, "building body failed"))
+		return
+	}
+
+	// Write
+	if err = json.NewEncoder(rw).Encode(b); err != nil {
+		r.onError(ks.Context, m.Name, errors.Wrap(err, "writing failed"))
+		return
+	}
+}
+
+// openSession opens a new session for the keys
+// Sessions can only be opened with messages encrypted with public keys
+func (r *Router) openSession(ks RouterKeys, payload json.RawMessage) (resp interface{}, err error) {
+	// Check session
+	if ks.session != nil {
+		err = WithCode(ErrBadRequest, errors.New("sessions can't be opened within a session"))
+		return
+	}
+
+	// Unmarshal payload
+	// Clients predating forward secrecy send no payload
+	var b BodySessionOpen
+	if len(payload) > 0 {
+		if err = json.Unmarshal(payload, &b); err != nil {
+			err = WithCode(ErrBadRequest, errors.Wrap(err, "unmarshaling payload failed"))
+			return
+		}
+	}
+
+	// Create session
+	var s Session
+	if len(b.EphemeralKey) > 0 {
+		var sr Session
+		if s, sr, err = newEphemeralSession(r.o.SessionTTL, time.Now(), b.EphemeralKey); err != nil {
+			err = WithCode(ErrBadRequest, errors.Wrap(err, "creating ephemeral session failed"))
+			return
+		}
+		resp = sr
+	} else {
+		if s, err = NewSession(r.o.SessionTTL, time.Now()); err != nil {
+			err = errors.Wrap(err, "creating session failed")
+			return
+		}
+		resp = s
+	}
+
+	// Store session
+	if err = r.o.SessionStore.Set(StoredSession{PublicKey: ks.PublicKey, Session: s}); err != nil {
+		err = errors.Wrap(err, "storing session failed")
+		return
+	}
+	return
+}
+
+// handle dispatches a payload to the handler registered under a name
+func (r *Router) handle(ctx context.Context, name string, payload json.RawMessage) (resp interface{}, err error) {
+	// Fetch handler
+	h, ok := r.handlers[name]
+	if !ok {
+		err = WithCode(ErrNotFound, fmt.Errorf("unknown name %s", name))
+		return
+	}
+
+	// Handle
+	if resp, err = h(ctx, payload); err != nil {
+		err = errors.Wrapf(err, "handling %s failed", name)
+		return
+	}
+	return
+}
+
+// handleBatch dispatches the sub-requests of a batch in order
+// Errors of sub-requests are returned in their results and don't fail the batch
+func (r *Router) handleBatch(ctx context.Context, payload json.RawMessage) (resp interface{}, err error) {
+	// Unmarshal payload
+	var is []BodyBatchItem
+	if err = json.Unmarshal(payload, &is); err != nil {
+		err = WithCode(ErrBadRequest, errors.Wrap(err, "unmarshaling payload failed"))
+		return
+	}
+
+	// Check size
+	if len(is) > r.o.MaxBatchSize {
+		err = WithCode(ErrBadRequest, fmt.Errorf("batch size %d is bigger than %d", len(is), r.o.MaxBatchSize))
+		return
+	}
+
+	// Loop through items
+	var rs = make([]BodyBatchResult, len(is))
+	for idx, i := range is {
+		// Handle
+		var o interface{}
+		var errHandle error
+		if i.Name == NameBatch {
+			errHandle = WithCode(ErrBadRequest, errors.New("batches can't be nested"))
+		} else {
+			o, errHandle = r.handle(ctx, i.Name, i.Payload)
+		}
+
+		// Process error
+		if errHandle != nil {
+			r.onError(ctx, i.Name, errHandle)
+			var be = NewBodyError(errHandle, r.o.ErrorLabel)
+			be.RequestID = RequestIDFromContext(ctx)
+			rs[idx].Error = &be
+			continue
+		}
+
+		// Marshal output
+		if rs[idx].Payload, err = json.Marshal(o); err != nil {
+			err = errors.Wrapf(err, "marshaling output of %s failed", i.Name)
+			return
+		}
+	}
+	resp = rs
+	return
+}
+
+// onError calls the error callback
+func (r *Router) onError(ctx context.Context, name string, err error) {
+	if r.o.OnError != nil {
+		r.o.OnError(ctx, name, err)
+	}
+}
+
+// writeError writes an error in plain JSON when keys are unknown
+func (r *Router) writeError(ctx context.Context, rw http.ResponseWriter, name string, err error) {
+	r.onError(ctx, name, err)
+	var b = NewBodyError(err, r.o.ErrorLabel)
+	b.RequestID = RequestIDFromContext(ctx)
+	rw.WriteHeader(b.HTTPStatus())
+	if errWrite := json.NewEncoder(rw).Encode(b); errWrite != nil {
+		r.onError(ctx, name, errors.Wrap(errWrite, "writing failed"))
+	}
+}
+
+// writeErrorEncrypted writes an encrypted error under NameError
+func (r *Router) writeErrorEncrypted(rw http.ResponseWriter, ks RouterKeys, name string, err error) {
+	// Callback
+	r.onError(ks.Context, name, err)
+
+	// Build body
+	var be = NewBodyError(err, r.o.ErrorLabel)
+	be.RequestID = RequestIDFromContext(ks.Context)
+	var b BodyMessage
+	var errBuild error
+	if b, errBuild = NewBodyMessageWithOptions(NameError, be, ks.PrivateKey, ks.PrivateKey.Public(), ks.PublicKey, time.Now(), BodyMessageOptions{
+		RequestID: be.RequestID,
+		Response:  true,
+		Session:   ks.session,
+	}); errBuild != nil {
+		r.writeError(ks.Context, rw, name, errors.Wrap(errBuild, "building body failed"))
+		return
+	}
+
+	// Write
+	rw.WriteHeader(be.HTTPStatus())
+	if errWrite := json.NewEncoder(rw).Encode(b); errWrite != nil {
+		r.onError(ks.Context, name, errors.Wrap(errWrite, "writing failed"))
+		return
+	}
+}
+
+// requestIDContextKey is the context key of the request ID
+type requestIDContextKey struct{}
+
+// RequestIDFromContext returns the ID of the request being handled by a router
+func RequestIDFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(requestIDContextKey{}).(string)
+	return v
+}
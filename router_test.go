@@ -0,0 +1,92 @@
+package asticrypt_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/asticode/go-asticrypt"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouter(t *testing.T) {
+	// Init
+	var pk1, pk2 = &asticrypt.PrivateKey{}, &asticrypt.PrivateKey{}
+	pk1.SetPassphrase("test")
+	err := pk1.UnmarshalText([]byte(prv1))
+	assert.NoError(t, err)
+	err = pk2.UnmarshalText([]byte(prv2))
+	assert.NoError(t, err)
+	var r = asticrypt.NewRouter(func(ctx context.Context, key *asticrypt.PublicKey) (asticrypt.RouterKeys, error) {
+		if !bytes.Equal(key.Fingerprint(), pk1.Public().Fingerprint()) {
+			return asticrypt.RouterKeys{}, asticrypt.WithCode(asticrypt.ErrUnauthorized, errors.New("unknown key"))
+		}
+		return asticrypt.RouterKeys{PrivateKey: pk2, PublicKey: pk1.Public()}, nil
+	}, asticrypt.RouterOptions{})
+	asticrypt.Handle(r, "sum", func(ctx context.Context, req []int) (resp int, err error) {
+		if len(req) == 0 {
+			err = asticrypt.HandlerError{Err: asticrypt.WithCode(asticrypt.ErrBadRequest, errors.New("empty request")), Label: "label"}
+			return
+		}
+		for _, i := range req {
+			resp += i
+		}
+		return
+	})
+	var send = func(name string, in interface{}, status int) (m asticrypt.BodyMessageIn) {
+		b, err := asticrypt.NewBodyMessage(name, in, pk1, pk1.Public(), pk2.Public(), time.Now())
+		assert.NoError(t, err)
+		buf, err := json.Marshal(b)
+		assert.NoError(t, err)
+		var rec = httptest.NewRecorder()
+		var req = httptest.NewRequest(http.MethodPost, "/encrypted", bytes.NewReader(buf))
+		req.Header.Set(asticrypt.HeaderRequestID, "plain-id")
+		r.ServeHTTP(rec, req)
+		assert.Equal(t, status, rec.Code)
+		var bin asticrypt.BodyMessage
+		err = json.NewDecoder(rec.Body).Decode(&bin)
+		assert.NoError(t, err)
+		m, err = bin.Decrypt(pk1, pk2.Public(), time.Now())
+		assert.NoError(t, err)
+
+		// The authenticated request ID prevails
+		var bout asticrypt.BodyMessageIn
+		bout, err = b.Decrypt(pk2, pk1.Public(), time.Now())
+		assert.NoError(t, err)
+		assert.Equal(t, bout.RequestID, m.RequestID)
+		assert.Equal(t, m.RequestID, rec.Header().Get(asticrypt.HeaderRequestID))
+		return
+	}
+
+	// Success
+	m := send("sum", []int{1, 2, 3}, http.StatusOK)
+	assert.Equal(t, "sum", m.Name)
+	assert.Equal(t, "6", string(m.Payload))
+
+	// Handler error
+	m = send("sum", nil, http.StatusBadRequest)
+	assert.Equal(t, asticrypt.NameError, m.Name)
+	assert.Equal(t, `{"code":"bad_request","label":"label","request_id":"`+m.RequestID+`"}`, string(m.Payload))
+
+	// Unknown name
+	m = send("unknown", nil, http.StatusNotFound)
+	assert.Equal(t, asticrypt.NameError, m.Name)
+	assert.Equal(t, `{"code":"not_found","label":"Communicating with server failed","request_id":"`+m.RequestID+`"}`, string(m.Payload))
+
+	// Unknown key
+	b, err := asticrypt.NewBodyMessage("sum", []int{1}, pk2, pk2.Public(), pk1.Public(), time.Now())
+	assert.NoError(t, err)
+	buf, err := json.Marshal(b)
+	assert.NoError(t, err)
+	var rec = httptest.NewRecorder()
+	var req = httptest.NewRequest(http.MethodPost, "/encrypted", bytes.NewReader(buf))
+	req.Header.Set(asticrypt.HeaderRequestID, "plain-id")
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, "plain-id", rec.Header().Get(asticrypt.HeaderRequestID))
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"flag"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/asticode/go-asticrypt"
 	"github.com/asticode/go-astilog"
 	"github.com/asticode/go-astimysql"
 	"github.com/asticode/go-astipatch"
@@ -16,9 +18,17 @@ var (
 	addrLocal          = flag.String("l", "", "the local addr")
 	addrPublic         = flag.String("p", "", "the public addr")
 	configPath         = flag.String("c", "", "the config path")
+	messageValidity    = flag.Duration("mv", 0, "the duration a message creation date can differ from now")
+	minProtocolVersion = flag.Int("mpv", 0, "the min protocol version clients must speak")
 	googleClientID     = flag.String("gci", "", "the google client id")
 	googleClientSecret = flag.String("gcs", "", "the google client secret")
+	masterKeyPath      = flag.String("master-key-path", "", "the master key path")
+	oldMasterKeyPath   = flag.String("old-master-key-path", "", "the old master key path, only used by db-rekey")
 	pathResources      = flag.String("r", "", "the resources path")
+	postgresDSN        = flag.String("postgres-dsn", "", "the postgres dsn")
+	replayCacheType    = flag.String("rc", "", "the replay cache (memory, mysql, postgres or sqlite), defaults to the storage")
+	sqlitePath         = flag.String("sqlite-path", "", "the sqlite path")
+	storageType        = flag.String("st", "", "the storage (memory, mysql, postgres or sqlite)")
 )
 
 // Configuration represents a configuration
@@ -28,9 +38,17 @@ type Configuration struct {
 	GoogleClientID     string                  `toml:"google_client_id"`
 	GoogleClientSecret string                  `toml:"google_client_secret"`
 	Logger             astilog.Configuration   `toml:"logger"`
+	MasterKey          MasterKeyConfiguration  `toml:"master_key"`
+	MessageValidity    duration                `toml:"message_validity"`
+	MinProtocolVersion int                     `toml:"min_protocol_version"`
 	MySQL              astimysql.Configuration `toml:"mysql"`
+	OldMasterKey       MasterKeyConfiguration  `toml:"old_master_key"`
 	Patcher            astipatch.Configuration `toml:"patcher"`
 	PathResources      string                  `toml:"path_resources"`
+	Postgres           PostgresConfiguration   `toml:"postgres"`
+	ReplayCache        string                  `toml:"replay_cache"`
+	SQLite             SQLiteConfiguration     `toml:"sqlite"`
+	Storage            string                  `toml:"storage"`
 }
 
 // newConfiguration creates a new configuration object
@@ -40,6 +58,11 @@ func newConfiguration() (c Configuration) {
 		Logger: astilog.Configuration{
 			AppName: "go-asticrypt-server",
 		},
+		MasterKey:       MasterKeyConfiguration{Env: "ASTICRYPT_MASTER_KEY"},
+		MessageValidity: duration{Duration: asticrypt.BodyMessageValidityDefault},
+		OldMasterKey:    MasterKeyConfiguration{Env: "ASTICRYPT_OLD_MASTER_KEY"},
+		SQLite:          SQLiteConfiguration{Path: "asticrypt.db"},
+		Storage:         storageTypeMySQL,
 	}
 
 	// Local config
@@ -57,9 +80,17 @@ func newConfiguration() (c Configuration) {
 		GoogleClientID:     *googleClientID,
 		GoogleClientSecret: *googleClientSecret,
 		Logger:             astilog.FlagConfig(),
+		MasterKey:          MasterKeyConfiguration{Path: *masterKeyPath},
+		MessageValidity:    duration{Duration: *messageValidity},
+		MinProtocolVersion: *minProtocolVersion,
 		MySQL:              astimysql.FlagConfig(),
+		OldMasterKey:       MasterKeyConfiguration{Path: *oldMasterKeyPath},
 		Patcher:            astipatch.FlagConfig(),
 		PathResources:      *pathResources,
+		Postgres:           PostgresConfiguration{DSN: *postgresDSN},
+		ReplayCache:        *replayCacheType,
+		SQLite:             SQLiteConfiguration{Path: *sqlitePath},
+		Storage:            *storageType,
 	}
 
 	// Merge configs
@@ -68,3 +99,14 @@ func newConfiguration() (c Configuration) {
 	}
 	return
 }
+
+// duration represents a duration that can be decoded from a toml string such as "5s"
+type duration struct {
+	time.Duration
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface
+func (d *duration) UnmarshalText(b []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(b))
+	return
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// masterKeySize is the size of master keys
+const masterKeySize = 32
+
+// Vars
+var (
+	errNoMasterKey = errors.New("no master key configured")
+	keyProvider    KeyProvider
+)
+
+// KeyProvider represents a provider wrapping the data keys server private keys are encrypted with
+// The local key provider uses a master key loaded from the configuration, a KMS can be plugged in by implementing
+// this interface.
+type KeyProvider interface {
+	// ID identifies the master key so that data keys can be unwrapped by the right provider once it's rotated
+	ID() string
+	UnwrapKey(wrapped []byte) (key []byte, err error)
+	WrapKey(key []byte) (wrapped []byte, err error)
+}
+
+// MasterKeyConfiguration represents the master key configuration
+// The key is base64 encoded and is read, in that order, from the file, the configuration or the env variable
+type MasterKeyConfiguration struct {
+	Env  string `toml:"env"`
+	Key  string `toml:"key"`
+	Path string `toml:"path"`
+}
+
+// loadMasterKey loads a master key
+func loadMasterKey(c MasterKeyConfiguration) (k []byte, err error) {
+	// Get encoded key
+	var s string
+	if len(c.Path) > 0 {
+		var b []byte
+		if b, err = ioutil.ReadFile(c.Path); err != nil {
+			err = errors.Wrapf(err, "reading %s failed", c.Path)
+			return
+		}
+		s = string(b)
+	} else if len(c.Key) > 0 {
+		s = c.Key
+	} else if len(c.Env) > 0 {
+		s = os.Getenv(c.Env)
+	}
+	if s = strings.TrimSpace(s); len(s) == 0 {
+		err = errNoMasterKey
+		return
+	}
+
+	// Decode key
+	if k, err = base64.StdEncoding.DecodeString(s); err != nil {
+		err = errors.Wrap(err, "base64 decoding master key failed")
+		return
+	}
+	return
+}
+
+// keyProviderLocal represents a key provider wrapping data keys locally with AES-256-GCM
+type keyProviderLocal struct {
+	a  cipher.AEAD
+	id string
+}
+
+// newKeyProviderLocal builds a new local key provider
+func newKeyProviderLocal(masterKey []byte) (p *keyProviderLocal, err error) {
+	// Check master key
+	if len(masterKey) != masterKeySize {
+		err = fmt.Errorf("master key size %d != %d", len(masterKey), masterKeySize)
+		return
+	}
+
+	// Create AEAD
+	var b cipher.Block
+	if b, err = aes.NewCipher(masterKey); err != nil {
+		err = errors.Wrap(err, "creating cipher failed")
+		return
+	}
+	p = &keyProviderLocal{}
+	if p.a, err = cipher.NewGCM(b); err != nil {
+		err = errors.Wrap(err, "creating gcm failed")
+		return
+	}
+
+	// The ID is derived from the master key so that it doesn't need to be configured
+	var h = sha256.Sum256(masterKey)
+	p.id = "local:" + hex.EncodeToString(h[:8])
+	return
+}
+
+// ID implements the KeyProvider interface
+func (p *keyProviderLocal) ID() string {
+	return p.id
+}
+
+// WrapKey implements the KeyProvider interface
+func (p *keyProviderLocal) WrapKey(key []byte) (wrapped []byte, err error) {
+	// Generate nonce
+	var nonce = make([]byte, p.a.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		err = errors.Wrap(err, "generating nonce failed")
+		return
+	}
+
+	// Seal
+	wrapped = p.a.Seal(nonce, nonce, key, []byte(p.id))
+	return
+}
+
+// UnwrapKey implements the KeyProvider interface
+func (p *keyProviderLocal) UnwrapKey(wrapped []byte) (key []byte, err error) {
+	// Check size
+	if len(wrapped) < p.a.NonceSize() {
+		err = fmt.Errorf("wrapped key size %d is invalid", len(wrapped))
+		return
+	}
+
+	// Open
+	if key, err = p.a.Open(nil, wrapped[:p.a.NonceSize()], wrapped[p.a.NonceSize():], []byte(p.id)); err != nil {
+		err = errors.Wrap(err, "opening gcm failed")
+		return
+	}
+	return
+}
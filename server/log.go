@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+
+	"github.com/asticode/go-asticrypt"
+	"github.com/asticode/go-astilog"
+)
+
+// requestLogger prefixes log lines with the ID of the request they belong to
+type requestLogger struct {
+	prefix string
+}
+
+// newRequestLogger creates a new request logger
+func newRequestLogger(requestID string) requestLogger {
+	if len(requestID) == 0 {
+		return requestLogger{}
+	}
+	return requestLogger{prefix: "[" + requestID + "] "}
+}
+
+// loggerFromContext creates a new request logger based on the request ID stored in the context
+func loggerFromContext(ctx context.Context) requestLogger {
+	return newRequestLogger(asticrypt.RequestIDFromContext(ctx))
+}
+
+// Debugf logs a debug line
+func (l requestLogger) Debugf(format string, args ...interface{}) {
+	astilog.Debugf(l.prefix+format, args...)
+}
+
+// Error logs an error
+func (l requestLogger) Error(err error) {
+	astilog.Errorf("%s%s", l.prefix, err)
+}
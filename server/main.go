@@ -1,12 +1,14 @@
 package main
 
 import (
+	"crypto/rand"
 	"flag"
 
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/asticode/go-asticrypt"
 	"github.com/asticode/go-astilog"
 	"github.com/asticode/go-astimysql"
 	"github.com/asticode/go-astipatch"
@@ -30,22 +32,77 @@ func main() {
 	// Build logger
 	astilog.SetLogger(astilog.New(configuration.Logger))
 
-	// Build db
+	// Build storage
 	var db *sqlx.DB
 	var err error
-	if db, err = astimysql.New(configuration.MySQL); err != nil {
-		astilog.Fatalf("%s while creating db", err)
+	switch configuration.Storage {
+	case storageTypeMemory:
+		storage = newStorageMemory()
+	case storageTypeMySQL:
+		if db, err = astimysql.New(configuration.MySQL); err != nil {
+			astilog.Fatalf("%s while creating db", err)
+		}
+		storage = newStorageMySQL(db)
+	case storageTypePostgres:
+		if db, err = newPostgres(configuration.Postgres); err != nil {
+			astilog.Fatalf("%s while creating db", err)
+		}
+		storage = newStoragePostgres(db)
+	case storageTypeSQLite:
+		if db, err = newSQLite(configuration.SQLite); err != nil {
+			astilog.Fatalf("%s while creating db", err)
+		}
+		storage = newStorageSQLite(db)
+	default:
+		astilog.Fatalf("Invalid storage %s", configuration.Storage)
 	}
 
-	// Build patcher
-	var p = astipatch.NewPatcherSQL(db, astipatch.NewStorerSQL(db))
+	// Build replay cache
+	// It defaults to the storage, db replay caches must use the same db as the storage
+	var rc = configuration.ReplayCache
+	if len(rc) == 0 {
+		rc = configuration.Storage
+	}
+	switch {
+	case rc == replayCacheTypeMemory:
+		replayCache = asticrypt.NewReplayCacheMemory()
+	case rc == replayCacheTypeMySQL && configuration.Storage == storageTypeMySQL:
+		replayCache = newReplayCacheMySQL(db)
+	case rc == replayCacheTypePostgres && configuration.Storage == storageTypePostgres:
+		replayCache = newReplayCachePostgres(db)
+	case rc == replayCacheTypeSQLite && configuration.Storage == storageTypeSQLite:
+		replayCache = newReplayCacheSQLite(db)
+	default:
+		astilog.Fatalf("Invalid replay cache %s for storage %s", rc, configuration.Storage)
+	}
 
-	// Build storage
-	storage = newStorageMySQL(db)
+	// Build key provider
+	var mk []byte
+	if mk, err = loadMasterKey(configuration.MasterKey); err == errNoMasterKey && configuration.Storage == storageTypeMemory {
+		// Server private keys don't outlive the process with the memory storage
+		astilog.Warn("No master key configured, generating a random one")
+		mk = make([]byte, masterKeySize)
+		_, err = rand.Read(mk)
+	}
+	if err != nil {
+		astilog.Fatalf("%s while loading master key", err)
+	}
+	if keyProvider, err = newKeyProviderLocal(mk); err != nil {
+		astilog.Fatalf("%s while creating key provider", err)
+	}
 
 	// Handle signals
 	handleSignals()
 
+	// Patches are only used by the MySQL and PostgreSQL storages, the SQLite storage creates its schema itself
+	// PostgreSQL patches are located in resources/patches_postgres
+	var p astipatch.Patcher
+	if configuration.Storage == storageTypeMySQL || configuration.Storage == storageTypePostgres {
+		p = astipatch.NewPatcherSQL(db, astipatch.NewStorerSQL(db))
+	} else if s == "db-init" || s == "db-migrate" || s == "db-rollback" {
+		astilog.Fatalf("%s is only available with the %s and %s storages", s, storageTypeMySQL, storageTypePostgres)
+	}
+
 	// Switch on subcommand
 	switch s {
 	case "db-init":
@@ -70,6 +127,25 @@ func main() {
 			}
 		}
 		astilog.Infof("%s successful", s)
+	case "db-rekey":
+		// Build old key provider
+		// It's optional when only unencrypted legacy server private keys need to be sealed
+		var oldP KeyProvider
+		var omk []byte
+		if omk, err = loadMasterKey(configuration.OldMasterKey); err == nil {
+			if oldP, err = newKeyProviderLocal(omk); err != nil {
+				astilog.Fatalf("%s while creating old key provider", err)
+			}
+		} else if err != errNoMasterKey {
+			astilog.Fatalf("%s while loading old master key", err)
+		}
+
+		// Rekey
+		var n int
+		if n, err = rekey(oldP, keyProvider); err != nil {
+			astilog.Fatal(err)
+		}
+		astilog.Infof("db-rekey successful, %d server private key(s) rekeyed", n)
 	default:
 		// Serve
 		if err := serve(configuration.AddrLocal, configuration.PathResources); err != nil {
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/asticode/go-asticrypt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// Replay cache types
+const (
+	replayCacheTypeMemory   = "memory"
+	replayCacheTypeMySQL    = "mysql"
+	replayCacheTypePostgres = "postgres"
+	replayCacheTypeSQLite   = "sqlite"
+)
+
+// Vars
+var replayCache asticrypt.ReplayCache
+
+// mysqlErrDuplicateEntry is the MySQL error number of a duplicate entry
+const mysqlErrDuplicateEntry = 1062
+
+// replayCacheMySQL represents a MySQL replay cache
+// Contrary to the in-memory replay cache, it can be shared by several servers
+type replayCacheMySQL struct {
+	db *sqlx.DB
+}
+
+// newReplayCacheMySQL builds a new mysql replay cache
+func newReplayCacheMySQL(db *sqlx.DB) *replayCacheMySQL {
+	return &replayCacheMySQL{db: db}
+}
+
+// Add implements the asticrypt.ReplayCache interface
+func (c *replayCacheMySQL) Add(scope, id string, expiresAt time.Time) (err error) {
+	// Purge expired IDs
+	if _, err = c.db.Exec("DELETE FROM replay WHERE scope = ? AND expires_at < ?", scope, time.Now().UTC()); err != nil {
+		return
+	}
+
+	// Store ID
+	if _, err = c.db.Exec("INSERT INTO replay (scope, id, expires_at) VALUES (?, ?, ?)", scope, id, expiresAt.UTC()); err != nil {
+		if e, ok := err.(*mysql.MySQLError); ok && e.Number == mysqlErrDuplicateEntry {
+			err = asticrypt.ErrReplayedMessage
+		}
+		return
+	}
+	return
+}
+
+// replayCacheSQLite represents a SQLite replay cache
+type replayCacheSQLite struct {
+	db *sqlx.DB
+}
+
+// newReplayCacheSQLite builds a new SQLite replay cache
+func newReplayCacheSQLite(db *sqlx.DB) *replayCacheSQLite {
+	return &replayCacheSQLite{db: db}
+}
+
+// Add implements the asticrypt.ReplayCache interface
+func (c *replayCacheSQLite) Add(scope, id string, expiresAt time.Time) (err error) {
+	// Purge expired IDs
+	if _, err = c.db.Exec("DELETE FROM replay WHERE scope = ? AND expires_at < ?", scope, time.Now().UTC()); err != nil {
+		return
+	}
+
+	// Store ID
+	var r sql.Result
+	if r, err = c.db.Exec("INSERT OR IGNORE INTO replay (scope, id, expires_at) VALUES (?, ?, ?)", scope, id, expiresAt.UTC()); err != nil {
+		return
+	}
+
+	// ID already exists
+	var n int64
+	if n, err = r.RowsAffected(); err != nil {
+		return
+	} else if n == 0 {
+		err = asticrypt.ErrReplayedMessage
+		return
+	}
+	return
+}
+
+// replayCachePostgres represents a PostgreSQL replay cache
+// Like the MySQL replay cache, it can be shared by several servers
+type replayCachePostgres struct {
+	db *sqlx.DB
+}
+
+// newReplayCachePostgres builds a new PostgreSQL replay cache
+func newReplayCachePostgres(db *sqlx.DB) *replayCachePostgres {
+	return &replayCachePostgres{db: db}
+}
+
+// Add implements the asticrypt.ReplayCache interface
+func (c *replayCachePostgres) Add(scope, id string, expiresAt time.Time) (err error) {
+	// Purge expired IDs
+	if _, err = c.db.Exec("DELETE FROM replay WHERE scope = $1 AND expires_at < $2", scope, time.Now().UTC()); err != nil {
+		return
+	}
+
+	// Store ID
+	var r sql.Result
+	if r, err = c.db.Exec("INSERT INTO replay (scope, id, expires_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", scope, id, expiresAt.UTC()); err != nil {
+		return
+	}
+
+	// ID already exists
+	var n int64
+	if n, err = r.RowsAffected(); err != nil {
+		return
+	} else if n == 0 {
+		err = asticrypt.ErrReplayedMessage
+		return
+	}
+	return
+}
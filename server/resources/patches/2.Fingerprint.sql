@@ -0,0 +1,8 @@
+-- add client public key fingerprint
+ALTER TABLE user ADD COLUMN client_public_key_fingerprint BINARY(32) DEFAULT NULL AFTER id;
+
+-- compute fingerprints of existing users: client_public_key is the base64 encoded DER SubjectPublicKeyInfo
+UPDATE user SET client_public_key_fingerprint = UNHEX(SHA2(FROM_BASE64(client_public_key), 256));
+
+-- make fingerprint mandatory and unique
+ALTER TABLE user MODIFY client_public_key_fingerprint BINARY(32) NOT NULL, ADD UNIQUE KEY client_public_key_fingerprint (client_public_key_fingerprint);
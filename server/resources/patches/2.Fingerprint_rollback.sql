@@ -0,0 +1 @@
+ALTER TABLE user DROP INDEX client_public_key_fingerprint, DROP COLUMN client_public_key_fingerprint;
\ No newline at end of file
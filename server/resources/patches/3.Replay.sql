@@ -0,0 +1,8 @@
+-- create table replay
+CREATE TABLE IF NOT EXISTS replay (
+    scope VARCHAR(255) NOT NULL,
+    id VARCHAR(255) NOT NULL,
+    expires_at datetime NOT NULL,
+    PRIMARY KEY (scope, id),
+    KEY expires_at (expires_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS replay;
\ No newline at end of file
@@ -0,0 +1,14 @@
+-- create table prekey
+-- signed prekeys have a signature, one-time prekeys don't and are deleted once fetched
+CREATE TABLE IF NOT EXISTS prekey (
+    id int(10) unsigned NOT NULL AUTO_INCREMENT,
+    user_id int(10) unsigned NOT NULL,
+    prekey_id VARCHAR(255) NOT NULL,
+    `key` VARBINARY(32) NOT NULL,
+    signature BLOB DEFAULT NULL,
+    signature_scheme VARCHAR(255) DEFAULT NULL,
+    created_at datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_prekey_user FOREIGN KEY (user_id) REFERENCES user(id),
+    UNIQUE KEY user_prekey_id (user_id, prekey_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1,45 @@
+-- create table user
+-- user is a reserved word in PostgreSQL and must be quoted
+CREATE TABLE IF NOT EXISTS "user" (
+    id SERIAL PRIMARY KEY,
+    client_public_key_fingerprint BYTEA NOT NULL UNIQUE,
+    client_public_key_hash BYTEA NOT NULL UNIQUE,
+    client_public_key BYTEA,
+    server_private_key BYTEA,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+-- create table account
+CREATE TABLE IF NOT EXISTS account (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER DEFAULT NULL REFERENCES "user"(id),
+    addr VARCHAR(255) NOT NULL UNIQUE,
+    token VARCHAR(255) NOT NULL DEFAULT '',
+    validation_token VARCHAR(255) NOT NULL DEFAULT '',
+    validated_at TIMESTAMP WITH TIME ZONE DEFAULT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+-- create table replay
+CREATE TABLE IF NOT EXISTS replay (
+    scope VARCHAR(255) NOT NULL,
+    id VARCHAR(255) NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (scope, id)
+);
+CREATE INDEX IF NOT EXISTS replay_expires_at ON replay (expires_at);
+
+-- create table prekey
+-- signed prekeys have a signature, one-time prekeys don't and are deleted once fetched
+CREATE TABLE IF NOT EXISTS prekey (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES "user"(id),
+    prekey_id VARCHAR(255) NOT NULL,
+    key BYTEA NOT NULL,
+    signature BYTEA DEFAULT NULL,
+    signature_scheme VARCHAR(255) DEFAULT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    UNIQUE (user_id, prekey_id)
+);
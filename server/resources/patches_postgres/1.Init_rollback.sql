@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS prekey;
+DROP TABLE IF EXISTS replay;
+DROP TABLE IF EXISTS account;
+DROP TABLE IF EXISTS "user";
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"text/template"
 	"time"
 
@@ -35,10 +38,11 @@ func serve(addr, pathResources string) (err error) {
 	r.ServeFiles("/static/*filepath", http.Dir(filepath.Join(pathResources, "static")))
 
 	// JSON
+	r.GET("/time", handleTime)
 	r.POST("/users", handleCreateUser)
 
 	// Encrypted
-	r.POST("/encrypted", handleEncryptedMessages)
+	r.Handler(http.MethodPost, "/encrypted", newEncryptedRouter())
 
 	// Listen
 	astilog.Debugf("Listening on %s", addr)
@@ -52,7 +56,20 @@ func serve(addr, pathResources string) (err error) {
 
 func adaptHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		astilog.Debugf("handling %s", r.URL.Path)
+		// Make sure every request has a valid ID
+		// Invalid IDs are replaced before being logged so that clients can't inject arbitrary strings in logs. The
+		// encrypted router replaces it with the authenticated one once the message is decrypted.
+		var requestID = r.Header.Get(asticrypt.HeaderRequestID)
+		if !asticrypt.IsValidRequestID(requestID) {
+			var err error
+			if requestID, err = asticrypt.NewRequestID(); err != nil {
+				handleErrorJSON(rw, err, "generating request ID", "Handling request failed")
+				return
+			}
+			r.Header.Set(asticrypt.HeaderRequestID, requestID)
+		}
+		rw.Header().Set(asticrypt.HeaderRequestID, requestID)
+		newRequestLogger(requestID).Debugf("handling %s", r.URL.Path)
 		h.ServeHTTP(rw, r)
 	})
 }
@@ -109,14 +126,24 @@ func handleOAuthRedirect(rw http.ResponseWriter, r *http.Request, p httprouter.P
 	http.Redirect(rw, r, authURL, http.StatusFound)
 }
 
-func handleErrorJSON(rw http.ResponseWriter, code int, err error, msgDev, msgUser string) {
-	rw.WriteHeader(code)
-	astilog.Error(errors.Wrap(err, msgDev+" failed"))
-	if errWrite := json.NewEncoder(rw).Encode(asticrypt.BodyError{Label: msgUser}); errWrite != nil {
+func handleErrorJSON(rw http.ResponseWriter, err error, msgDev, msgUser string) {
+	var b = asticrypt.NewBodyError(err, msgUser)
+	b.RequestID = rw.Header().Get(asticrypt.HeaderRequestID)
+	newRequestLogger(b.RequestID).Error(errors.Wrap(err, msgDev+" failed"))
+	rw.WriteHeader(b.HTTPStatus())
+	if errWrite := json.NewEncoder(rw).Encode(b); errWrite != nil {
 		astilog.Errorf("%s while writing", errWrite)
 	}
 }
 
+func handleTime(rw http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	// Write
+	if err := json.NewEncoder(rw).Encode(asticrypt.BodyTime{Now: time.Now()}); err != nil {
+		handleErrorJSON(rw, err, "writing", "Getting time failed")
+		return
+	}
+}
+
 func handleCreateUser(rw http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	// Init
 	const defaultUserErrorMsg = "Creating user failed"
@@ -125,130 +152,134 @@ func handleCreateUser(rw http.ResponseWriter, r *http.Request, p httprouter.Para
 	var b asticrypt.BodyKey
 	var err error
 	if err = json.NewDecoder(r.Body).Decode(&b); err != nil {
-		handleErrorJSON(rw, http.StatusInternalServerError, err, "decoding body", defaultUserErrorMsg)
+		handleErrorJSON(rw, asticrypt.WithCode(asticrypt.ErrBadRequest, err), "decoding body", defaultUserErrorMsg)
+		return
+	}
+	if b.Key == nil {
+		handleErrorJSON(rw, asticrypt.WithCode(asticrypt.ErrBadRequest, errors.New("body has no key")), "validating body", defaultUserErrorMsg)
+		return
+	}
+
+	// Check protocol version
+	var v = asticrypt.ProtocolVersionLegacy
+	if b.Capabilities != nil {
+		v = b.Capabilities.ProtocolVersion
+	}
+	if err = asticrypt.CheckProtocolVersion(v, configuration.MinProtocolVersion); err != nil {
+		handleErrorJSON(rw, err, "checking protocol version", defaultUserErrorMsg)
 		return
 	}
 
 	// Generate server private key
-	// TODO Use passphrase?
 	astilog.Debugf("Generating new private key")
 	var srvPrvKey *asticrypt.PrivateKey
 	if srvPrvKey, err = asticrypt.GeneratePrivateKey(""); err != nil {
-		handleErrorJSON(rw, http.StatusInternalServerError, err, "generating server private key", defaultUserErrorMsg)
+		handleErrorJSON(rw, err, "generating server private key", defaultUserErrorMsg)
 		return
 	}
 
 	// Fetch user
 	if _, err = storage.UserFetchWithKey(b.Key); err != nil && err != errNotFound {
-		handleErrorJSON(rw, http.StatusInternalServerError, err, "fetching user", defaultUserErrorMsg)
+		handleErrorJSON(rw, err, "fetching user", defaultUserErrorMsg)
 		return
 	} else if err == nil {
-		handleErrorJSON(rw, http.StatusInternalServerError, errors.New("user already exists"), "creating user", defaultUserErrorMsg)
+		handleErrorJSON(rw, asticrypt.WithCode(asticrypt.ErrConflict, errors.New("user already exists")), "creating user", defaultUserErrorMsg)
+		return
+	}
+
+	// Seal server private key
+	var sealed []byte
+	if sealed, err = sealPrivateKey(keyProvider, srvPrvKey, b.Key); err != nil {
+		handleErrorJSON(rw, err, "sealing server private key", defaultUserErrorMsg)
 		return
 	}
 
 	// Create user
-	if err = storage.UserCreate(b.Key, srvPrvKey); err != nil {
-		handleErrorJSON(rw, http.StatusInternalServerError, err, "creating user", defaultUserErrorMsg)
+	if err = storage.UserCreate(b.Key, sealed); err != nil {
+		handleErrorJSON(rw, err, "creating user", defaultUserErrorMsg)
 		return
 	}
 
 	// Write
-	if err = json.NewEncoder(rw).Encode(asticrypt.BodyKey{Key: srvPrvKey.Public()}); err != nil {
-		handleErrorJSON(rw, http.StatusInternalServerError, err, "writing", defaultUserErrorMsg)
+	var c = asticrypt.LocalCapabilities()
+	if err = json.NewEncoder(rw).Encode(asticrypt.BodyKey{Capabilities: &c, Key: srvPrvKey.Public()}); err != nil {
+		handleErrorJSON(rw, err, "writing", defaultUserErrorMsg)
 		return
 	}
 }
 
-func handleErrorEncrypted(rw http.ResponseWriter, u *User, err error, msgDev, msgUser string) {
-	// Log
-	astilog.Error(errors.Wrap(err, msgDev+" failed"))
+// contextKey represents a context key
+type contextKey int
 
-	// Build body
-	var b asticrypt.BodyMessage
-	if b, err = asticrypt.NewBodyMessage(asticrypt.NameError, asticrypt.BodyError{Label: msgUser}, u.ServerPrivateKey, u.ServerPrivateKey.Public(), u.ClientPublicKey, time.Now()); err != nil {
-		handleErrorJSON(rw, http.StatusInternalServerError, err, "building body", msgUser)
-		return
-	}
+// Context keys
+const (
+	contextKeyUser contextKey = iota
+)
 
-	// Write
-	if err = json.NewEncoder(rw).Encode(b); err != nil {
-		handleErrorJSON(rw, http.StatusInternalServerError, err, "writing", msgUser)
-		return
-	}
+// userFromContext retrieves the user stored in the context by resolveKeys
+func userFromContext(ctx context.Context) *User {
+	u, _ := ctx.Value(contextKeyUser).(*User)
+	return u
 }
 
-func handleEncryptedMessages(rw http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	// Init
-	var userErrorMsg = "Communicating with server failed"
-
-	// Decode body
-	var b asticrypt.BodyMessage
-	var err error
-	if err = json.NewDecoder(r.Body).Decode(&b); err != nil {
-		handleErrorJSON(rw, http.StatusInternalServerError, err, "decoding body", userErrorMsg)
-		return
-	}
+// newEncryptedRouter builds the router handling encrypted messages
+func newEncryptedRouter() (r *asticrypt.Router) {
+	r = asticrypt.NewRouter(resolveKeys, asticrypt.RouterOptions{
+		MinProtocolVersion: configuration.MinProtocolVersion,
+		OnError: func(ctx context.Context, name string, err error) {
+			loggerFromContext(ctx).Error(errors.Wrapf(err, "routing %s failed", name))
+		},
+		ReplayCache: replayCache,
+		// Sessions are lost when the server restarts, clients then open new sessions
+		SessionStore: asticrypt.NewSessionStoreMemory(),
+		Validity:     configuration.MessageValidity.Duration,
+	})
+	asticrypt.Handle(r, asticrypt.NameAccountAdd, handleAccountAdd)
+	asticrypt.Handle(r, asticrypt.NameAccountFetch, handleAccountFetch)
+	asticrypt.Handle(r, asticrypt.NameAccountList, handleAccountList)
+	asticrypt.Handle(r, asticrypt.NamePrekeyBundleFetch, handlePrekeyBundleFetch)
+	asticrypt.Handle(r, asticrypt.NamePrekeyBundlePublish, handlePrekeyBundlePublish)
+	asticrypt.Handle(r, asticrypt.NameReferences, handleReferences)
+	return
+}
 
-	// Fetch user based on the key
+// resolveKeys fetches the user based on the key
+func resolveKeys(ctx context.Context, key *asticrypt.PublicKey) (ks asticrypt.RouterKeys, err error) {
+	// Fetch user
 	var u *User
-	if u, err = storage.UserFetchWithKey(b.Key); err != nil {
-		handleErrorJSON(rw, http.StatusInternalServerError, err, "decoding body", userErrorMsg)
+	if u, err = storage.UserFetchWithKey(key); err == errNotFound {
+		err = asticrypt.WithCode(asticrypt.ErrUnauthorized, errors.New("user not found"))
 		return
-	}
-
-	// Decrypt message
-	var m asticrypt.BodyMessageIn
-	if m, err = b.Decrypt(u.ServerPrivateKey, u.ClientPublicKey, time.Now()); err != nil {
-		handleErrorEncrypted(rw, u, err, "decrypting message", userErrorMsg)
+	} else if err != nil {
+		err = errors.Wrap(err, "fetching user failed")
 		return
 	}
 
-	// Switch on name
-	astilog.Debugf("m.Name is %s", m.Name)
-	var data interface{}
-	switch m.Name {
-	case asticrypt.NameAccountAdd:
-		data, userErrorMsg, err = handleAccountAdd(m.Payload, u)
-	case asticrypt.NameAccountFetch:
-		data, userErrorMsg, err = handleAccountFetch(m.Payload, u)
-	case asticrypt.NameAccountList:
-		data, userErrorMsg, err = handleAccountList(u)
-	case asticrypt.NameReferences:
-		data, userErrorMsg, err = handleReferences()
-	default:
-		err = errors.New("Unknown b.Name")
-	}
-
-	// Process error
-	if err != nil {
-		handleErrorEncrypted(rw, u, err, fmt.Sprintf("handling %s", m.Name), userErrorMsg)
+	// Open server private key
+	var k *asticrypt.PrivateKey
+	if k, err = openPrivateKey(keyProvider, u.ServerPrivateKey, u.ClientPublicKey); err != nil {
+		err = errors.Wrap(err, "opening server private key failed")
 		return
 	}
 
-	// Build body
-	if b, err = asticrypt.NewBodyMessage(m.Name, data, u.ServerPrivateKey, u.ServerPrivateKey.Public(), u.ClientPublicKey, time.Now()); err != nil {
-		handleErrorEncrypted(rw, u, err, "building body", userErrorMsg)
-		return
-	}
-
-	// Write
-	if err = json.NewEncoder(rw).Encode(b); err != nil {
-		handleErrorEncrypted(rw, u, err, "writing", userErrorMsg)
-		return
+	// Build keys
+	ks = asticrypt.RouterKeys{
+		Context:     context.WithValue(ctx, contextKeyUser, u),
+		PrivateKey:  k,
+		PublicKey:   u.ClientPublicKey,
+		ReplayScope: strconv.Itoa(u.ID),
 	}
+	return
 }
 
-func handleAccountAdd(payload json.RawMessage, u *User) (data interface{}, userErrorMsg string, err error) {
+func handleAccountAdd(ctx context.Context, account string) (data string, err error) {
 	// Init
-	userErrorMsg = "Adding account failed"
-
-	// Unmarshal payload
-	var account string
-	if err = json.Unmarshal(payload, &account); err != nil {
-		err = errors.Wrap(err, "unmarshaling failed")
-		return
-	}
+	var userErrorMsg = "Adding account failed"
+	defer func() {
+		if err != nil {
+			err = asticrypt.HandlerError{Err: err, Label: userErrorMsg}
+		}
+	}()
 
 	// Fetch user based on the account
 	if _, err = storage.UserFetchWithAccount(account); err != nil && err != errNotFound {
@@ -259,17 +290,17 @@ func handleAccountAdd(payload json.RawMessage, u *User) (data interface{}, userE
 	// Account already exists
 	if err == nil {
 		userErrorMsg = "Account is already associated to a user"
-		err = errors.New("Account already exists")
+		err = asticrypt.WithCode(asticrypt.ErrConflict, errors.New("account already exists"))
 		return
 	}
 
 	// Create account
 	var token string
-	if token, err = storage.AccountCreate(account, u); err != nil {
+	if token, err = storage.AccountCreate(account, userFromContext(ctx)); err != nil {
 		err = errors.Wrap(err, "creating account failed")
 		return
 	}
-	astilog.Debugf("Token is %s", token)
+	loggerFromContext(ctx).Debugf("Token is %s", token)
 
 	// TODO Send validation link
 
@@ -278,16 +309,14 @@ func handleAccountAdd(payload json.RawMessage, u *User) (data interface{}, userE
 	return
 }
 
-func handleAccountFetch(payload json.RawMessage, u *User) (data interface{}, userErrorMsg string, err error) {
+func handleAccountFetch(ctx context.Context, account string) (data interface{}, err error) {
 	// Init
-	userErrorMsg = "Fetching account failed"
-
-	// Unmarshal payload
-	var account string
-	if err = json.Unmarshal(payload, &account); err != nil {
-		err = errors.Wrap(err, "unmarshaling failed")
-		return
-	}
+	var userErrorMsg = "Fetching account failed"
+	defer func() {
+		if err != nil {
+			err = asticrypt.HandlerError{Err: err, Label: userErrorMsg}
+		}
+	}()
 
 	// Fetch user based on the account
 	if _, err = storage.UserFetchWithAccount(account); err != nil && err != errNotFound {
@@ -297,32 +326,106 @@ func handleAccountFetch(payload json.RawMessage, u *User) (data interface{}, use
 	return
 }
 
-func handleAccountList(u *User) (data interface{}, userErrorMsg string, err error) {
+func handleAccountList(ctx context.Context, _ interface{}) (data []string, err error) {
 	// Init
-	userErrorMsg = "Listing accounts failed"
+	var userErrorMsg = "Listing accounts failed"
+	defer func() {
+		if err != nil {
+			err = asticrypt.HandlerError{Err: err, Label: userErrorMsg}
+		}
+	}()
 
 	// List accounts
 	var es []*Account
-	if es, err = storage.AccountList(u); err != nil {
+	if es, err = storage.AccountList(userFromContext(ctx)); err != nil {
 		err = errors.Wrap(err, "listing account failed")
 		return
 	}
 
 	// Build data
-	var accounts = []string{}
+	data = []string{}
 	for _, e := range es {
-		accounts = append(accounts, e.Addr)
+		data = append(data, e.Addr)
+	}
+	return
+}
+
+func handlePrekeyBundleFetch(ctx context.Context, b asticrypt.BodyPrekeyBundleFetch) (data *asticrypt.PrekeyBundle, err error) {
+	// Init
+	var userErrorMsg = "Fetching prekey bundle failed"
+	defer func() {
+		if err != nil {
+			err = asticrypt.HandlerError{Err: err, Label: userErrorMsg}
+		}
+	}()
+
+	// Fetch user based on the account
+	var u *User
+	if u, err = storage.UserFetchWithAccount(b.Account); err != nil {
+		if err == errNotFound {
+			userErrorMsg = "Account doesn't exist"
+			err = asticrypt.WithCode(asticrypt.ErrNotFound, errors.New("account doesn't exist"))
+			return
+		}
+		err = errors.Wrap(err, "fetching user failed")
+		return
+	}
+
+	// Fetch prekey bundle
+	if data, err = storage.PrekeyBundleFetch(u); err != nil {
+		if err == errNotFound {
+			userErrorMsg = "User hasn't published a prekey bundle"
+			err = asticrypt.WithCode(asticrypt.ErrNotFound, errors.New("prekey bundle doesn't exist"))
+			return
+		}
+		err = errors.Wrap(err, "fetching prekey bundle failed")
+		return
 	}
-	data = accounts
 	return
 }
 
-func handleReferences() (data interface{}, userErrorMsg string, err error) {
+func handlePrekeyBundlePublish(ctx context.Context, b asticrypt.PrekeyBundle) (data interface{}, err error) {
 	// Init
-	userErrorMsg = "Getting references failed"
+	var userErrorMsg = "Publishing prekey bundle failed"
+	defer func() {
+		if err != nil {
+			err = asticrypt.HandlerError{Err: err, Label: userErrorMsg}
+		}
+	}()
+
+	// Check identity key
+	// Bundles must be signed by the key the user is authenticated with
+	var u = userFromContext(ctx)
+	if b.IdentityKey == nil || !bytes.Equal(b.IdentityKey.Fingerprint(), u.ClientPublicKey.Fingerprint()) {
+		err = asticrypt.WithCode(asticrypt.ErrBadRequest, errors.New("identity key doesn't match user key"))
+		return
+	}
+
+	// Verify bundle
+	if err = b.Verify(); err != nil {
+		err = asticrypt.WithCode(asticrypt.ErrBadRequest, errors.Wrap(err, "verifying bundle failed"))
+		return
+	}
+
+	// Publish prekey bundle
+	if err = storage.PrekeyBundlePublish(u, b); err != nil {
+		err = errors.Wrap(err, "publishing prekey bundle failed")
+		return
+	}
+	return
+}
+
+func handleReferences(ctx context.Context, c *asticrypt.BodyCapabilities) (data asticrypt.BodyReferences, err error) {
+	// Negotiate capabilities
+	// Legacy clients don't send their capabilities
+	var cs = asticrypt.LocalCapabilities()
+	if c != nil {
+		cs = cs.Negotiate(*c)
+	}
 
 	// Build data
 	data = asticrypt.BodyReferences{
+		Capabilities:       cs,
 		GoogleClientID:     configuration.GoogleClientID,
 		GoogleClientSecret: configuration.GoogleClientSecret,
 		Now:                time.Now(),
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+
+	"github.com/asticode/go-asticrypt"
+	"github.com/asticode/go-astilog"
+	"github.com/pkg/errors"
+)
+
+// dataKeySize is the size of the data keys server private keys are encrypted with
+const dataKeySize = 32
+
+// sealedPrivateKey represents a server private key encrypted at rest
+// The private key is encrypted with a data key which is wrapped by a key provider, therefore rotating the master key
+// only requires rewrapping data keys.
+type sealedPrivateKey struct {
+	Key         []byte `json:"key"`
+	KeyProvider string `json:"key_provider"`
+	Nonce       []byte `json:"nonce"`
+	WrappedKey  []byte `json:"wrapped_key"`
+}
+
+// parseSealedPrivateKey parses a stored server private key
+// Legacy server private keys were stored unencrypted, in which case ok is false
+func parseSealedPrivateKey(b []byte) (s sealedPrivateKey, ok bool, err error) {
+	// Legacy private keys are base64 encoded pems
+	if !bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		return
+	}
+
+	// Unmarshal
+	if err = json.Unmarshal(b, &s); err != nil {
+		err = errors.Wrap(err, "unmarshaling sealed private key failed")
+		return
+	}
+	ok = true
+	return
+}
+
+// newDataKeyAEAD creates the AEAD of a data key
+func newDataKeyAEAD(key []byte) (a cipher.AEAD, err error) {
+	// Check key
+	if len(key) != dataKeySize {
+		err = fmt.Errorf("data key size %d != %d", len(key), dataKeySize)
+		return
+	}
+
+	// Create AEAD
+	var b cipher.Block
+	if b, err = aes.NewCipher(key); err != nil {
+		err = errors.Wrap(err, "creating cipher failed")
+		return
+	}
+	if a, err = cipher.NewGCM(b); err != nil {
+		err = errors.Wrap(err, "creating gcm failed")
+		return
+	}
+	return
+}
+
+// sealPrivateKey encrypts a server private key with a new data key wrapped by the key provider
+// The private key is bound to the client public key so that it can't be swapped with the one of another user
+func sealPrivateKey(p KeyProvider, k *asticrypt.PrivateKey, cltPubKey *asticrypt.PublicKey) (o []byte, err error) {
+	// Generate data key
+	var key = make([]byte, dataKeySize)
+	if _, err = rand.Read(key); err != nil {
+		err = errors.Wrap(err, "generating data key failed")
+		return
+	}
+
+	// Create AEAD
+	var a cipher.AEAD
+	if a, err = newDataKeyAEAD(key); err != nil {
+		err = errors.Wrap(err, "creating AEAD failed")
+		return
+	}
+
+	// Generate nonce
+	var s = sealedPrivateKey{
+		KeyProvider: p.ID(),
+		Nonce:       make([]byte, a.NonceSize()),
+	}
+	if _, err = rand.Read(s.Nonce); err != nil {
+		err = errors.Wrap(err, "generating nonce failed")
+		return
+	}
+
+	// Seal
+	s.Key = a.Seal(nil, s.Nonce, []byte(k.String()), cltPubKey.Fingerprint())
+
+	// Wrap data key
+	if s.WrappedKey, err = p.WrapKey(key); err != nil {
+		err = errors.Wrap(err, "wrapping data key failed")
+		return
+	}
+
+	// Marshal
+	if o, err = json.Marshal(s); err != nil {
+		err = errors.Wrap(err, "marshaling sealed private key failed")
+		return
+	}
+	return
+}
+
+// openPrivateKey decrypts a server private key sealed by sealPrivateKey
+func openPrivateKey(p KeyProvider, b []byte, cltPubKey *asticrypt.PublicKey) (k *asticrypt.PrivateKey, err error) {
+	// Parse
+	var s sealedPrivateKey
+	var ok bool
+	if s, ok, err = parseSealedPrivateKey(b); err != nil {
+		err = errors.Wrap(err, "parsing sealed private key failed")
+		return
+	} else if !ok {
+		err = errors.New("server private key is not encrypted, db-rekey must be run")
+		return
+	}
+
+	// Check key provider
+	if s.KeyProvider != p.ID() {
+		err = fmt.Errorf("server private key has been sealed by key provider %s, not %s", s.KeyProvider, p.ID())
+		return
+	}
+
+	// Unwrap data key
+	var key []byte
+	if key, err = p.UnwrapKey(s.WrappedKey); err != nil {
+		err = errors.Wrap(err, "unwrapping data key failed")
+		return
+	}
+
+	// Create AEAD
+	var a cipher.AEAD
+	if a, err = newDataKeyAEAD(key); err != nil {
+		err = errors.Wrap(err, "creating AEAD failed")
+		return
+	}
+
+	// Check nonce
+	if len(s.Nonce) != a.NonceSize() {
+		err = fmt.Errorf("nonce size %d is invalid", len(s.Nonce))
+		return
+	}
+
+	// Open
+	var o []byte
+	if o, err = a.Open(nil, s.Nonce, s.Key, cltPubKey.Fingerprint()); err != nil {
+		err = errors.Wrap(err, "opening gcm failed")
+		return
+	}
+
+	// Unmarshal
+	k = &asticrypt.PrivateKey{}
+	if err = k.UnmarshalText(o); err != nil {
+		err = errors.Wrap(err, "unmarshaling private key failed")
+		return
+	}
+	return
+}
+
+// rekeyPrivateKey seals a server private key with a new key provider
+// Data keys wrapped by the old key provider are rewrapped, unencrypted legacy private keys are sealed. The old key
+// provider can be nil if only legacy private keys need to be sealed. The returned bytes are nil if the private key
+// is already sealed by the new key provider.
+func rekeyPrivateKey(oldP, newP KeyProvider, b []byte, cltPubKey *asticrypt.PublicKey) (o []byte, err error) {
+	// Parse
+	var s sealedPrivateKey
+	var ok bool
+	if s, ok, err = parseSealedPrivateKey(b); err != nil {
+		err = errors.Wrap(err, "parsing sealed private key failed")
+		return
+	}
+
+	// Legacy private key
+	if !ok {
+		// Unmarshal
+		var k = &asticrypt.PrivateKey{}
+		if err = k.UnmarshalText(b); err != nil {
+			err = errors.Wrap(err, "unmarshaling private key failed")
+			return
+		}
+
+		// Seal
+		if o, err = sealPrivateKey(newP, k, cltPubKey); err != nil {
+			err = errors.Wrap(err, "sealing private key failed")
+			return
+		}
+		return
+	}
+
+	// Private key is already sealed by the new key provider
+	if s.KeyProvider == newP.ID() {
+		return
+	}
+
+	// Check old key provider
+	if oldP == nil || s.KeyProvider != oldP.ID() {
+		err = fmt.Errorf("server private key has been sealed by unknown key provider %s", s.KeyProvider)
+		return
+	}
+
+	// Rewrap data key
+	var key []byte
+	if key, err = oldP.UnwrapKey(s.WrappedKey); err != nil {
+		err = errors.Wrap(err, "unwrapping data key failed")
+		return
+	}
+	if s.WrappedKey, err = newP.WrapKey(key); err != nil {
+		err = errors.Wrap(err, "wrapping data key failed")
+		return
+	}
+	s.KeyProvider = newP.ID()
+
+	// Marshal
+	if o, err = json.Marshal(s); err != nil {
+		err = errors.Wrap(err, "marshaling sealed private key failed")
+		return
+	}
+	return
+}
+
+// rekey seals the server private keys of all users with a new key provider
+// Users are updated one by one so that it can be resumed if it fails
+func rekey(oldP, newP KeyProvider) (n int, err error) {
+	// List users
+	var us []*User
+	if us, err = storage.UserList(); err != nil {
+		err = errors.Wrap(err, "listing users failed")
+		return
+	}
+
+	// Loop through users
+	for _, u := range us {
+		// Rekey
+		var b []byte
+		if b, err = rekeyPrivateKey(oldP, newP, u.ServerPrivateKey, u.ClientPublicKey); err != nil {
+			err = errors.Wrapf(err, "rekeying server private key of user %d failed", u.ID)
+			return
+		} else if b == nil {
+			continue
+		}
+
+		// Update
+		astilog.Debugf("Rekeying server private key of user %d", u.ID)
+		if err = storage.UserUpdate(u, u.ClientPublicKey, b); err != nil {
+			err = errors.Wrapf(err, "updating user %d failed", u.ID)
+			return
+		}
+		n++
+	}
+	return
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/asticode/go-asticrypt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMasterKey(t *testing.T) {
+	// Init
+	var k = make([]byte, masterKeySize)
+	_, err := rand.Read(k)
+	require.NoError(t, err)
+	var s = base64.StdEncoding.EncodeToString(k)
+
+	// No master key
+	_, err = loadMasterKey(MasterKeyConfiguration{Env: "ASTICRYPT_TEST_UNSET_MASTER_KEY"})
+	assert.Equal(t, errNoMasterKey, err)
+
+	// Configuration
+	k2, err := loadMasterKey(MasterKeyConfiguration{Key: s})
+	require.NoError(t, err)
+	assert.Equal(t, k, k2)
+
+	// File
+	var p = filepath.Join(t.TempDir(), "master.key")
+	require.NoError(t, os.WriteFile(p, []byte(s+"\n"), 0600))
+	k2, err = loadMasterKey(MasterKeyConfiguration{Key: "invalid", Path: p})
+	require.NoError(t, err)
+	assert.Equal(t, k, k2)
+
+	// Env
+	t.Setenv("ASTICRYPT_TEST_MASTER_KEY", s)
+	k2, err = loadMasterKey(MasterKeyConfiguration{Env: "ASTICRYPT_TEST_MASTER_KEY"})
+	require.NoError(t, err)
+	assert.Equal(t, k, k2)
+
+	// Invalid size
+	_, err = newKeyProviderLocal(k[:16])
+	assert.Error(t, err)
+}
+
+func TestServerPrivateKey(t *testing.T) {
+	// Init
+	var newKeyProvider = func() KeyProvider {
+		var k = make([]byte, masterKeySize)
+		_, err := rand.Read(k)
+		require.NoError(t, err)
+		p, err := newKeyProviderLocal(k)
+		require.NoError(t, err)
+		return p
+	}
+	var p1, p2 = newKeyProvider(), newKeyProvider()
+	clt1, err := asticrypt.GeneratePrivateKeyWithType(asticrypt.KeyTypeEd25519, "")
+	require.NoError(t, err)
+	clt2, err := asticrypt.GeneratePrivateKeyWithType(asticrypt.KeyTypeEd25519, "")
+	require.NoError(t, err)
+	srv, err := asticrypt.GeneratePrivateKeyWithType(asticrypt.KeyTypeEd25519, "")
+	require.NoError(t, err)
+
+	// Seal
+	b, err := sealPrivateKey(p1, srv, clt1.Public())
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(b, []byte(srv.String())))
+
+	// Open
+	k, err := openPrivateKey(p1, b, clt1.Public())
+	require.NoError(t, err)
+	assert.Equal(t, srv.String(), k.String())
+
+	// The private key is bound to the client public key and the key provider
+	_, err = openPrivateKey(p1, b, clt2.Public())
+	assert.Error(t, err)
+	_, err = openPrivateKey(p2, b, clt1.Public())
+	assert.Error(t, err)
+
+	// Legacy private keys must be rekeyed first
+	_, err = openPrivateKey(p1, []byte(srv.String()), clt1.Public())
+	assert.Error(t, err)
+
+	// Rekey
+	b2, err := rekeyPrivateKey(p1, p2, b, clt1.Public())
+	require.NoError(t, err)
+	k, err = openPrivateKey(p2, b2, clt1.Public())
+	require.NoError(t, err)
+	assert.Equal(t, srv.String(), k.String())
+	_, err = openPrivateKey(p1, b2, clt1.Public())
+	assert.Error(t, err)
+
+	// Private keys already sealed by the new key provider are left untouched
+	b3, err := rekeyPrivateKey(p1, p2, b2, clt1.Public())
+	require.NoError(t, err)
+	assert.Nil(t, b3)
+
+	// Private keys sealed by an unknown key provider can't be rekeyed
+	_, err = rekeyPrivateKey(nil, p2, b, clt1.Public())
+	assert.Error(t, err)
+
+	// Legacy private keys are sealed
+	b3, err = rekeyPrivateKey(nil, p2, []byte(srv.String()), clt1.Public())
+	require.NoError(t, err)
+	k, err = openPrivateKey(p2, b3, clt1.Public())
+	require.NoError(t, err)
+	assert.Equal(t, srv.String(), k.String())
+}
+
+func TestRekey(t *testing.T) {
+	// Init
+	var mk1, mk2 = make([]byte, masterKeySize), make([]byte, masterKeySize)
+	mk2[0] = 1
+	p1, err := newKeyProviderLocal(mk1)
+	require.NoError(t, err)
+	p2, err := newKeyProviderLocal(mk2)
+	require.NoError(t, err)
+	storage = newStorageMemory()
+	defer func() { storage = nil }()
+
+	// Create users
+	var clts []*asticrypt.PrivateKey
+	for idx := 0; idx < 2; idx++ {
+		clt, err := asticrypt.GeneratePrivateKeyWithType(asticrypt.KeyTypeEd25519, "")
+		require.NoError(t, err)
+		srv, err := asticrypt.GeneratePrivateKeyWithType(asticrypt.KeyTypeEd25519, "")
+		require.NoError(t, err)
+		var b = []byte(srv.String())
+		if idx == 0 {
+			b, err = sealPrivateKey(p1, srv, clt.Public())
+			require.NoError(t, err)
+		}
+		require.NoError(t, storage.UserCreate(clt.Public(), b))
+		clts = append(clts, clt)
+	}
+
+	// Rekey
+	n, err := rekey(p1, p2)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	for _, clt := range clts {
+		u, err := storage.UserFetchWithKey(clt.Public())
+		require.NoError(t, err)
+		_, err = openPrivateKey(p2, u.ServerPrivateKey, clt.Public())
+		assert.NoError(t, err)
+	}
+
+	// Rekeying again is a no-op
+	n, err = rekey(p1, p2)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
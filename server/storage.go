@@ -2,45 +2,141 @@ package main
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/asticode/go-asticrypt"
 	"github.com/asticode/go-astilog"
 	"github.com/asticode/go-astitools/string"
-	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 )
 
+// Storage types
+const (
+	storageTypeMemory   = "memory"
+	storageTypeMySQL    = "mysql"
+	storageTypePostgres = "postgres"
+	storageTypeSQLite   = "sqlite"
+)
+
 // Vars
 var (
 	errNotFound = errors.New("not.found")
 	storage     Storage
 )
 
+// nullTimeLayouts are the layouts of times scanned as text
+// The MySQL driver returns DATETIME values as text unless parseTime=true is set in the DSN
+var nullTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	time.RFC3339Nano,
+}
+
+// nullTime represents a nullable time that can be scanned by all SQL storages
+type nullTime struct {
+	Time  time.Time
+	Valid bool
+}
+
+// newNullTime creates a valid null time
+func newNullTime(t time.Time) nullTime {
+	return nullTime{Time: t, Valid: true}
+}
+
+// Scan implements the sql.Scanner interface
+func (t *nullTime) Scan(v interface{}) (err error) {
+	// Init
+	*t = nullTime{}
+
+	// Switch on type
+	var s string
+	switch v := v.(type) {
+	case nil:
+		return
+	case time.Time:
+		*t = newNullTime(v)
+		return
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	default:
+		err = fmt.Errorf("scanning %T into a time is not supported", v)
+		return
+	}
+
+	// Zero dates are null
+	if len(s) == 0 || strings.HasPrefix(s, "0000-00-00") {
+		return
+	}
+
+	// Parse
+	for _, l := range nullTimeLayouts {
+		var tm time.Time
+		if tm, err = time.ParseInLocation(l, s, time.UTC); err == nil {
+			*t = newNullTime(tm)
+			return
+		}
+	}
+	err = fmt.Errorf("time %s is invalid", s)
+	return
+}
+
+// Value implements the driver.Valuer interface
+func (t nullTime) Value() (driver.Value, error) {
+	if !t.Valid {
+		return nil, nil
+	}
+	return t.Time, nil
+}
+
 // Base represents a base model
+// Times are portable nullable types so that models can be shared by all SQL storages
 type Base struct {
-	CreatedAt mysql.NullTime `db:"created_at"`
-	UpdatedAt mysql.NullTime `db:"updated_at"`
+	CreatedAt nullTime `db:"created_at"`
+	UpdatedAt nullTime `db:"updated_at"`
 }
 
 // Account represents an account
 type Account struct {
 	Base
-	Addr            string         `db:"addr"`
+	Addr            string   `db:"addr"`
+	ID              int      `db:"id"`
+	Token           string   `db:"token"`
+	UserID          int      `db:"user_id"`
+	ValidatedAt     nullTime `db:"validated_at"`
+	ValidationToken string   `db:"validation_token"`
+}
+
+// Prekey represents a prekey published by a user
+// Signed prekeys have a signature, one-time prekeys are deleted once fetched
+type Prekey struct {
+	CreatedAt       nullTime       `db:"created_at"`
 	ID              int            `db:"id"`
-	Token           string         `db:"token"`
+	Key             []byte         `db:"key"`
+	PrekeyID        string         `db:"prekey_id"`
+	Signature       []byte         `db:"signature"`
+	SignatureScheme sql.NullString `db:"signature_scheme"`
 	UserID          int            `db:"user_id"`
-	ValidatedAt     mysql.NullTime `db:"validated_at"`
-	ValidationToken string         `db:"validation_token"`
+}
+
+// newNullString creates a null string that is null when empty
+func newNullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: len(s) > 0}
 }
 
 // User represents a user
 type User struct {
 	Base
-	ClientPublicKey     *asticrypt.PublicKey  `db:"client_public_key"`
-	ClientPublicKeyHash []byte                `db:"client_public_key_hash"`
-	ID                  int                   `db:"id"`
-	ServerPrivateKey    *asticrypt.PrivateKey `db:"server_private_key"`
+	ClientPublicKey            *asticrypt.PublicKey `db:"client_public_key"`
+	ClientPublicKeyFingerprint []byte               `db:"client_public_key_fingerprint"`
+	ClientPublicKeyHash        []byte               `db:"client_public_key_hash"`
+	ID                         int                  `db:"id"`
+	// Server private key sealed with the key provider
+	ServerPrivateKey []byte `db:"server_private_key"`
 }
 
 // Storage represents a storage
@@ -49,10 +145,13 @@ type Storage interface {
 	AccountFetchWithValidationToken(token string) (e *Account, err error)
 	AccountList(u *User) (e []*Account, err error)
 	AccountValidate(e *Account) (err error)
-	UserCreate(cltPubKey *asticrypt.PublicKey, srvPrvKey *asticrypt.PrivateKey) error
+	PrekeyBundleFetch(u *User) (b *asticrypt.PrekeyBundle, err error)
+	PrekeyBundlePublish(u *User, b asticrypt.PrekeyBundle) (err error)
+	UserCreate(cltPubKey *asticrypt.PublicKey, srvPrvKey []byte) error
 	UserFetchWithAccount(account string) (*User, error)
 	UserFetchWithKey(key *asticrypt.PublicKey) (*User, error)
-	UserUpdate(u *User, cltPubKey *asticrypt.PublicKey, srvPrvKey *asticrypt.PrivateKey) error
+	UserList() ([]*User, error)
+	UserUpdate(u *User, cltPubKey *asticrypt.PublicKey, srvPrvKey []byte) error
 }
 
 // storageMySQL represents a MySQL storage
@@ -98,10 +197,107 @@ func (s *storageMySQL) AccountValidate(e *Account) (err error) {
 	return
 }
 
+// PrekeyBundleFetch fetches the prekey bundle of a user and consumes one of its one-time prekeys
+func (s *storageMySQL) PrekeyBundleFetch(u *User) (b *asticrypt.PrekeyBundle, err error) {
+	astilog.Debug("Fetching prekey bundle")
+
+	// Begin transaction
+	var tx *sqlx.Tx
+	if tx, err = s.db.Beginx(); err != nil {
+		err = errors.Wrap(err, "beginning transaction failed")
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// Fetch signed prekey
+	var p Prekey
+	if err = tx.Get(&p, "SELECT * FROM prekey WHERE user_id = ? AND signature IS NOT NULL ORDER BY id DESC LIMIT 1", u.ID); err == sql.ErrNoRows {
+		err = errNotFound
+		return
+	} else if err != nil {
+		err = errors.Wrap(err, "fetching signed prekey failed")
+		return
+	}
+	b = &asticrypt.PrekeyBundle{
+		IdentityKey:           u.ClientPublicKey,
+		SignatureScheme:       p.SignatureScheme.String,
+		SignedPrekey:          asticrypt.Prekey{ID: p.PrekeyID, Key: p.Key},
+		SignedPrekeySignature: p.Signature,
+	}
+
+	// Fetch one-time prekey
+	// Bundles without one-time prekeys are still valid once they've all been consumed
+	p = Prekey{}
+	if errGet := tx.Get(&p, "SELECT * FROM prekey WHERE user_id = ? AND signature IS NULL ORDER BY id ASC LIMIT 1 FOR UPDATE", u.ID); errGet == nil {
+		// Consume one-time prekey
+		if _, err = tx.Exec("DELETE FROM prekey WHERE id = ?", p.ID); err != nil {
+			err = errors.Wrap(err, "deleting one-time prekey failed")
+			return
+		}
+		b.OneTimePrekeys = []asticrypt.Prekey{{ID: p.PrekeyID, Key: p.Key}}
+	} else if errGet != sql.ErrNoRows {
+		err = errors.Wrap(errGet, "fetching one-time prekey failed")
+		return
+	}
+
+	// Commit
+	if err = tx.Commit(); err != nil {
+		err = errors.Wrap(err, "committing transaction failed")
+		return
+	}
+	return
+}
+
+// PrekeyBundlePublish replaces the signed prekey of a user and adds its one-time prekeys
+func (s *storageMySQL) PrekeyBundlePublish(u *User, b asticrypt.PrekeyBundle) (err error) {
+	astilog.Debug("Publishing prekey bundle")
+
+	// Begin transaction
+	var tx *sqlx.Tx
+	if tx, err = s.db.Beginx(); err != nil {
+		err = errors.Wrap(err, "beginning transaction failed")
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// Replace signed prekey
+	if _, err = tx.Exec("DELETE FROM prekey WHERE user_id = ? AND signature IS NOT NULL", u.ID); err != nil {
+		err = errors.Wrap(err, "deleting signed prekey failed")
+		return
+	}
+	if _, err = tx.Exec("INSERT INTO prekey (user_id, prekey_id, `key`, signature, signature_scheme) VALUES (?, ?, ?, ?, ?)", u.ID, b.SignedPrekey.ID, b.SignedPrekey.Key, b.SignedPrekeySignature, b.SignatureScheme); err != nil {
+		err = errors.Wrap(err, "inserting signed prekey failed")
+		return
+	}
+
+	// Add one-time prekeys
+	for _, p := range b.OneTimePrekeys {
+		if _, err = tx.Exec("INSERT INTO prekey (user_id, prekey_id, `key`) VALUES (?, ?, ?)", u.ID, p.ID, p.Key); err != nil {
+			err = errors.Wrap(err, "inserting one-time prekey failed")
+			return
+		}
+	}
+
+	// Commit
+	if err = tx.Commit(); err != nil {
+		err = errors.Wrap(err, "committing transaction failed")
+		return
+	}
+	return
+}
+
 // UserCreate creates a user
-func (s *storageMySQL) UserCreate(cltPubKey *asticrypt.PublicKey, srvPrvKey *asticrypt.PrivateKey) (err error) {
+func (s *storageMySQL) UserCreate(cltPubKey *asticrypt.PublicKey, srvPrvKey []byte) (err error) {
 	astilog.Debug("Creating new user")
-	_, err = s.db.Exec("INSERT INTO user (client_public_key_hash, client_public_key, server_private_key) VALUES (?, ?, ?)", cltPubKey.Hash(), cltPubKey.String(), srvPrvKey.String())
+	_, err = s.db.Exec("INSERT INTO user (client_public_key_fingerprint, client_public_key_hash, client_public_key, server_private_key) VALUES (?, ?, ?, ?)", cltPubKey.Fingerprint(), cltPubKey.Hash(), cltPubKey.String(), srvPrvKey)
 	return
 }
 
@@ -119,15 +315,23 @@ func (s *storageMySQL) UserFetchWithAccount(account string) (u *User, err error)
 func (s *storageMySQL) UserFetchWithKey(key *asticrypt.PublicKey) (u *User, err error) {
 	astilog.Debug("Fetching user with key")
 	u = &User{}
-	if err = s.db.Get(u, "SELECT * FROM user WHERE client_public_key_hash = ? LIMIT 1", key.Hash()); err == sql.ErrNoRows {
+	if err = s.db.Get(u, "SELECT * FROM user WHERE client_public_key_fingerprint = ? LIMIT 1", key.Fingerprint()); err == sql.ErrNoRows {
 		err = errNotFound
 	}
 	return
 }
 
+// UserList lists all users
+func (s *storageMySQL) UserList() (us []*User, err error) {
+	astilog.Debug("Listing users")
+	us = []*User{}
+	err = s.db.Select(&us, "SELECT * FROM user ORDER BY id ASC")
+	return
+}
+
 // UserUpdate updates a user
-func (s *storageMySQL) UserUpdate(u *User, cltPubKey *asticrypt.PublicKey, srvPrvKey *asticrypt.PrivateKey) (err error) {
+func (s *storageMySQL) UserUpdate(u *User, cltPubKey *asticrypt.PublicKey, srvPrvKey []byte) (err error) {
 	astilog.Debug("Updating user")
-	_, err = s.db.Exec("UPDATE user SET client_public_key = ?, server_private_key = ? WHERE id = ?", cltPubKey.String(), srvPrvKey.String(), u.ID)
+	_, err = s.db.Exec("UPDATE user SET client_public_key_fingerprint = ?, client_public_key_hash = ?, client_public_key = ?, server_private_key = ? WHERE id = ?", cltPubKey.Fingerprint(), cltPubKey.Hash(), cltPubKey.String(), srvPrvKey, u.ID)
 	return
 }
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/asticode/go-asticrypt"
+	"github.com/asticode/go-astilog"
+	"github.com/asticode/go-astitools/string"
+)
+
+// storageMemory represents an in-memory storage
+// Data is lost when the process restarts, it's meant for tests and demos
+type storageMemory struct {
+	accounts []*Account
+	m        *sync.Mutex
+	prekeys  []*Prekey
+	seq      int
+	users    []*User
+}
+
+// newStorageMemory builds a new in-memory storage
+func newStorageMemory() *storageMemory {
+	return &storageMemory{m: &sync.Mutex{}}
+}
+
+// now returns the current time as stored in models
+func (s *storageMemory) now() nullTime {
+	return newNullTime(time.Now().UTC())
+}
+
+// nextID returns the next ID
+func (s *storageMemory) nextID() int {
+	s.seq++
+	return s.seq
+}
+
+// AccountCreate creates an account
+func (s *storageMemory) AccountCreate(account string, u *User) (token string, err error) {
+	astilog.Debug("Creating new account")
+	s.m.Lock()
+	defer s.m.Unlock()
+	token = astistring.RandomString(100)
+
+	// Account already exists
+	for _, e := range s.accounts {
+		if e.Addr == account {
+			e.UpdatedAt = s.now()
+			e.ValidationToken = token
+			return
+		}
+	}
+
+	// Create account
+	s.accounts = append(s.accounts, &Account{
+		Addr:            account,
+		Base:            Base{CreatedAt: s.now(), UpdatedAt: s.now()},
+		ID:              s.nextID(),
+		UserID:          u.ID,
+		ValidationToken: token,
+	})
+	return
+}
+
+// AccountFetchWithValidationToken fetches an account based on a validation token
+func (s *storageMemory) AccountFetchWithValidationToken(token string) (e *Account, err error) {
+	astilog.Debug("Fetching account with validation token")
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, v := range s.accounts {
+		if v.ValidationToken == token && !v.ValidatedAt.Valid {
+			c := *v
+			e = &c
+			return
+		}
+	}
+	err = errNotFound
+	return
+}
+
+// AccountList lists the accounts of a user
+func (s *storageMemory) AccountList(u *User) (e []*Account, err error) {
+	astilog.Debug("Listing accounts")
+	s.m.Lock()
+	defer s.m.Unlock()
+	e = []*Account{}
+	for _, v := range s.accounts {
+		if v.UserID == u.ID && v.ValidatedAt.Valid {
+			c := *v
+			e = append(e, &c)
+		}
+	}
+	return
+}
+
+// AccountValidate validates an account
+func (s *storageMemory) AccountValidate(e *Account) (err error) {
+	astilog.Debug("Validating account")
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, v := range s.accounts {
+		if v.ID == e.ID {
+			v.UpdatedAt = s.now()
+			v.ValidatedAt = s.now()
+		}
+	}
+	return
+}
+
+// PrekeyBundleFetch fetches the prekey bundle of a user and consumes one of its one-time prekeys
+func (s *storageMemory) PrekeyBundleFetch(u *User) (b *asticrypt.PrekeyBundle, err error) {
+	astilog.Debug("Fetching prekey bundle")
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	// Fetch signed prekey
+	for _, p := range s.prekeys {
+		if p.UserID == u.ID && p.Signature != nil {
+			b = &asticrypt.PrekeyBundle{
+				IdentityKey:           u.ClientPublicKey,
+				SignatureScheme:       p.SignatureScheme.String,
+				SignedPrekey:          asticrypt.Prekey{ID: p.PrekeyID, Key: p.Key},
+				SignedPrekeySignature: p.Signature,
+			}
+		}
+	}
+	if b == nil {
+		err = errNotFound
+		return
+	}
+
+	// Consume one-time prekey
+	for idx, p := range s.prekeys {
+		if p.UserID == u.ID && p.Signature == nil {
+			b.OneTimePrekeys = []asticrypt.Prekey{{ID: p.PrekeyID, Key: p.Key}}
+			s.prekeys = append(s.prekeys[:idx], s.prekeys[idx+1:]...)
+			break
+		}
+	}
+	return
+}
+
+// PrekeyBundlePublish replaces the signed prekey of a user and adds its one-time prekeys
+func (s *storageMemory) PrekeyBundlePublish(u *User, b asticrypt.PrekeyBundle) (err error) {
+	astilog.Debug("Publishing prekey bundle")
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	// Check prekey IDs
+	var ids = map[string]bool{b.SignedPrekey.ID: true}
+	for _, p := range s.prekeys {
+		if p.UserID == u.ID && p.Signature == nil {
+			ids[p.PrekeyID] = true
+		}
+	}
+	for _, p := range b.OneTimePrekeys {
+		if ids[p.ID] {
+			err = fmt.Errorf("prekey %s already exists", p.ID)
+			return
+		}
+		ids[p.ID] = true
+	}
+
+	// Replace signed prekey
+	var ps []*Prekey
+	for _, p := range s.prekeys {
+		if p.UserID != u.ID || p.Signature == nil {
+			ps = append(ps, p)
+		}
+	}
+	s.prekeys = append(ps, &Prekey{
+		CreatedAt:       s.now(),
+		ID:              s.nextID(),
+		Key:             b.SignedPrekey.Key,
+		PrekeyID:        b.SignedPrekey.ID,
+		Signature:       b.SignedPrekeySignature,
+		SignatureScheme: newNullString(b.SignatureScheme),
+		UserID:          u.ID,
+	})
+
+	// Add one-time prekeys
+	for _, p := range b.OneTimePrekeys {
+		s.prekeys = append(s.prekeys, &Prekey{
+			CreatedAt: s.now(),
+			ID:        s.nextID(),
+			Key:       p.Key,
+			PrekeyID:  p.ID,
+			UserID:    u.ID,
+		})
+	}
+	return
+}
+
+// UserCreate creates a user
+func (s *storageMemory) UserCreate(cltPubKey *asticrypt.PublicKey, srvPrvKey []byte) (err error) {
+	astilog.Debug("Creating new user")
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	// User already exists
+	if s.userWithKey(cltPubKey) != nil {
+		err = fmt.Errorf("user with key %x already exists", cltPubKey.Fingerprint())
+		return
+	}
+
+	// Create user
+	s.users = append(s.users, &User{
+		Base:                       Base{CreatedAt: s.now(), UpdatedAt: s.now()},
+		ClientPublicKey:            cltPubKey,
+		ClientPublicKeyFingerprint: cltPubKey.Fingerprint(),
+		ClientPublicKeyHash:        cltPubKey.Hash(),
+		ID:                         s.nextID(),
+		ServerPrivateKey:           srvPrvKey,
+	})
+	return
+}
+
+// userWithKey returns the user matching a key
+func (s *storageMemory) userWithKey(key *asticrypt.PublicKey) *User {
+	for _, u := range s.users {
+		if bytes.Equal(u.ClientPublicKeyFingerprint, key.Fingerprint()) {
+			return u
+		}
+	}
+	return nil
+}
+
+// UserFetchWithAccount fetches a user based on an account
+func (s *storageMemory) UserFetchWithAccount(account string) (u *User, err error) {
+	astilog.Debug("Fetching user with account")
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, e := range s.accounts {
+		if e.Addr == account && e.ValidatedAt.Valid {
+			for _, v := range s.users {
+				if v.ID == e.UserID {
+					c := *v
+					u = &c
+					return
+				}
+			}
+		}
+	}
+	err = errNotFound
+	return
+}
+
+// UserFetchWithKey fetches a user based on a key
+func (s *storageMemory) UserFetchWithKey(key *asticrypt.PublicKey) (u *User, err error) {
+	astilog.Debug("Fetching user with key")
+	s.m.Lock()
+	defer s.m.Unlock()
+	if v := s.userWithKey(key); v != nil {
+		c := *v
+		u = &c
+		return
+	}
+	err = errNotFound
+	return
+}
+
+// UserList lists all users
+func (s *storageMemory) UserList() (us []*User, err error) {
+	astilog.Debug("Listing users")
+	s.m.Lock()
+	defer s.m.Unlock()
+	us = []*User{}
+	for _, v := range s.users {
+		c := *v
+		us = append(us, &c)
+	}
+	return
+}
+
+// UserUpdate updates a user
+func (s *storageMemory) UserUpdate(u *User, cltPubKey *asticrypt.PublicKey, srvPrvKey []byte) (err error) {
+	astilog.Debug("Updating user")
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, v := range s.users {
+		if v.ID == u.ID {
+			v.ClientPublicKey = cltPubKey
+			v.ClientPublicKeyFingerprint = cltPubKey.Fingerprint()
+			v.ClientPublicKeyHash = cltPubKey.Hash()
+			v.ServerPrivateKey = srvPrvKey
+			v.UpdatedAt = s.now()
+		}
+	}
+	return
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+
+	"github.com/asticode/go-asticrypt"
+	"github.com/asticode/go-astilog"
+	"github.com/asticode/go-astitools/string"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// PostgresConfiguration represents the PostgreSQL configuration
+type PostgresConfiguration struct {
+	DSN string `toml:"dsn"`
+}
+
+// newPostgres opens a PostgreSQL db
+// Contrary to SQLite, its schema is managed with the patches located in resources/patches_postgres
+func newPostgres(c PostgresConfiguration) (db *sqlx.DB, err error) {
+	// Open
+	if db, err = sqlx.Open("postgres", c.DSN); err != nil {
+		err = errors.Wrap(err, "opening db failed")
+		return
+	}
+
+	// Ping
+	if err = db.Ping(); err != nil {
+		err = errors.Wrap(err, "pinging db failed")
+		return
+	}
+	return
+}
+
+// storagePostgres represents a PostgreSQL storage
+type storagePostgres struct {
+	db *sqlx.DB
+}
+
+// newStoragePostgres builds a new PostgreSQL storage
+func newStoragePostgres(db *sqlx.DB) *storagePostgres {
+	return &storagePostgres{db: db}
+}
+
+// AccountCreate creates an account
+func (s *storagePostgres) AccountCreate(account string, u *User) (token string, err error) {
+	astilog.Debug("Creating new account")
+	token = astistring.RandomString(100)
+	_, err = s.db.Exec("INSERT INTO account (addr, user_id, validation_token) VALUES ($1, $2, $3) ON CONFLICT (addr) DO UPDATE SET validation_token = EXCLUDED.validation_token, updated_at = NOW()", account, u.ID, token)
+	return
+}
+
+// AccountFetchWithValidationToken fetches an account based on a validation token
+func (s *storagePostgres) AccountFetchWithValidationToken(token string) (e *Account, err error) {
+	astilog.Debug("Fetching account with validation token")
+	e = &Account{}
+	if err = s.db.Get(e, "SELECT * FROM account WHERE validation_token = $1 AND validated_at IS NULL LIMIT 1", token); err == sql.ErrNoRows {
+		err = errNotFound
+	}
+	return
+}
+
+// AccountList lists the accounts of a user
+func (s *storagePostgres) AccountList(u *User) (e []*Account, err error) {
+	astilog.Debug("Listing accounts")
+	e = []*Account{}
+	err = s.db.Select(&e, "SELECT * FROM account WHERE user_id = $1 AND validated_at IS NOT NULL", u.ID)
+	return
+}
+
+// AccountValidate validates an account
+func (s *storagePostgres) AccountValidate(e *Account) (err error) {
+	astilog.Debug("Validating account")
+	_, err = s.db.Exec("UPDATE account SET validated_at = NOW(), updated_at = NOW() WHERE id = $1", e.ID)
+	return
+}
+
+// PrekeyBundleFetch fetches the prekey bundle of a user and consumes one of its one-time prekeys
+func (s *storagePostgres) PrekeyBundleFetch(u *User) (b *asticrypt.PrekeyBundle, err error) {
+	astilog.Debug("Fetching prekey bundle")
+
+	// Begin transaction
+	var tx *sqlx.Tx
+	if tx, err = s.db.Beginx(); err != nil {
+		err = errors.Wrap(err, "beginning transaction failed")
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// Fetch signed prekey
+	var p Prekey
+	if err = tx.Get(&p, "SELECT * FROM prekey WHERE user_id = $1 AND signature IS NOT NULL ORDER BY id DESC LIMIT 1", u.ID); err == sql.ErrNoRows {
+		err = errNotFound
+		return
+	} else if err != nil {
+		err = errors.Wrap(err, "fetching signed prekey failed")
+		return
+	}
+	b = &asticrypt.PrekeyBundle{
+		IdentityKey:           u.ClientPublicKey,
+		SignatureScheme:       p.SignatureScheme.String,
+		SignedPrekey:          asticrypt.Prekey{ID: p.PrekeyID, Key: p.Key},
+		SignedPrekeySignature: p.Signature,
+	}
+
+	// Fetch one-time prekey
+	// Bundles without one-time prekeys are still valid once they've all been consumed
+	p = Prekey{}
+	if errGet := tx.Get(&p, "SELECT * FROM prekey WHERE user_id = $1 AND signature IS NULL ORDER BY id ASC LIMIT 1 FOR UPDATE", u.ID); errGet == nil {
+		// Consume one-time prekey
+		if _, err = tx.Exec("DELETE FROM prekey WHERE id = $1", p.ID); err != nil {
+			err = errors.Wrap(err, "deleting one-time prekey failed")
+			return
+		}
+		b.OneTimePrekeys = []asticrypt.Prekey{{ID: p.PrekeyID, Key: p.Key}}
+	} else if errGet != sql.ErrNoRows {
+		err = errors.Wrap(errGet, "fetching one-time prekey failed")
+		return
+	}
+
+	// Commit
+	if err = tx.Commit(); err != nil {
+		err = errors.Wrap(err, "committing transaction failed")
+		return
+	}
+	return
+}
+
+// PrekeyBundlePublish replaces the signed prekey of a user and adds its one-time prekeys
+func (s *storagePostgres) PrekeyBundlePublish(u *User, b asticrypt.PrekeyBundle) (err error) {
+	astilog.Debug("Publishing prekey bundle")
+
+	// Begin transaction
+	var tx *sqlx.Tx
+	if tx, err = s.db.Beginx(); err != nil {
+		err = errors.Wrap(err, "beginning transaction failed")
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// Replace signed prekey
+	if _, err = tx.Exec("DELETE FROM prekey WHERE user_id = $1 AND signature IS NOT NULL", u.ID); err != nil {
+		err = errors.Wrap(err, "deleting signed prekey failed")
+		return
+	}
+	if _, err = tx.Exec("INSERT INTO prekey (user_id, prekey_id, key, signature, signature_scheme) VALUES ($1, $2, $3, $4, $5)", u.ID, b.SignedPrekey.ID, b.SignedPrekey.Key, b.SignedPrekeySignature, b.SignatureScheme); err != nil {
+		err = errors.Wrap(err, "inserting signed prekey failed")
+		return
+	}
+
+	// Add one-time prekeys
+	for _, p := range b.OneTimePrekeys {
+		if _, err = tx.Exec("INSERT INTO prekey (user_id, prekey_id, key) VALUES ($1, $2, $3)", u.ID, p.ID, p.Key); err != nil {
+			err = errors.Wrap(err, "inserting one-time prekey failed")
+			return
+		}
+	}
+
+	// Commit
+	if err = tx.Commit(); err != nil {
+		err = errors.Wrap(err, "committing transaction failed")
+		return
+	}
+	return
+}
+
+// UserCreate creates a user
+// Public keys are stored as bytea since they can only be scanned from []byte
+func (s *storagePostgres) UserCreate(cltPubKey *asticrypt.PublicKey, srvPrvKey []byte) (err error) {
+	astilog.Debug("Creating new user")
+	_, err = s.db.Exec(`INSERT INTO "user" (client_public_key_fingerprint, client_public_key_hash, client_public_key, server_private_key) VALUES ($1, $2, $3, $4)`, cltPubKey.Fingerprint(), cltPubKey.Hash(), []byte(cltPubKey.String()), srvPrvKey)
+	return
+}
+
+// UserFetchWithAccount fetches a user based on an account
+func (s *storagePostgres) UserFetchWithAccount(account string) (u *User, err error) {
+	astilog.Debug("Fetching user with account")
+	u = &User{}
+	if err = s.db.Get(u, `SELECT u.* FROM "user" u INNER JOIN account e ON u.id = e.user_id WHERE e.addr = $1 AND validated_at IS NOT NULL LIMIT 1`, account); err == sql.ErrNoRows {
+		err = errNotFound
+	}
+	return
+}
+
+// UserFetchWithKey fetches a user based on a key
+func (s *storagePostgres) UserFetchWithKey(key *asticrypt.PublicKey) (u *User, err error) {
+	astilog.Debug("Fetching user with key")
+	u = &User{}
+	if err = s.db.Get(u, `SELECT * FROM "user" WHERE client_public_key_fingerprint = $1 LIMIT 1`, key.Fingerprint()); err == sql.ErrNoRows {
+		err = errNotFound
+	}
+	return
+}
+
+// UserList lists all users
+func (s *storagePostgres) UserList() (us []*User, err error) {
+	astilog.Debug("Listing users")
+	us = []*User{}
+	err = s.db.Select(&us, `SELECT * FROM "user" ORDER BY id ASC`)
+	return
+}
+
+// UserUpdate updates a user
+func (s *storagePostgres) UserUpdate(u *User, cltPubKey *asticrypt.PublicKey, srvPrvKey []byte) (err error) {
+	astilog.Debug("Updating user")
+	_, err = s.db.Exec(`UPDATE "user" SET client_public_key_fingerprint = $1, client_public_key_hash = $2, client_public_key = $3, server_private_key = $4, updated_at = NOW() WHERE id = $5`, cltPubKey.Fingerprint(), cltPubKey.Hash(), []byte(cltPubKey.String()), srvPrvKey, u.ID)
+	return
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"database/sql"
+
+	"github.com/asticode/go-asticrypt"
+	"github.com/asticode/go-astilog"
+	"github.com/asticode/go-astitools/string"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+// sqliteSchema is the SQLite schema
+// Contrary to MySQL, it's not managed with patches and is created when the storage is opened
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS user (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    client_public_key_fingerprint BLOB NOT NULL UNIQUE,
+    client_public_key_hash BLOB NOT NULL UNIQUE,
+    client_public_key BLOB,
+    server_private_key BLOB,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS account (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER REFERENCES user(id),
+    addr TEXT NOT NULL UNIQUE,
+    token TEXT NOT NULL DEFAULT '',
+    validation_token TEXT NOT NULL DEFAULT '',
+    validated_at DATETIME DEFAULT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS prekey (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES user(id),
+    prekey_id TEXT NOT NULL,
+    key BLOB NOT NULL,
+    signature BLOB DEFAULT NULL,
+    signature_scheme TEXT DEFAULT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, prekey_id)
+);
+
+CREATE TABLE IF NOT EXISTS replay (
+    scope TEXT NOT NULL,
+    id TEXT NOT NULL,
+    expires_at DATETIME NOT NULL,
+    PRIMARY KEY (scope, id)
+);
+CREATE INDEX IF NOT EXISTS replay_expires_at ON replay (expires_at);
+`
+
+// SQLiteConfiguration represents the SQLite configuration
+type SQLiteConfiguration struct {
+	Path string `toml:"path"`
+}
+
+// newSQLite opens a SQLite db and creates its schema
+func newSQLite(c SQLiteConfiguration) (db *sqlx.DB, err error) {
+	// Open
+	if db, err = sqlx.Open("sqlite3", c.Path+"?_foreign_keys=on"); err != nil {
+		err = errors.Wrapf(err, "opening %s failed", c.Path)
+		return
+	}
+
+	// SQLite only allows one writer at a time
+	db.SetMaxOpenConns(1)
+
+	// Create schema
+	if _, err = db.Exec(sqliteSchema); err != nil {
+		err = errors.Wrap(err, "creating schema failed")
+		return
+	}
+	return
+}
+
+// storageSQLite represents a SQLite storage
+// It's meant for single-node deployments
+type storageSQLite struct {
+	db *sqlx.DB
+}
+
+// newStorageSQLite builds a new SQLite storage
+func newStorageSQLite(db *sqlx.DB) *storageSQLite {
+	return &storageSQLite{db: db}
+}
+
+// AccountCreate creates an account
+func (s *storageSQLite) AccountCreate(account string, u *User) (token string, err error) {
+	astilog.Debug("Creating new account")
+	token = astistring.RandomString(100)
+	_, err = s.db.Exec("INSERT INTO account (addr, user_id, validation_token) VALUES (?, ?, ?) ON CONFLICT (addr) DO UPDATE SET validation_token = excluded.validation_token, updated_at = CURRENT_TIMESTAMP", account, u.ID, token)
+	return
+}
+
+// AccountFetchWithValidationToken fetches an account based on a validation token
+func (s *storageSQLite) AccountFetchWithValidationToken(token string) (e *Account, err error) {
+	astilog.Debug("Fetching account with validation token")
+	e = &Account{}
+	if err = s.db.Get(e, "SELECT * FROM account WHERE validation_token = ? AND validated_at IS NULL LIMIT 1", token); err == sql.ErrNoRows {
+		err = errNotFound
+	}
+	return
+}
+
+// AccountList lists the accounts of a user
+func (s *storageSQLite) AccountList(u *User) (e []*Account, err error) {
+	astilog.Debug("Listing accounts")
+	e = []*Account{}
+	err = s.db.Select(&e, "SELECT * FROM account WHERE user_id = ? AND validated_at IS NOT NULL", u.ID)
+	return
+}
+
+// AccountValidate validates an account
+func (s *storageSQLite) AccountValidate(e *Account) (err error) {
+	astilog.Debug("Validating account")
+	_, err = s.db.Exec("UPDATE account SET validated_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP WHERE id = ?", e.ID)
+	return
+}
+
+// PrekeyBundleFetch fetches the prekey bundle of a user and consumes one of its one-time prekeys
+func (s *storageSQLite) PrekeyBundleFetch(u *User) (b *asticrypt.PrekeyBundle, err error) {
+	astilog.Debug("Fetching prekey bundle")
+
+	// Begin transaction
+	var tx *sqlx.Tx
+	if tx, err = s.db.Beginx(); err != nil {
+		err = errors.Wrap(err, "beginning transaction failed")
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// Fetch signed prekey
+	var p Prekey
+	if err = tx.Get(&p, "SELECT * FROM prekey WHERE user_id = ? AND signature IS NOT NULL ORDER BY id DESC LIMIT 1", u.ID); err == sql.ErrNoRows {
+		err = errNotFound
+		return
+	} else if err != nil {
+		err = errors.Wrap(err, "fetching signed prekey failed")
+		return
+	}
+	b = &asticrypt.PrekeyBundle{
+		IdentityKey:           u.ClientPublicKey,
+		SignatureScheme:       p.SignatureScheme.String,
+		SignedPrekey:          asticrypt.Prekey{ID: p.PrekeyID, Key: p.Key},
+		SignedPrekeySignature: p.Signature,
+	}
+
+	// Fetch one-time prekey
+	// Bundles without one-time prekeys are still valid once they've all been consumed
+	p = Prekey{}
+	if errGet := tx.Get(&p, "SELECT * FROM prekey WHERE user_id = ? AND signature IS NULL ORDER BY id ASC LIMIT 1", u.ID); errGet == nil {
+		// Consume one-time prekey
+		if _, err = tx.Exec("DELETE FROM prekey WHERE id = ?", p.ID); err != nil {
+			err = errors.Wrap(err, "deleting one-time prekey failed")
+			return
+		}
+		b.OneTimePrekeys = []asticrypt.Prekey{{ID: p.PrekeyID, Key: p.Key}}
+	} else if errGet != sql.ErrNoRows {
+		err = errors.Wrap(errGet, "fetching one-time prekey failed")
+		return
+	}
+
+	// Commit
+	if err = tx.Commit(); err != nil {
+		err = errors.Wrap(err, "committing transaction failed")
+		return
+	}
+	return
+}
+
+// PrekeyBundlePublish replaces the signed prekey of a user and adds its one-time prekeys
+func (s *storageSQLite) PrekeyBundlePublish(u *User, b asticrypt.PrekeyBundle) (err error) {
+	astilog.Debug("Publishing prekey bundle")
+
+	// Begin transaction
+	var tx *sqlx.Tx
+	if tx, err = s.db.Beginx(); err != nil {
+		err = errors.Wrap(err, "beginning transaction failed")
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// Replace signed prekey
+	if _, err = tx.Exec("DELETE FROM prekey WHERE user_id = ? AND signature IS NOT NULL", u.ID); err != nil {
+		err = errors.Wrap(err, "deleting signed prekey failed")
+		return
+	}
+	if _, err = tx.Exec("INSERT INTO prekey (user_id, prekey_id, key, signature, signature_scheme) VALUES (?, ?, ?, ?, ?)", u.ID, b.SignedPrekey.ID, b.SignedPrekey.Key, b.SignedPrekeySignature, b.SignatureScheme); err != nil {
+		err = errors.Wrap(err, "inserting signed prekey failed")
+		return
+	}
+
+	// Add one-time prekeys
+	for _, p := range b.OneTimePrekeys {
+		if _, err = tx.Exec("INSERT INTO prekey (user_id, prekey_id, key) VALUES (?, ?, ?)", u.ID, p.ID, p.Key); err != nil {
+			err = errors.Wrap(err, "inserting one-time prekey failed")
+			return
+		}
+	}
+
+	// Commit
+	if err = tx.Commit(); err != nil {
+		err = errors.Wrap(err, "committing transaction failed")
+		return
+	}
+	return
+}
+
+// UserCreate creates a user
+// Public keys are stored as blobs since they can only be scanned from []byte
+func (s *storageSQLite) UserCreate(cltPubKey *asticrypt.PublicKey, srvPrvKey []byte) (err error) {
+	astilog.Debug("Creating new user")
+	_, err = s.db.Exec("INSERT INTO user (client_public_key_fingerprint, client_public_key_hash, client_public_key, server_private_key) VALUES (?, ?, ?, ?)", cltPubKey.Fingerprint(), cltPubKey.Hash(), []byte(cltPubKey.String()), srvPrvKey)
+	return
+}
+
+// UserFetchWithAccount fetches a user based on an account
+func (s *storageSQLite) UserFetchWithAccount(account string) (u *User, err error) {
+	astilog.Debug("Fetching user with account")
+	u = &User{}
+	if err = s.db.Get(u, "SELECT u.* FROM user u INNER JOIN account e ON u.id = e.user_id WHERE e.addr = ? AND validated_at IS NOT NULL LIMIT 1", account); err == sql.ErrNoRows {
+		err = errNotFound
+	}
+	return
+}
+
+// UserFetchWithKey fetches a user based on a key
+func (s *storageSQLite) UserFetchWithKey(key *asticrypt.PublicKey) (u *User, err error) {
+	astilog.Debug("Fetching user with key")
+	u = &User{}
+	if err = s.db.Get(u, "SELECT * FROM user WHERE client_public_key_fingerprint = ? LIMIT 1", key.Fingerprint()); err == sql.ErrNoRows {
+		err = errNotFound
+	}
+	return
+}
+
+// UserList lists all users
+func (s *storageSQLite) UserList() (us []*User, err error) {
+	astilog.Debug("Listing users")
+	us = []*User{}
+	err = s.db.Select(&us, "SELECT * FROM user ORDER BY id ASC")
+	return
+}
+
+// UserUpdate updates a user
+func (s *storageSQLite) UserUpdate(u *User, cltPubKey *asticrypt.PublicKey, srvPrvKey []byte) (err error) {
+	astilog.Debug("Updating user")
+	_, err = s.db.Exec("UPDATE user SET client_public_key_fingerprint = ?, client_public_key_hash = ?, client_public_key = ?, server_private_key = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", cltPubKey.Fingerprint(), cltPubKey.Hash(), []byte(cltPubKey.String()), srvPrvKey, u.ID)
+	return
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/asticode/go-asticrypt"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNullTime(t *testing.T) {
+	var tm = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, v := range []interface{}{
+		tm,
+		[]byte("2020-01-02 03:04:05"),
+		"2020-01-02T03:04:05Z",
+	} {
+		var n nullTime
+		require.NoError(t, n.Scan(v), "%v", v)
+		assert.Equal(t, newNullTime(tm), n, "%v", v)
+	}
+
+	// Fractional seconds
+	var n nullTime
+	require.NoError(t, n.Scan([]byte("2020-01-02 03:04:05.123456")))
+	assert.Equal(t, tm.Add(123456*time.Microsecond), n.Time)
+
+	// Null
+	for _, v := range []interface{}{nil, []byte("0000-00-00 00:00:00")} {
+		n = newNullTime(tm)
+		require.NoError(t, n.Scan(v), "%v", v)
+		assert.False(t, n.Valid, "%v", v)
+	}
+	v, err := n.Value()
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+
+	// Invalid
+	assert.Error(t, n.Scan([]byte("invalid")))
+	assert.Error(t, n.Scan(1))
+}
+
+// testStorage runs the storage conformance suite against a storage
+// It expects an empty storage
+func testStorage(t *testing.T, s Storage) {
+	// Generate keys
+	var generateKey = func() *asticrypt.PrivateKey {
+		k, err := asticrypt.GeneratePrivateKeyWithType(asticrypt.KeyTypeEd25519, "")
+		require.NoError(t, err)
+		return k
+	}
+	var clt1, clt2 = generateKey(), generateKey()
+	var srv1, srv2 = []byte("server private key 1"), []byte("server private key 2")
+
+	t.Run("user", func(t *testing.T) {
+		// Unknown user
+		_, err := s.UserFetchWithKey(clt1.Public())
+		assert.Equal(t, errNotFound, err)
+
+		// No users
+		us, err := s.UserList()
+		require.NoError(t, err)
+		assert.Empty(t, us)
+
+		// Create
+		err = s.UserCreate(clt1.Public(), srv1)
+		require.NoError(t, err)
+		u, err := s.UserFetchWithKey(clt1.Public())
+		require.NoError(t, err)
+		assert.NotZero(t, u.ID)
+		assert.Equal(t, clt1.Public().Fingerprint(), u.ClientPublicKeyFingerprint)
+		assert.Equal(t, clt1.Public().Hash(), u.ClientPublicKeyHash)
+		assert.Equal(t, clt1.Public().String(), u.ClientPublicKey.String())
+		assert.Equal(t, srv1, u.ServerPrivateKey)
+
+		// Keys are unique
+		err = s.UserCreate(clt1.Public(), srv1)
+		assert.Error(t, err)
+
+		// Update
+		err = s.UserUpdate(u, clt2.Public(), srv2)
+		require.NoError(t, err)
+		_, err = s.UserFetchWithKey(clt1.Public())
+		assert.Equal(t, errNotFound, err)
+		u2, err := s.UserFetchWithKey(clt2.Public())
+		require.NoError(t, err)
+		assert.Equal(t, u.ID, u2.ID)
+		assert.Equal(t, clt2.Public().Fingerprint(), u2.ClientPublicKeyFingerprint)
+		assert.Equal(t, srv2, u2.ServerPrivateKey)
+
+		// List
+		us, err = s.UserList()
+		require.NoError(t, err)
+		require.Len(t, us, 1)
+		assert.Equal(t, u.ID, us[0].ID)
+		assert.Equal(t, srv2, us[0].ServerPrivateKey)
+	})
+
+	t.Run("account", func(t *testing.T) {
+		// Init
+		u, err := s.UserFetchWithKey(clt2.Public())
+		require.NoError(t, err)
+
+		// Create
+		token, err := s.AccountCreate("test@example.com", u)
+		require.NoError(t, err)
+		assert.NotEmpty(t, token)
+
+		// Accounts are not listed and don't identify users until validated
+		es, err := s.AccountList(u)
+		require.NoError(t, err)
+		assert.Empty(t, es)
+		_, err = s.UserFetchWithAccount("test@example.com")
+		assert.Equal(t, errNotFound, err)
+
+		// Creating the account again renews its validation token
+		token2, err := s.AccountCreate("test@example.com", u)
+		require.NoError(t, err)
+		assert.NotEqual(t, token, token2)
+		_, err = s.AccountFetchWithValidationToken(token)
+		assert.Equal(t, errNotFound, err)
+
+		// Validate
+		e, err := s.AccountFetchWithValidationToken(token2)
+		require.NoError(t, err)
+		assert.Equal(t, "test@example.com", e.Addr)
+		assert.Equal(t, u.ID, e.UserID)
+		err = s.AccountValidate(e)
+		require.NoError(t, err)
+		_, err = s.AccountFetchWithValidationToken(token2)
+		assert.Equal(t, errNotFound, err)
+
+		// Validated accounts are listed and identify users
+		es, err = s.AccountList(u)
+		require.NoError(t, err)
+		require.Len(t, es, 1)
+		assert.Equal(t, "test@example.com", es[0].Addr)
+		assert.True(t, es[0].ValidatedAt.Valid)
+		u2, err := s.UserFetchWithAccount("test@example.com")
+		require.NoError(t, err)
+		assert.Equal(t, u.ID, u2.ID)
+		_, err = s.UserFetchWithAccount("unknown@example.com")
+		assert.Equal(t, errNotFound, err)
+	})
+
+	t.Run("prekey", func(t *testing.T) {
+		// Init
+		u, err := s.UserFetchWithKey(clt2.Public())
+		require.NoError(t, err)
+
+		// No bundle
+		_, err = s.PrekeyBundleFetch(u)
+		assert.Equal(t, errNotFound, err)
+
+		// Publish
+		var ss asticrypt.PrekeySecrets
+		b, err := asticrypt.NewPrekeyBundle(clt2, &ss, 2)
+		require.NoError(t, err)
+		err = s.PrekeyBundlePublish(u, b)
+		require.NoError(t, err)
+
+		// One-time prekeys are consumed in order
+		for idx := 0; idx < 3; idx++ {
+			b2, err := s.PrekeyBundleFetch(u)
+			require.NoError(t, err)
+			assert.NoError(t, b2.Verify())
+			assert.Equal(t, b.SignedPrekey, b2.SignedPrekey)
+			if idx < 2 {
+				assert.Equal(t, []asticrypt.Prekey{b.OneTimePrekeys[idx]}, b2.OneTimePrekeys)
+			} else {
+				assert.Empty(t, b2.OneTimePrekeys)
+			}
+		}
+
+		// Publishing replaces the signed prekey
+		b, err = asticrypt.NewPrekeyBundle(clt2, &ss, 1)
+		require.NoError(t, err)
+		err = s.PrekeyBundlePublish(u, b)
+		require.NoError(t, err)
+		b2, err := s.PrekeyBundleFetch(u)
+		require.NoError(t, err)
+		assert.Equal(t, b.SignedPrekey, b2.SignedPrekey)
+		assert.Equal(t, b.OneTimePrekeys, b2.OneTimePrekeys)
+	})
+}
+
+func TestStorageMemory(t *testing.T) {
+	testStorage(t, newStorageMemory())
+}
+
+func TestStorageSQLite(t *testing.T) {
+	db, err := newSQLite(SQLiteConfiguration{Path: filepath.Join(t.TempDir(), "test.db")})
+	require.NoError(t, err)
+	defer db.Close()
+	testStorage(t, newStorageSQLite(db))
+
+	// Replay cache
+	var c = newReplayCacheSQLite(db)
+	err = c.Add("scope", "id", time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	err = c.Add("scope", "id", time.Now().Add(time.Minute))
+	assert.Equal(t, asticrypt.ErrReplayedMessage, err)
+	err = c.Add("other", "id", time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+}
+
+// TestStorageMySQL only runs if ASTICRYPT_TEST_MYSQL_DSN is set, with an empty and migrated db
+func TestStorageMySQL(t *testing.T) {
+	var dsn = os.Getenv("ASTICRYPT_TEST_MYSQL_DSN")
+	if len(dsn) == 0 {
+		t.Skip("ASTICRYPT_TEST_MYSQL_DSN is not set")
+	}
+	db, err := sqlx.Open("mysql", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+	testStorage(t, newStorageMySQL(db))
+}
+
+// TestStoragePostgres only runs if ASTICRYPT_TEST_POSTGRES_DSN is set, with an empty and migrated db
+func TestStoragePostgres(t *testing.T) {
+	var dsn = os.Getenv("ASTICRYPT_TEST_POSTGRES_DSN")
+	if len(dsn) == 0 {
+		t.Skip("ASTICRYPT_TEST_POSTGRES_DSN is not set")
+	}
+	db, err := newPostgres(PostgresConfiguration{DSN: dsn})
+	require.NoError(t, err)
+	defer db.Close()
+	testStorage(t, newStoragePostgres(db))
+
+	// Replay cache
+	var c = newReplayCachePostgres(db)
+	err = c.Add("scope", "id", time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	err = c.Add("scope", "id", time.Now().Add(time.Minute))
+	assert.Equal(t, asticrypt.ErrReplayedMessage, err)
+}
@@ -0,0 +1,278 @@
+package asticrypt
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Session HKDF infos
+// Requests and responses are sealed with different keys so that a response can't be reflected as a request
+const (
+	sessionInfoRequest  = "asticrypt session request"
+	sessionInfoResponse = "asticrypt session response"
+)
+
+// sessionTTLDefault is the default session TTL
+const sessionTTLDefault = time.Hour
+
+// ErrSessionExpired is returned when a session doesn't exist or has expired, in which case a new session must be
+// opened
+var ErrSessionExpired = errors.New("asticrypt: session expired")
+
+// Session represents a symmetric session established with a public key handshake
+// Messages sent within a session are only sealed with an AEAD which is much cheaper than public key operations
+type Session struct {
+	// Ephemeral public key of the server, sent back when the client provided one in which case the key is derived
+	// from the key agreement and is never sent
+	EphemeralKey []byte    `json:"ephemeral_key,omitempty"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	ID           string    `json:"id"`
+	Key          []byte    `json:"key,omitempty"`
+}
+
+// BodySessionOpen represents the payload sent to open a session
+// Clients predating forward secrecy send no payload
+type BodySessionOpen struct {
+	// Ephemeral public key of the client
+	EphemeralKey []byte `json:"ephemeral_key,omitempty"`
+}
+
+// NewSession creates a new session
+func NewSession(ttl time.Duration, now time.Time) (s Session, err error) {
+	// Generate ID
+	if s.ID, err = NewRequestID(); err != nil {
+		err = errors.Wrap(err, "generating ID failed")
+		return
+	}
+
+	// Generate key
+	s.Key = make([]byte, aesKeyBits/8)
+	if _, err = rand.Read(s.Key); err != nil {
+		err = errors.Wrap(err, "generating key failed")
+		return
+	}
+
+	// Set expiration date
+	s.ExpiresAt = now.Add(ttl)
+	return
+}
+
+// newEphemeralSession creates a new session whose key is derived from the key agreement between a new server
+// ephemeral key and the client ephemeral public key
+// The returned session holds the key and must be stored, the response only holds the server ephemeral public key.
+// Ephemeral keys are dropped once the key is derived so that compromising long-term keys doesn't expose sessions.
+func newEphemeralSession(ttl time.Duration, now time.Time, clientPub []byte) (s, resp Session, err error) {
+	// Create session
+	if s, err = NewSession(ttl, now); err != nil {
+		err = errors.Wrap(err, "creating session failed")
+		return
+	}
+
+	// Generate ephemeral key
+	var k *EphemeralKey
+	if k, err = GenerateEphemeralKey(); err != nil {
+		err = errors.Wrap(err, "generating ephemeral key failed")
+		return
+	}
+
+	// Derive key
+	if s.Key, err = k.deriveSessionKey(clientPub, clientPub, k.Public()); err != nil {
+		err = errors.Wrap(err, "deriving session key failed")
+		return
+	}
+
+	// Create response
+	resp = Session{
+		EphemeralKey: k.Public(),
+		ExpiresAt:    s.ExpiresAt,
+		ID:           s.ID,
+	}
+	return
+}
+
+// complete derives the key of a session received in response to a BodySessionOpen using the client ephemeral key
+func (s *Session) complete(k *EphemeralKey) (err error) {
+	// Check ephemeral key
+	if len(s.EphemeralKey) == 0 {
+		err = errors.New("server didn't send an ephemeral key")
+		return
+	}
+
+	// Derive key
+	if s.Key, err = k.deriveSessionKey(s.EphemeralKey, k.Public(), s.EphemeralKey); err != nil {
+		err = errors.Wrap(err, "deriving session key failed")
+		return
+	}
+	return
+}
+
+// IsExpired checks whether the session has expired
+func (s Session) IsExpired(now time.Time) bool {
+	return !now.Before(s.ExpiresAt)
+}
+
+// aead creates the AEAD of a direction
+func (s Session) aead(response bool) (a cipher.AEAD, err error) {
+	// Derive key
+	var info = sessionInfoRequest
+	if response {
+		info = sessionInfoResponse
+	}
+	var k = make([]byte, aesKeyBits/8)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, s.Key, []byte(s.ID), []byte(info)), k); err != nil {
+		err = errors.Wrap(err, "deriving key failed")
+		return
+	}
+
+	// Create AEAD
+	if a, err = newAEAD(EncryptionModeAES256GCM, k); err != nil {
+		err = errors.Wrap(err, "creating AEAD failed")
+		return
+	}
+	return
+}
+
+// BodySessionMessage represents a message sealed within a session
+type BodySessionMessage struct {
+	ID     string `json:"id"`
+	Nonce  []byte `json:"nonce"`
+	Sealed []byte `json:"sealed"`
+}
+
+// seal seals a message within the session
+func (s Session) seal(i interface{}, response bool) (m *BodySessionMessage, err error) {
+	// Marshal
+	var b []byte
+	if b, err = json.Marshal(i); err != nil {
+		err = errors.Wrap(err, "marshaling failed")
+		return
+	}
+
+	// Create AEAD
+	var a cipher.AEAD
+	if a, err = s.aead(response); err != nil {
+		err = errors.Wrap(err, "creating AEAD failed")
+		return
+	}
+
+	// Generate nonce
+	m = &BodySessionMessage{ID: s.ID, Nonce: make([]byte, a.NonceSize())}
+	if _, err = rand.Read(m.Nonce); err != nil {
+		err = errors.Wrap(err, "generating nonce failed")
+		return
+	}
+
+	// Seal
+	m.Sealed = a.Seal(nil, m.Nonce, b, []byte(s.ID))
+	return
+}
+
+// open opens a message sealed within the session
+func (s Session) open(m *BodySessionMessage, o interface{}, response bool) (err error) {
+	// Check ID
+	if m.ID != s.ID {
+		err = errors.New("session ID is invalid")
+		return
+	}
+
+	// Create AEAD
+	var a cipher.AEAD
+	if a, err = s.aead(response); err != nil {
+		err = errors.Wrap(err, "creating AEAD failed")
+		return
+	}
+
+	// Check nonce
+	if len(m.Nonce) != a.NonceSize() {
+		err = errors.New("nonce size is invalid")
+		return
+	}
+
+	// Open
+	var b []byte
+	if b, err = a.Open(nil, m.Nonce, m.Sealed, []byte(s.ID)); err != nil {
+		err = errors.Wrap(err, "opening failed")
+		return
+	}
+
+	// Unmarshal
+	if err = json.Unmarshal(b, o); err != nil {
+		err = errors.Wrap(err, "unmarshaling failed")
+		return
+	}
+	return
+}
+
+// StoredSession represents a session stored by a server alongside the public key of the client that opened it
+type StoredSession struct {
+	Session
+	PublicKey *PublicKey
+}
+
+// SessionStore represents a store of the sessions opened by clients
+type SessionStore interface {
+	// Get returns ErrSessionExpired if the session doesn't exist or has expired
+	Get(id string) (StoredSession, error)
+	Set(s StoredSession) error
+}
+
+// sessionStoreMemory represents an in-memory session store
+type sessionStoreMemory struct {
+	m        *sync.Mutex
+	purgedAt time.Time
+	ss       map[string]StoredSession
+}
+
+// NewSessionStoreMemory creates a new in-memory session store
+// Sessions are lost when the process restarts, clients then open new sessions
+func NewSessionStoreMemory() SessionStore {
+	return &sessionStoreMemory{
+		m:  &sync.Mutex{},
+		ss: make(map[string]StoredSession),
+	}
+}
+
+// Get implements the SessionStore interface
+func (s *sessionStoreMemory) Get(id string) (ss StoredSession, err error) {
+	// Lock
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	// Get
+	var ok bool
+	if ss, ok = s.ss[id]; !ok || ss.IsExpired(time.Now()) {
+		err = ErrSessionExpired
+		return
+	}
+	return
+}
+
+// Set implements the SessionStore interface
+func (s *sessionStoreMemory) Set(ss StoredSession) error {
+	// Lock
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	// Purge expired sessions
+	var now = time.Now()
+	if now.Sub(s.purgedAt) > time.Minute {
+		for k, v := range s.ss {
+			if v.IsExpired(now) {
+				delete(s.ss, k)
+			}
+		}
+		s.purgedAt = now
+	}
+
+	// Set
+	s.ss[ss.ID] = ss
+	return nil
+}
@@ -0,0 +1,57 @@
+package asticrypt_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asticode/go-asticrypt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession(t *testing.T) {
+	// Init
+	var pk1, pk2 = &asticrypt.PrivateKey{}, &asticrypt.PrivateKey{}
+	pk1.SetPassphrase("test")
+	err := pk1.UnmarshalText([]byte(prv1))
+	assert.NoError(t, err)
+	err = pk2.UnmarshalText([]byte(prv2))
+	assert.NoError(t, err)
+	var now = time.Now()
+	s, err := asticrypt.NewSession(time.Hour, now)
+	assert.NoError(t, err)
+	assert.False(t, s.IsExpired(now))
+	assert.True(t, s.IsExpired(now.Add(time.Hour)))
+
+	// Request
+	b, err := asticrypt.NewBodyMessageWithOptions("name", "test", pk1, pk1.Public(), pk2.Public(), now, asticrypt.BodyMessageOptions{Session: &s})
+	assert.NoError(t, err)
+	assert.Nil(t, b.Message)
+	assert.Nil(t, b.Key)
+	m, err := b.DecryptWithOptions(nil, nil, now, asticrypt.BodyMessageDecryptOptions{Session: &s})
+	assert.NoError(t, err)
+	assert.Equal(t, "\"test\"", string(m.Payload))
+
+	// Requests can't be reflected as responses
+	_, err = b.DecryptWithOptions(nil, nil, now, asticrypt.BodyMessageDecryptOptions{Response: true, Session: &s})
+	assert.Error(t, err)
+
+	// Wrong session
+	s2, err := asticrypt.NewSession(time.Hour, now)
+	assert.NoError(t, err)
+	_, err = b.DecryptWithOptions(nil, nil, now, asticrypt.BodyMessageDecryptOptions{Session: &s2})
+	assert.Error(t, err)
+
+	// Expired session
+	_, err = b.DecryptWithOptions(nil, nil, now.Add(time.Hour), asticrypt.BodyMessageDecryptOptions{Session: &s, Validity: 2 * time.Hour})
+	assert.Equal(t, asticrypt.ErrSessionExpired, err)
+
+	// Store
+	var st = asticrypt.NewSessionStoreMemory()
+	_, err = st.Get(s.ID)
+	assert.Equal(t, asticrypt.ErrSessionExpired, err)
+	err = st.Set(asticrypt.StoredSession{PublicKey: pk1.Public(), Session: s})
+	assert.NoError(t, err)
+	ss, err := st.Get(s.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, s, ss.Session)
+}
@@ -0,0 +1,167 @@
+package asticrypt
+
+import (
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"io"
+	"math/big"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// x25519KeyWrapInfo is the HKDF info used when deriving x25519 key wrapping keys
+const x25519KeyWrapInfo = "asticrypt x25519 key wrap"
+
+// curve25519P is the prime of the field curve25519 is defined over
+var curve25519P, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+// ed25519PrivateKeyToX25519 converts an ed25519 private key to an x25519 scalar
+// It's the conversion used by libsodium's crypto_sign_ed25519_sk_to_curve25519
+func ed25519PrivateKeyToX25519(k ed25519.PrivateKey) []byte {
+	var h = sha512.Sum512(k.Seed())
+	return h[:curve25519.ScalarSize]
+}
+
+// ed25519PublicKeyToX25519 converts an ed25519 public key to an x25519 public key
+// using the birational map u = (1 + y) / (1 - y) described in RFC 7748
+func ed25519PublicKeyToX25519(k ed25519.PublicKey) (o []byte, err error) {
+	// Check size
+	if len(k) != ed25519.PublicKeySize {
+		err = errors.New("invalid ed25519 public key size")
+		return
+	}
+
+	// Decode y which is encoded in little endian with the sign of x in the most significant bit
+	var b = reverse(k)
+	b[0] &= 0x7f
+	var y = new(big.Int).SetBytes(b)
+
+	// Compute 1 - y
+	var d = new(big.Int).Sub(big.NewInt(1), y)
+	d.Mod(d, curve25519P)
+	if d.Sign() == 0 {
+		err = errors.New("invalid ed25519 public key")
+		return
+	}
+
+	// Compute u
+	var u = new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, d.ModInverse(d, curve25519P))
+	u.Mod(u, curve25519P)
+
+	// Encode u in little endian
+	o = reverse(u.FillBytes(make([]byte, curve25519.PointSize)))
+	return
+}
+
+// reverse returns a reversed copy of a slice
+func reverse(i []byte) (o []byte) {
+	o = make([]byte, len(i))
+	for idx := range i {
+		o[len(i)-1-idx] = i[idx]
+	}
+	return
+}
+
+// x25519KeyWrappingKey derives the key wrapping key from a shared secret and both public keys
+func x25519KeyWrappingKey(shared, ephemeral, recipient []byte) (k []byte, err error) {
+	k = make([]byte, chacha20poly1305.KeySize)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, shared, append(append([]byte{}, ephemeral...), recipient...), []byte(x25519KeyWrapInfo)), k); err != nil {
+		err = errors.Wrap(err, "deriving key failed")
+		return
+	}
+	return
+}
+
+// wrapKeyX25519 wraps a key for an x25519 public key with an ephemeral key agreement
+// The output is the ephemeral public key followed by the sealed key
+func wrapKeyX25519(recipient, key []byte) (o []byte, err error) {
+	// Generate ephemeral key
+	var eph = make([]byte, curve25519.ScalarSize)
+	if _, err = rand.Read(eph); err != nil {
+		err = errors.Wrap(err, "generating ephemeral key failed")
+		return
+	}
+	var ephPub []byte
+	if ephPub, err = curve25519.X25519(eph, curve25519.Basepoint); err != nil {
+		err = errors.Wrap(err, "computing ephemeral public key failed")
+		return
+	}
+
+	// Compute shared secret
+	var shared []byte
+	if shared, err = curve25519.X25519(eph, recipient); err != nil {
+		err = errors.Wrap(err, "computing shared secret failed")
+		return
+	}
+
+	// Derive key wrapping key
+	var kwk []byte
+	if kwk, err = x25519KeyWrappingKey(shared, ephPub, recipient); err != nil {
+		err = errors.Wrap(err, "deriving key wrapping key failed")
+		return
+	}
+
+	// Create AEAD
+	var a cipher.AEAD
+	if a, err = chacha20poly1305.New(kwk); err != nil {
+		err = errors.Wrap(err, "creating AEAD failed")
+		return
+	}
+
+	// Seal
+	// The key wrapping key is never reused therefore the nonce can be constant
+	o = a.Seal(ephPub, make([]byte, a.NonceSize()), key, nil)
+	return
+}
+
+// unwrapKeyX25519 unwraps a key wrapped by wrapKeyX25519
+func unwrapKeyX25519(scalar, wrapped []byte) (key []byte, err error) {
+	// Check size
+	if len(wrapped) < curve25519.PointSize {
+		err = errors.New("wrapped key is too short")
+		return
+	}
+	var ephPub = wrapped[:curve25519.PointSize]
+
+	// Compute public key
+	var pub []byte
+	if pub, err = curve25519.X25519(scalar, curve25519.Basepoint); err != nil {
+		err = errors.Wrap(err, "computing public key failed")
+		return
+	}
+
+	// Compute shared secret
+	var shared []byte
+	if shared, err = curve25519.X25519(scalar, ephPub); err != nil {
+		err = errors.Wrap(err, "computing shared secret failed")
+		return
+	}
+
+	// Derive key wrapping key
+	var kwk []byte
+	if kwk, err = x25519KeyWrappingKey(shared, ephPub, pub); err != nil {
+		err = errors.Wrap(err, "deriving key wrapping key failed")
+		return
+	}
+
+	// Create AEAD
+	var a cipher.AEAD
+	if a, err = chacha20poly1305.New(kwk); err != nil {
+		err = errors.Wrap(err, "creating AEAD failed")
+		return
+	}
+
+	// Open
+	if key, err = a.Open(nil, make([]byte, a.NonceSize()), wrapped[curve25519.PointSize:], nil); err != nil {
+		err = errors.Wrap(err, "opening key failed")
+		return
+	}
+	return
+}